@@ -92,6 +92,48 @@ func GetCertificateUsers(tlsState *tls.ConnectionState) ([]string, error) {
 	return getCertificatePrincipals(peerCert), nil
 }
 
+// HasClientCert returns true if the peer presented at least one certificate
+// during the handshake. The certificate is not necessarily verified, see
+// UserFromClientCert. The zero ConnectionState has no client certificate.
+func HasClientCert(state tls.ConnectionState) bool {
+	return len(state.PeerCertificates) > 0
+}
+
+// UserFromClientCert returns the user named by the CommonName of the verified
+// client certificate, after applying the principal map. Unlike
+// GetCertificateUsers, it only considers certificates that were verified
+// during the handshake.
+func UserFromClientCert(state tls.ConnectionState) (string, error) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", errors.Errorf("no verified client certificates in request")
+	}
+	// The first certificate of each verified chain is the peer certificate.
+	peerCert := state.VerifiedChains[0][0]
+	if peerCert.Subject.CommonName == "" {
+		return "", errors.Errorf("client certificate has an empty CommonName")
+	}
+	return transformPrincipal(peerCert.Subject.CommonName), nil
+}
+
+// TenantFromClientCert returns the tenant named by the Organization of the
+// verified client certificate. Like UserFromClientCert, it only considers
+// certificates that were verified during the handshake. Certificates with no
+// or several organizations are rejected as ambiguous.
+func TenantFromClientCert(state tls.ConnectionState) (string, error) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", errors.Errorf("no verified client certificates in request")
+	}
+	// The first certificate of each verified chain is the peer certificate.
+	orgs := state.VerifiedChains[0][0].Subject.Organization
+	switch {
+	case len(orgs) == 0 || (len(orgs) == 1 && orgs[0] == ""):
+		return "", errors.Errorf("client certificate has no Organization")
+	case len(orgs) > 1:
+		return "", errors.Errorf("client certificate has %d Organizations, expected one", len(orgs))
+	}
+	return orgs[0], nil
+}
+
 // ContainsUser returns true if the specified user is present in the list of
 // users.
 func ContainsUser(user string, users []string) bool {
@@ -154,6 +154,100 @@ func TestGetCertificateUsersMapped(t *testing.T) {
 	}
 }
 
+func TestUserFromClientCert(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer func() { _ = security.SetCertPrincipalMap(nil) }()
+
+	// verified moves the peer certificates of the fake state into a single
+	// verified chain.
+	verified := func(spec string) tls.ConnectionState {
+		state := makeFakeTLSState(spec)
+		if len(state.PeerCertificates) > 0 {
+			state.VerifiedChains = [][]*x509.Certificate{state.PeerCertificates}
+		}
+		return *state
+	}
+
+	testCases := []struct {
+		state    tls.ConnectionState
+		expected string
+		errStr   string
+	}{
+		{verified("foo"), "foo", ""},
+		{verified("foo,bar;CA"), "foo", ""},
+		{verified("mapped;CA"), "bar", ""},
+		{verified(""), "", "no verified client certificates"},
+		// Peer certificates that were not verified are ignored.
+		{*makeFakeTLSState("foo"), "", "no verified client certificates"},
+		{verified(",foo"), "", "empty CommonName"},
+	}
+
+	if err := security.SetCertPrincipalMap([]string{"mapped:bar"}); err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range testCases {
+		user, err := security.UserFromClientCert(tc.state)
+		if !testutils.IsError(err, tc.errStr) {
+			t.Errorf("#%d: expected error %q, got %v", i, tc.errStr, err)
+			continue
+		}
+		if user != tc.expected {
+			t.Errorf("#%d: expected user %q, got %q", i, tc.expected, user)
+		}
+	}
+}
+
+func TestHasClientCert(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	if security.HasClientCert(tls.ConnectionState{}) {
+		t.Error("expected no client certificate in the zero state")
+	}
+	if security.HasClientCert(*makeFakeTLSState("")) {
+		t.Error("expected no client certificate in an empty state")
+	}
+	if !security.HasClientCert(*makeFakeTLSState("foo")) {
+		t.Error("expected a client certificate")
+	}
+}
+
+func TestTenantFromClientCert(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	verified := func(orgs ...string) tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "foo", Organization: orgs}}
+		return tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+	}
+
+	testCases := []struct {
+		state    tls.ConnectionState
+		expected string
+		errStr   string
+	}{
+		{verified("tenant-10"), "tenant-10", ""},
+		{verified(), "", "no Organization"},
+		{verified(""), "", "no Organization"},
+		{verified("tenant-10", "tenant-11"), "", "2 Organizations, expected one"},
+		{tls.ConnectionState{}, "", "no verified client certificates"},
+		// Peer certificates that were not verified are ignored.
+		{tls.ConnectionState{PeerCertificates: verified("tenant-10").PeerCertificates},
+			"", "no verified client certificates"},
+	}
+	for i, tc := range testCases {
+		tenant, err := security.TenantFromClientCert(tc.state)
+		if !testutils.IsError(err, tc.errStr) {
+			t.Errorf("#%d: expected error %q, got %v", i, tc.errStr, err)
+			continue
+		}
+		if tenant != tc.expected {
+			t.Errorf("#%d: expected tenant %q, got %q", i, tc.expected, tenant)
+		}
+	}
+}
+
 func TestAuthenticationHook(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer func() { _ = security.SetCertPrincipalMap(nil) }()
@@ -0,0 +1,92 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+)
+
+// caPools are the CA pools set by UpdateCAPool.
+type caPools struct {
+	rootCAs, clientCAs *x509.CertPool
+}
+
+// CAPoolHolder holds the CA pools replacing the ones of the server configs it
+// is passed to through TLSOptions, eg: to trust a new CA cluster-wide before
+// reissuing the certificates it signs. A single CAPoolHolder may be shared by
+// several configs: UpdateCAPool then updates all of them. The zero value holds
+// no pools: the configs use their own until UpdateCAPool is called.
+//
+// The configs loaded from Vault are rebuilt with the same TLSOptions on each
+// renewal, so the pools held are kept across renewals.
+type CAPoolHolder struct {
+	// pools holds the *caPools set by UpdateCAPool, if any.
+	pools atomic.Value
+}
+
+// UpdateCAPool replaces both the pools used to verify peer server and client
+// certificates by the configs with the certificates in caPEM. caPEM must hold
+// all the CA certificates to trust, including the current ones during a
+// rotation.
+//
+// As handshakes may be reading the configs concurrently, they are not
+// modified: each config serves a copy of itself with the new pools instead,
+// made on the first handshake after the update and reused until the next one.
+// The handshakes in progress complete with the pools they started with.
+//
+// The copies of a config made with Clone or CloneWithOverrides serve the
+// pools too. The copies made with CloneWithOverrides keep their overrides, but
+// the ones made with Clone are served the settings of the original config
+// instead of their own.
+func (h *CAPoolHolder) UpdateCAPool(caPEM []byte) error {
+	if isEmptyPEM(caPEM) {
+		return errors.Mark(errors.New("CA certificate PEM data is empty"), ErrEmptyCAFile)
+	}
+	certPool, err := certPoolFromPEM(caPEM)
+	if err != nil {
+		return errors.Mark(errors.Wrap(err, "failed to parse PEM data to pool"), ErrBadCAPEM)
+	}
+	h.pools.Store(&caPools{rootCAs: certPool, clientCAs: certPool})
+	return nil
+}
+
+// caPoolsConfig is a config serving the pools it was built with.
+type caPoolsConfig struct {
+	pools  *caPools
+	config *tls.Config
+}
+
+// install sets up cfg to serve the CA pools held by h. It must be called
+// before any other GetConfigForClient callback is set.
+func (h *CAPoolHolder) install(cfg *tls.Config) {
+	// served holds the caPoolsConfig built for the pools last served, if any.
+	var served atomic.Value
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pools, _ := h.pools.Load().(*caPools)
+		if pools == nil {
+			return nil, nil
+		}
+		if cached, ok := served.Load().(caPoolsConfig); ok && cached.pools == pools {
+			return cached.config, nil
+		}
+		// Concurrent handshakes may build the config twice: either copy is
+		// fine to serve.
+		updated := cfg.Clone()
+		updated.GetConfigForClient = nil
+		updated.RootCAs, updated.ClientCAs = pools.rootCAs, pools.clientCAs
+		served.Store(caPoolsConfig{pools: pools, config: updated})
+		return updated, nil
+	}
+}
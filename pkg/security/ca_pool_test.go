@@ -0,0 +1,163 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/security/securitytest"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+)
+
+func TestUpdateCAPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	caPEM, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCAPEM, newCAKeyPEM := generateTestCA(t)
+
+	// A client certificate signed by the new CA.
+	certPEM, keyPEM, err := security.GenerateClientCertAndKey(
+		newCAPEM, newCAKeyPEM, security.RootUser,
+		security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newClientConfig := embeddedClientTLSConfig(t)
+	newClientConfig.Certificates = []tls.Certificate{cert}
+	oldClientConfig := embeddedClientTLSConfig(t)
+
+	for _, withStats := range []bool{false, true} {
+		var holder security.CAPoolHolder
+		opts := security.TLSOptions{CAPools: &holder}
+		if withStats {
+			opts.HandshakeStats = &security.HandshakeStats{}
+		}
+		serverConfig := embeddedServerTLSConfig(t, opts)
+
+		if _, err := testHandshake(t, serverConfig, newClientConfig); !testutils.IsError(
+			err, "certificate signed by unknown authority",
+		) {
+			t.Fatalf("expected unknown authority error, got %v", err)
+		}
+
+		// Trust both CAs, and run handshakes concurrently with the update.
+		bothPEM := append(append(append([]byte(nil), caPEM...), '\n'), newCAPEM...)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				if _, err := testHandshake(t, serverConfig, oldClientConfig); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		if err := holder.UpdateCAPool(bothPEM); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		for _, clientConfig := range []*tls.Config{oldClientConfig, newClientConfig} {
+			if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Only trust the new CA.
+		if err := holder.UpdateCAPool(newCAPEM); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testHandshake(t, serverConfig, newClientConfig); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testHandshake(t, serverConfig, oldClientConfig); !testutils.IsError(
+			err, "certificate signed by unknown authority",
+		) {
+			t.Fatalf("expected unknown authority error, got %v", err)
+		}
+
+		// The config serving the pools is only built once per update.
+		first, err := serverConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second, err := serverConfig.GetConfigForClient(&tls.ClientHelloInfo{}); err != nil {
+			t.Fatal(err)
+		} else if first != second {
+			t.Error("expected the same config to be served until the next update")
+		}
+	}
+
+	// The copies made with CloneWithOverrides share the pools, and keep
+	// their overrides once the pools are updated.
+	var holder security.CAPoolHolder
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{CAPools: &holder})
+	requiredConfig := security.CloneWithOverrides(serverConfig, func(cfg *tls.Config) {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	})
+	noCertConfig := embeddedClientTLSConfig(t)
+	noCertConfig.Certificates = nil
+	if err := holder.UpdateCAPool(newCAPEM); err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []*tls.Config{serverConfig, requiredConfig} {
+		if _, err := testHandshake(t, config, newClientConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := testHandshake(t, serverConfig, noCertConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, requiredConfig, noCertConfig); !testutils.IsError(
+		err, "client didn't provide a certificate|bad certificate|certificate required",
+	) {
+		t.Fatalf("expected missing client certificate error, got %v", err)
+	}
+
+	// The GetConfigForClient callbacks set by the caller are only called for
+	// actual handshakes.
+	var tailoredHolder security.CAPoolHolder
+	tailoredConfig := embeddedServerTLSConfig(t, security.TLSOptions{
+		CAPools: &tailoredHolder,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo, base *tls.Config) (*tls.Config, error) {
+			if hello.Conn == nil {
+				return nil, errors.New("expected the connection of the client")
+			}
+			return nil, nil
+		},
+	})
+	if err := tailoredHolder.UpdateCAPool(newCAPEM); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, tailoredConfig, newClientConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := holder.UpdateCAPool([]byte("foo")); !errors.Is(err, security.ErrBadCAPEM) {
+		t.Fatalf("expected ErrBadCAPEM, got %v", err)
+	}
+	if err := holder.UpdateCAPool(nil); !errors.Is(err, security.ErrEmptyCAFile) {
+		t.Fatalf("expected ErrEmptyCAFile, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+
+	"github.com/cockroachdb/cockroach/pkg/util/cache"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+)
+
+// certPoolCacheSize is the maximum number of CA pools kept in the cache.
+const certPoolCacheSize = 64
+
+// certPoolCache caches the pools parsed from PEM-encoded CA certificates, so
+// that loading the same CA repeatedly (eg: for multiple listeners) does not
+// reparse it every time. Entries are keyed by the SHA-256 of the PEM data.
+var certPoolCache = struct {
+	syncutil.Mutex
+	pools *cache.UnorderedCache
+}{
+	pools: cache.NewUnorderedCache(cache.Config{
+		Policy: cache.CacheLRU,
+		ShouldEvict: func(size int, key, value interface{}) bool {
+			return size > certPoolCacheSize
+		},
+	}),
+}
+
+// certPoolFromPEM returns a pool holding the certificates in caPEM, which can
+// also hold DER-encoded certificates. It returns an error if caPEM is
+// malformed (see splitPEMBlocks), holds anything but certificates, or holds no
+// certificates at all.
+//
+// The pool is shared by all callers passing the same PEM data and must not be
+// modified.
+func certPoolFromPEM(caPEM []byte) (*x509.CertPool, error) {
+	key := sha256.Sum256(caPEM)
+
+	certPoolCache.Lock()
+	pool, ok := certPoolCache.pools.Get(key)
+	certPoolCache.Unlock()
+	if ok {
+		return pool.(*x509.CertPool), nil
+	}
+
+	certs, err := PEMContentsToX509(derCertsToPEM(caPEM))
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	certPool := x509.NewCertPool()
+	for _, cert := range certs {
+		certPool.AddCert(cert)
+	}
+
+	certPoolCache.Lock()
+	defer certPoolCache.Unlock()
+	// Another caller may have parsed the same data concurrently. Keep the pool
+	// already in the cache so that all callers share it.
+	if pool, ok := certPoolCache.pools.Get(key); ok {
+		return pool.(*x509.CertPool), nil
+	}
+	certPoolCache.pools.Add(key, certPool)
+	return certPool, nil
+}
+
+// ClearCertPoolCache clears the cache of parsed CA pools. It is meant for
+// tests that swap the asset loader and need subsequent loads to parse the new
+// CA certificates.
+func ClearCertPoolCache() {
+	certPoolCache.Lock()
+	defer certPoolCache.Unlock()
+	certPoolCache.pools.Clear()
+}
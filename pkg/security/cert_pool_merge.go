@@ -0,0 +1,92 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+
+	"github.com/cockroachdb/errors"
+)
+
+// CAPool is a pool of CA certificates built by this package. Unlike
+// x509.CertPool, it keeps its certificates, so that pools can be merged: see
+// MergeCertPools.
+type CAPool struct {
+	// Pool holds the certificates, eg: to be set as the RootCAs or ClientCAs
+	// of a config. It must not be modified.
+	Pool *x509.CertPool
+
+	certs []*x509.Certificate
+}
+
+// NewCAPoolFromPEM returns a pool holding the CA certificates in caPEM, which
+// can also hold DER-encoded certificates.
+func NewCAPoolFromPEM(caPEM []byte) (*CAPool, error) {
+	if isEmptyPEM(caPEM) {
+		return nil, errors.Mark(errors.New("CA certificate PEM data is empty"), ErrEmptyCAFile)
+	}
+	certs, err := PEMContentsToX509(derCertsToPEM(caPEM))
+	if err != nil {
+		return nil, errors.Mark(errors.Wrap(err, "failed to parse CA certificates"), ErrBadCAPEM)
+	}
+	if len(certs) == 0 {
+		return nil, errors.Mark(errors.New("no CA certificates found in PEM data"), ErrBadCAPEM)
+	}
+	b := newCertPoolBuilder()
+	for _, cert := range certs {
+		b.add(cert)
+	}
+	return b.pool, nil
+}
+
+// certPoolBuilder builds a CAPool, skipping the certificates already added.
+// x509.CertPool skips them too, but the certificates kept by the CAPool would
+// otherwise keep growing as pools sharing CAs are merged.
+type certPoolBuilder struct {
+	pool   *CAPool
+	hashes map[[sha256.Size]byte]struct{}
+}
+
+func newCertPoolBuilder() *certPoolBuilder {
+	return &certPoolBuilder{
+		pool:   &CAPool{Pool: x509.NewCertPool()},
+		hashes: make(map[[sha256.Size]byte]struct{}),
+	}
+}
+
+// add adds cert to the pool, unless a certificate with the same DER encoding
+// was already added.
+func (b *certPoolBuilder) add(cert *x509.Certificate) {
+	hash := sha256.Sum256(cert.Raw)
+	if _, ok := b.hashes[hash]; ok {
+		return
+	}
+	b.hashes[hash] = struct{}{}
+	b.pool.Pool.AddCert(cert)
+	b.pool.certs = append(b.pool.certs, cert)
+}
+
+// MergeCertPools returns a new pool holding the certificates of all the passed
+// in pools, eg: to trust an old and a new CA during a migration. nil pools are
+// ignored. The certificates held by several pools are only added once.
+func MergeCertPools(pools ...*CAPool) *CAPool {
+	b := newCertPoolBuilder()
+	for _, pool := range pools {
+		if pool == nil {
+			continue
+		}
+		for _, cert := range pool.certs {
+			b.add(cert)
+		}
+	}
+	return b.pool
+}
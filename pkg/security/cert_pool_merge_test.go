@@ -0,0 +1,104 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+)
+
+func TestMergeCertPools(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	opts := security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}}
+	type ca struct{ certPEM, keyPEM []byte }
+	var oldCA, newCA ca
+	oldCA.certPEM, oldCA.keyPEM = generateTestCA(t)
+	newCA.certPEM, newCA.keyPEM = generateTestCA(t)
+
+	serverConfig := func(ca ca, clientCAs *x509.CertPool) *tls.Config {
+		nodePEM, nodeKeyPEM, err := security.GenerateNodeCertAndKey(
+			ca.certPEM, ca.keyPEM, []string{"localhost"}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := security.NewServerTLSConfigWithSNI(
+			security.CertKeyPair{CertPEM: nodePEM, KeyPEM: nodeKeyPEM}, nil, ca.certPEM, ca.certPEM,
+			security.TLSOptions{ClientCAs: clientCAs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	oldConfig := serverConfig(oldCA, nil)
+	caPool := func(caPEM []byte) *security.CAPool {
+		pool, err := security.NewCAPoolFromPEM(caPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pool
+	}
+	oldPool, newPool := caPool(oldCA.certPEM), caPool(newCA.certPEM)
+
+	// nil pools are ignored.
+	merged := security.MergeCertPools(oldPool, nil, newPool)
+	if n := len(merged.Pool.Subjects()); n != 2 {
+		t.Fatalf("expected 2 CA certificates, got %d", n)
+	}
+	// Merged pools can be merged again. Duplicates are dropped.
+	if n := len(security.MergeCertPools(merged, oldPool).Pool.Subjects()); n != 2 {
+		t.Errorf("expected 2 CA certificates, got %d", n)
+	}
+	if n := len(security.MergeCertPools().Pool.Subjects()); n != 0 {
+		t.Errorf("expected an empty pool, got %d CA certificates", n)
+	}
+
+	if _, err := security.NewCAPoolFromPEM(nil); !errors.Is(err, security.ErrEmptyCAFile) {
+		t.Errorf("expected ErrEmptyCAFile, got %v", err)
+	}
+	if _, err := security.NewCAPoolFromPEM([]byte("foo")); !errors.Is(err, security.ErrBadCAPEM) {
+		t.Errorf("expected ErrBadCAPEM, got %v", err)
+	}
+
+	clientConfig := func(ca ca) *tls.Config {
+		clientPEM, clientKeyPEM, err := security.GenerateClientCertAndKey(
+			ca.certPEM, ca.keyPEM, security.RootUser, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, _, err := security.LoadTLSConfigAndCert(clientPEM, clientKeyPEM, oldCA.certPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.ServerName = "localhost"
+		return cfg
+	}
+
+	// Clients with certificates signed by either CA are accepted, while the
+	// pool of the old CA alone rejects the clients of the new one.
+	mergedConfig := serverConfig(oldCA, merged.Pool)
+	for _, ca := range []ca{oldCA, newCA} {
+		if _, err := testHandshake(t, mergedConfig, clientConfig(ca)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := testHandshake(t, oldConfig, clientConfig(newCA)); !testutils.IsError(
+		err, "certificate signed by unknown authority",
+	) {
+		t.Errorf("expected unknown authority error, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"context"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// CertSource provides the files of a certs directory by file name, eg: from a
+// secret store instead of the filesystem. It is passed to the ...WithSource
+// variants of the certs directory loaders.
+type CertSource interface {
+	// Read returns the contents of the named file, eg: "node.crt". As some
+	// files are optional, the error must satisfy os.IsNotExist if the file
+	// does not exist.
+	Read(name string) ([]byte, error)
+}
+
+// dirCertSource is a CertSource reading the files in a directory through an
+// asset loader.
+type dirCertSource struct {
+	al  AssetLoader
+	dir string
+}
+
+var _ CertSource = dirCertSource{}
+
+// NewDirCertSource returns a CertSource reading the files in dir through the
+// asset loader, as the certs directory loaders do. If dir is prefixed with
+// "embedded=", the embedded certs are read.
+func NewDirCertSource(dir string) (CertSource, error) {
+	al, dir, err := resolveAssetPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	return dirCertSource{al: al, dir: dir}, nil
+}
+
+// Read implements the CertSource interface.
+func (s dirCertSource) Read(name string) ([]byte, error) {
+	path := filepath.Join(s.dir, name)
+	// The embedded asset loader only reports missing files as such when
+	// stating them.
+	if _, err := s.al.Stat(path); err != nil {
+		return nil, err
+	}
+	return s.al.ReadFile(path)
+}
+
+// MemoryCertSource is a CertSource serving the files it holds, by file name.
+type MemoryCertSource map[string][]byte
+
+var _ CertSource = MemoryCertSource{}
+
+// Read implements the CertSource interface.
+func (s MemoryCertSource) Read(name string) ([]byte, error) {
+	contents, ok := s[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return contents, nil
+}
+
+// renamedCertSource is a CertSource serving some files of another one under
+// the standard names, eg: node.crt.
+type renamedCertSource struct {
+	src CertSource
+	// names maps the standard names to the names of the files in src.
+	names map[string]string
+}
+
+var _ CertSource = renamedCertSource{}
+
+// Read implements the CertSource interface.
+func (s renamedCertSource) Read(name string) ([]byte, error) {
+	if renamed, ok := s.names[name]; ok {
+		name = renamed
+	}
+	return s.src.Read(name)
+}
+
+// contextCertSource is a CertSource failing the reads once a context is
+// done.
+type contextCertSource struct {
+	ctx context.Context
+	src CertSource
+}
+
+var _ CertSource = contextCertSource{}
+
+// Read implements the CertSource interface.
+func (s contextCertSource) Read(name string) ([]byte, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.src.Read(name)
+}
+
+// readOptionalFromSource reads the named file from src, or returns nil if it
+// does not exist.
+func readOptionalFromSource(src CertSource, name string) ([]byte, error) {
+	contents, err := src.Read(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return contents, err
+}
+
+// readCACertFromSource reads the CA certificate of src. If the file does not
+// exist, the CA certificates in certPEM, the contents of the node certificate
+// file, are returned instead: some issuers bundle the CA chain with the node
+// certificate and do not ship a separate CA certificate. If there are none, the
+// error reading the CA certificate is returned.
+func readCACertFromSource(src CertSource, certPEM []byte) ([]byte, error) {
+	caPath := sourcePath(src, CACertFilename())
+	caPEM, err := src.Read(CACertFilename())
+	if err == nil {
+		log.Infof(context.Background(), "using CA certificate %s", caPath)
+		return caPEM, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	certs, parseErr := PEMContentsToX509(certPEM)
+	if parseErr != nil || len(certs) < 2 {
+		return nil, err
+	}
+	// The leaf is not necessarily first: see orderCertificateChain.
+	var bundledPEM []byte
+	for _, cert := range certs {
+		if cert.IsCA {
+			bundledPEM = append(bundledPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+	}
+	if bundledPEM == nil {
+		return nil, err
+	}
+	log.Infof(context.Background(), "%s not found, using the CA certificates bundled in %s",
+		caPath, sourcePath(src, NodeCertFilename()))
+	return bundledPEM, nil
+}
+
+// sourcePath returns the path of the named file of src, for error messages.
+func sourcePath(src CertSource, name string) string {
+	if s, ok := src.(renamedCertSource); ok {
+		if renamed, ok := s.names[name]; ok {
+			name = renamed
+		}
+		return sourcePath(s.src, name)
+	}
+	if s, ok := src.(contextCertSource); ok {
+		return sourcePath(s.src, name)
+	}
+	if s, ok := src.(dirCertSource); ok {
+		return filepath.Join(s.dir, name)
+	}
+	return name
+}
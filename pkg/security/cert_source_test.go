@@ -0,0 +1,121 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/security/securitytest"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+)
+
+// failingCertSource is a CertSource failing to read the files in failing.
+type failingCertSource struct {
+	security.MemoryCertSource
+	failing map[string]bool
+}
+
+func (s failingCertSource) Read(name string) ([]byte, error) {
+	if s.failing[name] {
+		return nil, errors.Errorf("could not fetch %s", name)
+	}
+	return s.MemoryCertSource.Read(name)
+}
+
+func TestCertSource(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	caPEM := readAsset(security.EmbeddedCACert)
+	certPEM := readAsset(security.EmbeddedNodeCert)
+	keyPEM := readAsset(security.EmbeddedNodeKey)
+	src := security.MemoryCertSource{
+		security.CACertFilename():   caPEM,
+		security.NodeCertFilename(): certPEM,
+		security.NodeKeyFilename():  keyPEM,
+	}
+	k8sSrc := security.MemoryCertSource{
+		"ca.crt":  caPEM,
+		"tls.crt": certPEM,
+		"tls.key": keyPEM,
+	}
+
+	serverConfig, err := security.LoadTLSConfigFromDirWithSource(src, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k8sConfig, err := security.LoadTLSConfigFromK8sDirWithSource(k8sSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := security.LoadClientTLSConfigFromDirWithSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, serverConfig := range []*tls.Config{serverConfig, k8sConfig} {
+		if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Errors reading files are returned, even for optional files: only
+	// missing optional files are skipped.
+	for _, name := range []string{
+		security.CACertFilename(), security.NodeCertFilename(), security.NodeKeyFilename(),
+	} {
+		failing := failingCertSource{src, map[string]bool{name: true}}
+		if _, err := security.LoadTLSConfigFromDirWithSource(
+			failing, security.CertsDirOptions{},
+		); !testutils.IsError(err, "could not fetch "+name) {
+			t.Errorf("expected error fetching %s, got %v", name, err)
+		}
+		if _, err := security.LoadClientTLSConfigFromDirWithSource(failing); !testutils.IsError(
+			err, "could not fetch "+name,
+		) {
+			t.Errorf("expected error fetching %s, got %v", name, err)
+		}
+	}
+	failing := failingCertSource{src, map[string]bool{security.NodeOCSPStapleFilename(): true}}
+	if _, err := security.LoadTLSConfigFromDirWithSource(
+		failing, security.CertsDirOptions{},
+	); !testutils.IsError(err, "could not fetch node.ocsp") {
+		t.Errorf("expected error fetching the OCSP staple, got %v", err)
+	}
+
+	// The directory source reads through the asset loader.
+	dirSrc, err := security.NewDirCertSource("embedded=" + security.EmbeddedCertsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := dirSrc.Read(security.CACertFilename()); err != nil {
+		t.Fatal(err)
+	} else if string(contents) != string(caPEM) {
+		t.Error("unexpected CA certificate contents")
+	}
+	if _, err := dirSrc.Read("missing.crt"); !os.IsNotExist(err) {
+		t.Errorf("expected missing file error, got %v", err)
+	}
+	if _, err := security.MemoryCertSource(nil).Read("missing.crt"); !os.IsNotExist(err) {
+		t.Errorf("expected missing file error, got %v", err)
+	}
+}
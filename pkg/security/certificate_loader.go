@@ -22,6 +22,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/util/envutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/errors"
 )
 
@@ -52,17 +53,73 @@ var defaultAssetLoader = AssetLoader{
 	Stat:     os.Stat,
 }
 
-// assetLoaderImpl is used to list/read/stat security assets.
-var assetLoaderImpl = defaultAssetLoader
+// assetLoaderState holds the asset loader. It is guarded by a mutex so that
+// tests can swap the loader while certificates are being loaded.
+var assetLoaderState = struct {
+	syncutil.RWMutex
+	// impl is used to list/read/stat security assets.
+	impl AssetLoader
+	// overridden is true if impl is not the default loader, eg: when loading
+	// the embedded test certs.
+	overridden bool
+}{impl: defaultAssetLoader}
 
 // SetAssetLoader overrides the asset loader with the passed-in one.
 func SetAssetLoader(al AssetLoader) {
-	assetLoaderImpl = al
+	assetLoaderState.Lock()
+	defer assetLoaderState.Unlock()
+	assetLoaderState.impl = al
+	assetLoaderState.overridden = true
 }
 
 // ResetAssetLoader restores the asset loader to the default value.
 func ResetAssetLoader() {
-	assetLoaderImpl = defaultAssetLoader
+	assetLoaderState.Lock()
+	defer assetLoaderState.Unlock()
+	assetLoaderState.impl = defaultAssetLoader
+	assetLoaderState.overridden = false
+}
+
+// assetLoaderImpl returns the current asset loader.
+func assetLoaderImpl() AssetLoader {
+	al, _ := currentAssetLoader()
+	return al
+}
+
+// currentAssetLoader returns the current asset loader, and whether it is not
+// the default one.
+func currentAssetLoader() (_ AssetLoader, overridden bool) {
+	assetLoaderState.RLock()
+	defer assetLoaderState.RUnlock()
+	return assetLoaderState.impl, assetLoaderState.overridden
+}
+
+// embeddedPrefix is the prefix of paths to embedded certs.
+const embeddedPrefix = "embedded="
+
+// resolveAssetPath strips the "embedded=" prefix from path, and returns the
+// asset loader to read it with. Embedded certs are only available through an
+// asset loader installed with SetAssetLoader (eg:
+// securitytest.EmbeddedAssets): with the default loader, an error is returned
+// instead of looking for a literal "embedded=..." path on disk.
+func resolveAssetPath(path string) (AssetLoader, string, error) {
+	al, overridden := currentAssetLoader()
+	if !strings.HasPrefix(path, embeddedPrefix) {
+		return al, path, nil
+	}
+	if !overridden {
+		return AssetLoader{}, "", errors.Errorf("cannot load %q: embedded certs are not available in this build", path)
+	}
+	return al, strings.TrimPrefix(path, embeddedPrefix), nil
+}
+
+// readAsset reads the file at path, which may be prefixed with "embedded=".
+func readAsset(path string) ([]byte, error) {
+	al, path, err := resolveAssetPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return al.ReadFile(path)
 }
 
 // PemUsage indicates the purpose of a given certificate.
@@ -289,7 +346,7 @@ func (cl *CertificateLoader) TestDisablePermissionChecks() {
 // usage, and looks for their keys.
 // It populates the certificates field.
 func (cl *CertificateLoader) Load() error {
-	fileInfos, err := assetLoaderImpl.ReadDir(cl.certsDir)
+	fileInfos, err := assetLoaderImpl().ReadDir(cl.certsDir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Directory does not exist.
@@ -334,7 +391,7 @@ func (cl *CertificateLoader) Load() error {
 
 		// Read the cert file contents.
 		fullCertPath := filepath.Join(cl.certsDir, filename)
-		certPEMBlock, err := assetLoaderImpl.ReadFile(fullCertPath)
+		certPEMBlock, err := assetLoaderImpl().ReadFile(fullCertPath)
 		if err != nil {
 			log.Warningf(context.Background(), "could not read certificate file %s: %v", fullPath, err)
 		}
@@ -370,7 +427,7 @@ func (cl *CertificateLoader) findKey(ci *CertInfo) error {
 	fullKeyPath := filepath.Join(cl.certsDir, keyFilename)
 
 	// Stat the file. This follows symlinks.
-	info, err := assetLoaderImpl.Stat(fullKeyPath)
+	info, err := assetLoaderImpl().Stat(fullKeyPath)
 	if err != nil {
 		return errors.Errorf("could not stat key file %s: %v", fullKeyPath, err)
 	}
@@ -391,7 +448,7 @@ func (cl *CertificateLoader) findKey(ci *CertInfo) error {
 	}
 
 	// Read key file.
-	keyPEMBlock, err := assetLoaderImpl.ReadFile(fullKeyPath)
+	keyPEMBlock, err := assetLoaderImpl().ReadFile(fullKeyPath)
 	if err != nil {
 		return errors.Errorf("could not read key file %s: %v", fullKeyPath, err)
 	}
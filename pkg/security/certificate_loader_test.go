@@ -22,6 +22,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -118,6 +119,47 @@ func TestLoadEmbeddedCerts(t *testing.T) {
 	}
 }
 
+func TestSetAssetLoaderConcurrentLoads(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer ResetTest()
+
+	// Swap the asset loader while loading the embedded certs: loads either
+	// succeed or fail for lack of embedded certs, and must not race with the
+	// swaps (under -race).
+	stop := make(chan struct{})
+	swapperDone := make(chan struct{})
+	go func() {
+		defer close(swapperDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			security.ResetAssetLoader()
+			security.SetAssetLoader(securitytest.EmbeddedAssets)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, err := security.LoadTLSConfigFromDir(
+					"embedded="+security.EmbeddedCertsDir, security.CertsDirOptions{})
+				if err != nil && !testutils.IsError(err, "embedded certs are not available") {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-swapperDone
+}
+
 func countLoadedCertificates(certsDir string) (int, error) {
 	cl := security.NewCertificateLoader(certsDir)
 	if err := cl.Load(); err != nil {
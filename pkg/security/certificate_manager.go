@@ -213,6 +213,10 @@ func (cm *CertificateManager) ClientCACertPath() string {
 	return filepath.Join(cm.certsDir, "ca-client"+certExtension)
 }
 
+// IntermediateCACertFilename returns the expected file name for the
+// intermediate CA certificates served along with the node certificate.
+func IntermediateCACertFilename() string { return "ca-intermediate" + certExtension }
+
 // UICACertPath returns the expected file path for the CA certificate
 // used to verify Admin UI certificates.
 func (cm *CertificateManager) UICACertPath() string {
@@ -239,6 +243,25 @@ func NodeKeyFilename() string {
 	return "node" + keyExtension
 }
 
+// NodeECCertFilename returns the expected file name for the optional ECDSA
+// node certificate, served instead of the node certificate to the clients
+// supporting it.
+func NodeECCertFilename() string {
+	return "node.ec" + certExtension
+}
+
+// NodeECKeyFilename returns the expected file name for the key of the optional
+// ECDSA node certificate.
+func NodeECKeyFilename() string {
+	return "node.ec" + keyExtension
+}
+
+// NodeOCSPStapleFilename returns the expected file name for the OCSP response
+// stapled to the node certificate.
+func NodeOCSPStapleFilename() string {
+	return "node.ocsp"
+}
+
 // UICertPath returns the expected file path for the UI certificate.
 func (cm *CertificateManager) UICertPath() string {
 	return filepath.Join(cm.certsDir, "ui"+certExtension)
@@ -367,6 +390,13 @@ func makeError(err error, s string) *Error { return makeErrorf(err, "%s", s) }
 // LoadCertificates creates a CertificateLoader to load all certs and keys.
 // Upon success, it swaps the existing certificates for the new ones.
 func (cm *CertificateManager) LoadCertificates() error {
+	return cm.loadCertificates(nil)
+}
+
+// loadCertificates is LoadCertificates, calling checkNodeCert (if not nil) on
+// the loaded node certificate before swapping anything in. The check sees the
+// same file contents as the ones swapped in.
+func (cm *CertificateManager) loadCertificates(checkNodeCert func(*CertInfo) error) error {
 	cl := NewCertificateLoader(cm.certsDir)
 	if err := cl.Load(); err != nil {
 		return makeErrorf(err, "problem loading certs directory %s", cm.certsDir)
@@ -394,6 +424,12 @@ func (cm *CertificateManager) LoadCertificates() error {
 		}
 	}
 
+	if checkNodeCert != nil {
+		if err := checkNodeCert(nodeCert); err != nil {
+			return err
+		}
+	}
+
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	if cm.initialized {
@@ -528,7 +564,8 @@ func (cm *CertificateManager) getEmbeddedServerTLSConfig(
 		nodeCert.FileContents,
 		nodeCert.KeyFileContents,
 		ca.FileContents,
-		clientCA.FileContents)
+		clientCA.FileContents,
+		TLSOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,247 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// CRLChecker rejects peer certificates listed in a certificate revocation
+// list. It is installed in a server TLS config through TLSOptions.CRLChecker.
+//
+// Each CRL must be signed by one of the CA certificates the checker is created
+// with, and only revokes the certificates issued by that CA.
+type CRLChecker struct {
+	// path is the file the CRLs were loaded from, if any.
+	path string
+	// caCerts are the certificates the CRL signatures are checked against.
+	caCerts []*x509.Certificate
+
+	mu struct {
+		syncutil.RWMutex
+		// revoked is the set of revoked certificates.
+		revoked map[revokedCert]struct{}
+		// modTime is the modification time of path at the last (re)load.
+		modTime time.Time
+	}
+}
+
+// revokedCert identifies a revoked certificate: serial numbers are only
+// unique for a given issuer. CAs are identified by both their name and their
+// key, since distinct CAs may share the same name.
+type revokedCert struct {
+	// issuerSubject and issuerKey are the DER-encoded subject and public key
+	// of the CA that issued the certificate.
+	issuerSubject, issuerKey string
+	// serial is the serial number of the certificate, in base 10.
+	serial string
+}
+
+// makeRevokedCert returns the revokedCert for the certificate with the
+// passed-in serial number issued by issuer.
+func makeRevokedCert(issuer *x509.Certificate, serial *big.Int) revokedCert {
+	return revokedCert{
+		issuerSubject: string(issuer.RawSubject),
+		issuerKey:     string(issuer.RawSubjectPublicKeyInfo),
+		serial:        serial.String(),
+	}
+}
+
+// LoadCRL parses one DER-encoded CRL, or one or more PEM-encoded CRLs, and
+// returns a CRLChecker rejecting the certificates they list. Each CRL must be
+// signed by one of the certificates in caPEM, and must not be past its next
+// update time.
+func LoadCRL(crlPEM, caPEM []byte) (*CRLChecker, error) {
+	c, err := newCRLChecker("", caPEM)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := c.parseCRL(crlPEM)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.revoked = revoked
+	return c, nil
+}
+
+// LoadCRLFile is like LoadCRL, but reads the CRLs from path. Changes to the
+// file are picked up by MaybeReload.
+func LoadCRLFile(path string, caPEM []byte) (*CRLChecker, error) {
+	c, err := newCRLChecker(path, caPEM)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.MaybeReload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newCRLChecker returns a CRLChecker checking the CRL signatures against the
+// certificates in caPEM. No CRL is loaded.
+func newCRLChecker(path string, caPEM []byte) (*CRLChecker, error) {
+	caCerts, err := PEMContentsToX509(caPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse CA certificates")
+	}
+	if len(caCerts) == 0 {
+		return nil, errors.New("at least one CA certificate is required to verify CRLs")
+	}
+	return &CRLChecker{path: path, caCerts: caCerts}, nil
+}
+
+// parseCRL returns the set of certificates revoked by the CRLs in contents.
+func (c *CRLChecker) parseCRL(contents []byte) (map[revokedCert]struct{}, error) {
+	ders := [][]byte{contents}
+	if bytes.Contains(contents, pemBeginMarker) {
+		blocks, err := splitPEMBlocks(contents)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse CRL")
+		}
+		ders = nil
+		for _, block := range blocks {
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+		if len(ders) == 0 {
+			return nil, errors.New("failed to parse CRL: no X509 CRL block found")
+		}
+	}
+
+	revoked := make(map[revokedCert]struct{})
+	now := timeutil.Now()
+	for i, der := range ders {
+		crl, err := x509.ParseDERCRL(der)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse CRL #%d", i)
+		}
+		issuer := c.crlIssuer(crl)
+		if issuer == nil {
+			return nil, errors.Errorf("CRL #%d issued by %s is not signed by a trusted CA certificate",
+				i, crl.TBSCertList.Issuer)
+		}
+		if crl.HasExpired(now) {
+			return nil, errors.Errorf("CRL #%d issued by %s expired at %s",
+				i, crl.TBSCertList.Issuer, crl.TBSCertList.NextUpdate)
+		}
+		for _, rc := range crl.TBSCertList.RevokedCertificates {
+			revoked[makeRevokedCert(issuer, rc.SerialNumber)] = struct{}{}
+		}
+	}
+	return revoked, nil
+}
+
+// crlIssuer returns the CA certificate whose key signed crl, or nil if none
+// did.
+func (c *CRLChecker) crlIssuer(crl *pkix.CertificateList) *x509.Certificate {
+	for _, caCert := range c.caCerts {
+		if caCert.CheckCRLSignature(crl) == nil {
+			return caCert
+		}
+	}
+	return nil
+}
+
+// MaybeReload reloads the CRLs if their file was modified since the last
+// successful load. It returns true if the CRLs were reloaded. It is a no-op for
+// checkers not loaded from a file.
+func (c *CRLChecker) MaybeReload() (bool, error) {
+	if c.path == "" {
+		return false, nil
+	}
+	info, err := assetLoaderImpl().Stat(c.path)
+	if err != nil {
+		return false, errors.Errorf("could not stat CRL: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mu.revoked != nil && info.ModTime().Equal(c.mu.modTime) {
+		return false, nil
+	}
+	contents, err := assetLoaderImpl().ReadFile(c.path)
+	if err != nil {
+		return false, err
+	}
+	revoked, err := c.parseCRL(contents)
+	if err != nil {
+		return false, makeErrorf(err, "could not load CRL %s", c.path)
+	}
+	c.mu.revoked = revoked
+	c.mu.modTime = info.ModTime()
+	return true, nil
+}
+
+// StartReloading periodically reloads the CRL file until the stopper stops.
+func (c *CRLChecker) StartReloading(stopper *stop.Stopper) {
+	stopper.RunWorker(context.Background(), func(ctx context.Context) {
+		ticker := time.NewTicker(certReloadPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopper.ShouldQuiesce():
+				return
+			case <-ticker.C:
+				if reloaded, err := c.MaybeReload(); err != nil {
+					log.Warningf(ctx, "could not reload CRL: %v", err)
+				} else if reloaded {
+					log.Infof(ctx, "successfully reloaded CRL %s", c.path)
+				}
+			}
+		}
+	})
+}
+
+// IsRevoked returns true if the certificate is listed in a CRL signed by its
+// issuer, looked up among the CA certificates of the checker.
+func (c *CRLChecker) IsRevoked(cert *x509.Certificate) bool {
+	for _, caCert := range c.caCerts {
+		if bytes.Equal(caCert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(caCert) == nil &&
+			c.isRevokedBy(cert, caCert) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRevokedBy returns true if the certificate is listed in a CRL signed by
+// issuer.
+func (c *CRLChecker) isRevokedBy(cert, issuer *x509.Certificate) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.mu.revoked[makeRevokedCert(issuer, cert.SerialNumber)]
+	return ok
+}
+
+// VerifyPeerCertificate implements the tls.Config.VerifyPeerCertificate
+// callback. It rejects verified peer certificates listed in a CRL signed by
+// the next certificate in the chain. Connections without a peer certificate
+// are let through.
+func (c *CRLChecker) VerifyPeerCertificate(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		if len(chain) > 1 && c.isRevokedBy(chain[0], chain[1]) {
+			return errors.Errorf("certificate with serial number %s has been revoked", chain[0].SerialNumber)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/security/securitytest"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// embeddedAsset returns the contents of the embedded certs file name.
+func embeddedAsset(t *testing.T, name string) []byte {
+	t.Helper()
+	contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+// makeCRL returns a PEM-encoded CRL signed by the CA, revoking the serial
+// numbers passed in.
+func makeCRL(
+	t *testing.T, caPEM, caKeyPEM []byte, nextUpdate time.Time, serials ...*big.Int,
+) []byte {
+	t.Helper()
+	caCerts, err := security.PEMContentsToX509(caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := security.PEMToPrivateKey(caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := timeutil.Now()
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: now,
+		})
+	}
+	crl, err := caCerts[0].CreateCRL(rand.Reader, caKey, revoked, now.Add(-time.Hour), nextUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+}
+
+// embeddedSerial returns the serial number of the embedded certificate name.
+func embeddedSerial(t *testing.T, name string) *big.Int {
+	t.Helper()
+	certs, err := security.PEMContentsToX509(embeddedAsset(t, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs[0].SerialNumber
+}
+
+// makeTestCRL returns a PEM-encoded CRL signed by the embedded CA, revoking
+// the embedded certificates with the passed-in file names.
+func makeTestCRL(t *testing.T, revokedNames ...string) []byte {
+	t.Helper()
+	var serials []*big.Int
+	for _, name := range revokedNames {
+		serials = append(serials, embeddedSerial(t, name))
+	}
+	return makeCRL(t, embeddedAsset(t, security.EmbeddedCACert), embeddedAsset(t, security.EmbeddedCAKey),
+		timeutil.Now().Add(time.Hour), serials...)
+}
+
+func TestCRLChecker(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	caPEM := embeddedAsset(t, security.EmbeddedCACert)
+	if _, err := security.LoadCRL([]byte("not a CRL"), caPEM); !testutils.IsError(err, "failed to parse CRL") {
+		t.Fatalf("expected parse error, got %v", err)
+	}
+	if _, err := security.LoadCRL(makeTestCRL(t), nil); !testutils.IsError(err, "at least one CA certificate is required") {
+		t.Fatalf("expected missing CA error, got %v", err)
+	}
+
+	checker, err := security.LoadCRL(makeTestCRL(t, security.EmbeddedRootCert), caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{CRLChecker: checker})
+
+	// The root client certificate is revoked.
+	_, err = testHandshake(t, serverConfig, embeddedClientTLSConfig(t))
+	if !testutils.IsError(err, "has been revoked") {
+		t.Fatalf("expected revoked certificate error, got %v", err)
+	}
+
+	// The testuser client certificate is not.
+	clientConfig, err := security.LoadClientTLSConfig(
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedTestUserCert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedTestUserKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRLCheckerVerifiesCRLs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	caPEM := embeddedAsset(t, security.EmbeddedCACert)
+	otherCAPEM, otherCAKeyPEM := generateTestCA(t)
+	rootSerial := embeddedSerial(t, security.EmbeddedRootCert)
+	rootCerts, err := security.PEMContentsToX509(embeddedAsset(t, security.EmbeddedRootCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCRL := makeCRL(t, otherCAPEM, otherCAKeyPEM, timeutil.Now().Add(time.Hour), rootSerial)
+
+	// The CRL must be signed by a trusted CA.
+	if _, err := security.LoadCRL(otherCRL, caPEM); !testutils.IsError(err, "is not signed by a trusted CA certificate") {
+		t.Fatalf("expected signature error, got %v", err)
+	}
+
+	// The CRL must not be stale.
+	staleCRL := makeCRL(t, caPEM, embeddedAsset(t, security.EmbeddedCAKey), timeutil.Now().Add(-time.Minute))
+	if _, err := security.LoadCRL(staleCRL, caPEM); !testutils.IsError(err, "expired at") {
+		t.Fatalf("expected expired CRL error, got %v", err)
+	}
+
+	// A serial number revoked by one CA does not revoke the certificate with
+	// the same serial number issued by another CA.
+	bothCAs := append(append([]byte(nil), caPEM...), otherCAPEM...)
+	checker, err := security.LoadCRL(append(makeTestCRL(t), otherCRL...), bothCAs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checker.IsRevoked(rootCerts[0]) {
+		t.Fatal("expected the root certificate not to be revoked by the other CA")
+	}
+	checker, err = security.LoadCRL(append(makeTestCRL(t, security.EmbeddedRootCert), otherCRL...), bothCAs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checker.IsRevoked(rootCerts[0]) {
+		t.Fatal("expected the root certificate to be revoked by its CA")
+	}
+}
+
+func TestCRLCheckerReload(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	crlPath := filepath.Join(dir, "ca.crl")
+	if err := ioutil.WriteFile(crlPath, makeTestCRL(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checker, err := security.LoadCRLFile(crlPath, embeddedAsset(t, security.EmbeddedCACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCerts, err := security.PEMContentsToX509(embeddedAsset(t, security.EmbeddedRootCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checker.IsRevoked(rootCerts[0]) {
+		t.Fatal("unexpected revoked certificate")
+	}
+	if reloaded, err := checker.MaybeReload(); err != nil || reloaded {
+		t.Fatalf("expected no reload, got %t, %v", reloaded, err)
+	}
+
+	// Revoke the root client certificate.
+	if err := ioutil.WriteFile(crlPath, makeTestCRL(t, security.EmbeddedRootCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, crlPath, time.Minute)
+	if reloaded, err := checker.MaybeReload(); err != nil || !reloaded {
+		t.Fatalf("expected reload, got %t, %v", reloaded, err)
+	}
+	if !checker.IsRevoked(rootCerts[0]) {
+		t.Fatal("expected revoked certificate")
+	}
+}
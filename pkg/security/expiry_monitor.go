@@ -0,0 +1,102 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"context"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// defaultExpiryCheckInterval is the interval at which StartExpiryMonitor
+// checks the node certificate.
+const defaultExpiryCheckInterval = time.Hour
+
+// StartExpiryMonitor is like StartExpiryMonitorWithInterval, checking the node
+// certificate every hour.
+func StartExpiryMonitor(
+	certDir string,
+	threshold time.Duration,
+	onNearExpiry func(cert *x509.Certificate, remaining time.Duration),
+) (stop func()) {
+	return StartExpiryMonitorWithInterval(certDir, threshold, defaultExpiryCheckInterval, onNearExpiry)
+}
+
+// StartExpiryMonitorWithInterval starts a goroutine parsing the node
+// certificate in certDir right away and then every interval, and calling
+// onNearExpiry whenever it expires in less than threshold, eg: to alert
+// operators. The callback is called at each check until the certificate is
+// renewed, with the time remaining until the certificate expires, which is
+// negative once it has expired. The certificate is read anew at each check, so
+// that renewals are picked up; the errors reading it are logged.
+//
+// The returned function stops the goroutine and waits for it to exit,
+// including any running callback. It may be called several times.
+func StartExpiryMonitorWithInterval(
+	certDir string,
+	threshold, interval time.Duration,
+	onNearExpiry func(cert *x509.Certificate, remaining time.Duration),
+) (stop func()) {
+	stopper := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			checkNodeCertExpiry(certDir, threshold, onNearExpiry)
+			select {
+			case <-stopper:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stopper) })
+		<-done
+	}
+}
+
+// checkNodeCertExpiry calls onNearExpiry if the node certificate in certDir
+// expires in less than threshold.
+func checkNodeCertExpiry(
+	certDir string,
+	threshold time.Duration,
+	onNearExpiry func(cert *x509.Certificate, remaining time.Duration),
+) {
+	ctx := context.Background()
+	src, err := NewDirCertSource(certDir)
+	if err != nil {
+		log.Warningf(ctx, "could not check the expiration of the node certificate: %v", err)
+		return
+	}
+	certPEM, err := src.Read(NodeCertFilename())
+	if err != nil {
+		log.Warningf(ctx, "could not check the expiration of the node certificate: %v", err)
+		return
+	}
+	cert, err := parseLeafCertificate(certPEM)
+	if err != nil {
+		log.Warningf(ctx, "could not check the expiration of node certificate %s: %v",
+			sourcePath(src, NodeCertFilename()), err)
+		return
+	}
+	if remaining := cert.NotAfter.Sub(timeutil.Now()); remaining < threshold {
+		onNearExpiry(cert, remaining)
+	}
+}
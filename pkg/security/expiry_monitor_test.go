@@ -0,0 +1,102 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+)
+
+func TestStartExpiryMonitor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	caPEM, caKeyPEM := generateTestCA(t)
+	certPEM, _, err := security.GenerateNodeCertAndKey(caPEM, caKeyPEM, []string{"localhost"},
+		security.CertOptions{
+			KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true},
+			ValidFor:   time.Hour,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(certsDir, security.NodeCertFilename()), certPEM, 0644,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu struct {
+		syncutil.Mutex
+		calls     int
+		cert      *x509.Certificate
+		remaining time.Duration
+	}
+	onNearExpiry := func(cert *x509.Certificate, remaining time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		mu.calls++
+		mu.cert, mu.remaining = cert, remaining
+	}
+	calls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return mu.calls
+	}
+
+	// The certificate does not expire within the threshold.
+	stop := security.StartExpiryMonitorWithInterval(certsDir, time.Minute, time.Millisecond, onNearExpiry)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	if n := calls(); n != 0 {
+		t.Fatalf("expected no callback, got %d calls", n)
+	}
+
+	// The callback is called at each check while the certificate expires
+	// within the threshold.
+	stop = security.StartExpiryMonitorWithInterval(certsDir, 2*time.Hour, time.Millisecond, onNearExpiry)
+	testutils.SucceedsSoon(t, func() error {
+		if n := calls(); n < 2 {
+			return errors.Errorf("expected at least 2 calls, got %d", n)
+		}
+		return nil
+	})
+	stop()
+	// Stopping waits for the goroutine to exit, and can be done again.
+	stop()
+	n := calls()
+	time.Sleep(10 * time.Millisecond)
+	if calls() != n {
+		t.Error("expected no callback after stopping the monitor")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if mu.cert.Subject.CommonName != security.NodeUser {
+		t.Errorf("expected the node certificate, got %q", mu.cert.Subject.CommonName)
+	}
+	if mu.remaining <= 0 || mu.remaining > time.Hour {
+		t.Errorf("expected less than an hour remaining, got %s", mu.remaining)
+	}
+}
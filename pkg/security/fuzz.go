@@ -0,0 +1,65 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// +build gofuzz
+
+package security
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+)
+
+// FuzzSplitPEMBlocks checks that the blocks returned by splitPEMBlocks are
+// returned again, identical, when splitting their encoding.
+func FuzzSplitPEMBlocks(data []byte) int {
+	blocks, err := splitPEMBlocks(data)
+	if err != nil || len(blocks) == 0 {
+		return 0
+	}
+	var encoded []byte
+	for _, block := range blocks {
+		blockPEM := pem.EncodeToMemory(block)
+		if blockPEM == nil {
+			// The headers cannot be encoded.
+			return 0
+		}
+		encoded = append(encoded, blockPEM...)
+	}
+	again, err := splitPEMBlocks(encoded)
+	if err != nil {
+		panic(fmt.Errorf("could not split encoded blocks: %v\n-- encoded:\n%s", err, encoded))
+	}
+	if len(again) != len(blocks) {
+		panic(fmt.Errorf("split %d blocks, then %d once encoded\n-- encoded:\n%s",
+			len(blocks), len(again), encoded))
+	}
+	for i := range blocks {
+		if !equalPEMBlocks(blocks[i], again[i]) {
+			panic(fmt.Errorf("block #%d changed once encoded: %+v, then %+v", i, blocks[i], again[i]))
+		}
+	}
+	return 1
+}
+
+// equalPEMBlocks returns true if a and b have the same type, headers and
+// contents.
+func equalPEMBlocks(a, b *pem.Block) bool {
+	if a.Type != b.Type || !bytes.Equal(a.Bytes, b.Bytes) || len(a.Headers) != len(b.Headers) {
+		return false
+	}
+	for k, v := range a.Headers {
+		if b.Headers[k] != v {
+			return false
+		}
+	}
+	return true
+}
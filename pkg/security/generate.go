@@ -0,0 +1,260 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Utilities to generate PEM-encoded certificates and keys in memory, without
+// touching a certs directory. See the Create* functions to generate
+// certificates on disk.
+
+const (
+	// defaultGeneratedKeySize is the RSA key size used when none is specified.
+	defaultGeneratedKeySize = 2048
+	// minGeneratedKeySize is the smallest RSA key size generated unless
+	// KeyOptions.AllowWeakKey is set.
+	minGeneratedKeySize = 2048
+	// defaultGeneratedCAValidity is the CA validity used when none is
+	// specified. It matches the default of `cockroach cert create-ca`.
+	defaultGeneratedCAValidity = 10 * 366 * 24 * time.Hour
+	// defaultGeneratedValidity is the validity of other certificates used when
+	// none is specified.
+	defaultGeneratedValidity = 366 * 24 * time.Hour
+)
+
+// ErrWeakKey indicates that the requested key parameters are too weak, eg:
+// an RSA key of less than 2048 bits. It can be tested for with errors.Is.
+var ErrWeakKey = errors.New("weak key parameters")
+
+// KeyType is the type of private key to generate.
+type KeyType int
+
+const (
+	// RSAKey is an RSA key. This is the default.
+	RSAKey KeyType = iota
+	// ECDSAKey is an ECDSA key on the P-256 curve.
+	ECDSAKey
+	// Ed25519Key is an Ed25519 key.
+	Ed25519Key
+)
+
+// KeyOptions holds the settings for generating a private key.
+type KeyOptions struct {
+	// KeyType is the type of key to generate.
+	KeyType KeyType
+	// KeySize is the size in bits of RSA keys. If zero, 2048 is used.
+	// It is ignored for other key types. Smaller sizes are rejected with
+	// ErrWeakKey, unless AllowWeakKey is set.
+	KeySize int
+	// AllowWeakKey allows generating RSA keys of less than 2048 bits, which
+	// are faster to generate. It must only be set by tests which generate
+	// many throwaway certificates.
+	AllowWeakKey bool
+}
+
+// generateKey generates a private key as specified by the options.
+func (opts KeyOptions) generateKey() (crypto.Signer, error) {
+	switch opts.KeyType {
+	case RSAKey:
+		keySize := opts.KeySize
+		if keySize == 0 {
+			keySize = defaultGeneratedKeySize
+		}
+		if keySize < minGeneratedKeySize && !opts.AllowWeakKey {
+			return nil, errors.Mark(errors.Errorf("RSA key size %d is less than the minimum of %d bits",
+				keySize, minGeneratedKeySize), ErrWeakKey)
+		}
+		return rsa.GenerateKey(rand.Reader, keySize)
+	case ECDSAKey:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case Ed25519Key:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, errors.Errorf("unknown key type %d", opts.KeyType)
+	}
+}
+
+// CACertOptions holds the settings for generating a CA certificate.
+type CACertOptions struct {
+	KeyOptions
+
+	// Subject is the subject of the CA certificate. If the CommonName is
+	// empty, the subject of the CA certificates generated by `cockroach cert`
+	// is used.
+	Subject pkix.Name
+	// NotBefore is the start of the validity of the certificate. If zero, the
+	// certificate is valid from a day ago to account for clock skew, and
+	// ValidFor is counted from now.
+	NotBefore time.Time
+	// ValidFor is the validity of the certificate. If zero, ten years is used.
+	ValidFor time.Duration
+}
+
+// GenerateCACertAndKey generates a self-signed CA certificate and its private
+// key. They are returned PEM-encoded, in the format found in certs
+// directories.
+func GenerateCACertAndKey(opts CACertOptions) (certPEM, keyPEM []byte, _ error) {
+	key, err := opts.generateKey()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate CA key")
+	}
+
+	validFor := opts.ValidFor
+	if validFor == 0 {
+		validFor = defaultGeneratedCAValidity
+	}
+	template, err := newTemplateWithValidity(caCommonName, opts.NotBefore, validFor)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Subject.CommonName != "" {
+		template.Subject = opts.Subject
+	}
+	setCAFields(template)
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create CA certificate")
+	}
+	return encodeCertAndKey(certDER, key)
+}
+
+// newTemplateWithValidity is like newTemplate, but the certificate is valid
+// for validFor starting at notBefore, if set.
+func newTemplateWithValidity(
+	commonName string, notBefore time.Time, validFor time.Duration,
+) (*x509.Certificate, error) {
+	template, err := newTemplate(commonName, validFor)
+	if err != nil {
+		return nil, err
+	}
+	if !notBefore.IsZero() {
+		template.NotBefore = notBefore
+		template.NotAfter = notBefore.Add(validFor)
+	}
+	return template, nil
+}
+
+// encodeCertAndKey PEM-encodes a DER certificate and its private key.
+func encodeCertAndKey(certDER []byte, key crypto.PrivateKey) (certPEM, keyPEM []byte, _ error) {
+	keyBlock, err := PrivateKeyToPEM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	return certPEM, pem.EncodeToMemory(keyBlock), nil
+}
+
+// CertOptions holds the settings for generating a certificate signed by a CA.
+type CertOptions struct {
+	KeyOptions
+
+	// NotBefore is the start of the validity of the certificate. If zero, the
+	// certificate is valid from a day ago to account for clock skew, and
+	// ValidFor is counted from now.
+	NotBefore time.Time
+	// ValidFor is the validity of the certificate. If zero, one year is used.
+	// The certificate must not outlast the CA certificate.
+	ValidFor time.Duration
+}
+
+// newTemplate returns a template with the validity specified by the options.
+func (opts CertOptions) newTemplate(commonName string) (*x509.Certificate, error) {
+	validFor := opts.ValidFor
+	if validFor == 0 {
+		validFor = defaultGeneratedValidity
+	}
+	return newTemplateWithValidity(commonName, opts.NotBefore, validFor)
+}
+
+// parseCACertAndKey parses a PEM-encoded CA certificate and its private key.
+func parseCACertAndKey(caCertPEM, caKeyPEM []byte) (*x509.Certificate, crypto.PrivateKey, error) {
+	caCert, err := parseLeafCertificate(caCertPEM)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse CA certificate")
+	}
+	caKey, err := PEMToPrivateKey(caKeyPEM)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse CA key")
+	}
+	return caCert, caKey, nil
+}
+
+// GenerateNodeCertAndKey generates a node certificate signed by the CA, and
+// its private key. The hosts may be DNS names or IP addresses. The certificate
+// can be used both as a server and a client certificate, like the ones
+// generated by `cockroach cert create-node`.
+func GenerateNodeCertAndKey(
+	caCertPEM, caKeyPEM []byte, hosts []string, opts CertOptions,
+) (certPEM, keyPEM []byte, _ error) {
+	if len(hosts) == 0 {
+		return nil, nil, errors.New("at least one host is required")
+	}
+	caCert, caKey, err := parseCACertAndKey(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := opts.generateKey()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate node key")
+	}
+	template, err := opts.newTemplate(NodeUser)
+	if err != nil {
+		return nil, nil, err
+	}
+	certDER, err := signServerCert(template, caCert, caKey, key.Public(), hosts)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create node certificate")
+	}
+	return encodeCertAndKey(certDER, key)
+}
+
+// GenerateClientCertAndKey generates a client certificate for user signed by
+// the CA, and its private key. The CommonName of the certificate is the user
+// name, and it can only be used for client authentication.
+func GenerateClientCertAndKey(
+	caCertPEM, caKeyPEM []byte, user string, opts CertOptions,
+) (certPEM, keyPEM []byte, _ error) {
+	if len(user) == 0 {
+		return nil, nil, errors.New("user cannot be empty")
+	}
+	caCert, caKey, err := parseCACertAndKey(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := opts.generateKey()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate client key")
+	}
+	template, err := opts.newTemplate(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	certDER, err := signClientCert(template, caCert, caKey, key.Public())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create client certificate")
+	}
+	return encodeCertAndKey(certDER, key)
+}
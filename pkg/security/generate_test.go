@@ -0,0 +1,400 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// parseCertAndKey parses a PEM-encoded certificate and private key.
+func parseCertAndKey(t *testing.T, certPEM, keyPEM []byte) (*x509.Certificate, crypto.PrivateKey) {
+	t.Helper()
+	certs, err := security.PEMContentsToX509(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("expected 1 certificate, found %d", len(certs))
+	}
+	key, err := security.PEMToPrivateKey(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs[0], key
+}
+
+func TestGenerateCACertAndKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		opts       security.CACertOptions
+		commonName string
+		keyType    string
+	}{
+		{security.CACertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}},
+			"Cockroach CA", "*rsa.PrivateKey"},
+		{security.CACertOptions{
+			KeyOptions: security.KeyOptions{KeyType: security.ECDSAKey},
+			Subject:    pkix.Name{CommonName: "Test CA", Organization: []string{"Test"}},
+			ValidFor:   time.Hour,
+		}, "Test CA", "*ecdsa.PrivateKey"},
+		{security.CACertOptions{KeyOptions: security.KeyOptions{KeyType: security.Ed25519Key}},
+			"Cockroach CA", "ed25519.PrivateKey"},
+	}
+
+	for i, tc := range testCases {
+		caPEM, caKeyPEM, err := security.GenerateCACertAndKey(tc.opts)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		caCert, caKey := parseCertAndKey(t, caPEM, caKeyPEM)
+		if !caCert.IsCA {
+			t.Errorf("#%d: expected a CA certificate", i)
+		}
+		if caCert.Subject.CommonName != tc.commonName {
+			t.Errorf("#%d: expected CommonName %q, got %q", i, tc.commonName, caCert.Subject.CommonName)
+		}
+		if keyType := fmt.Sprintf("%T", caKey); keyType != tc.keyType {
+			t.Errorf("#%d: expected key of type %s, got %s", i, tc.keyType, keyType)
+		}
+
+		// Sign a node certificate and load the result.
+		nodeKey, err := rsa.GenerateKey(rand.Reader, testKeySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodeDER, err := security.GenerateServerCert(
+			caCert, caKey, nodeKey.Public(), time.Minute, security.NodeUser, []string{"localhost"})
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		nodeKeyBlock, err := security.PrivateKeyToPEM(nodeKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, nodeCert, err := security.LoadTLSConfigAndCert(
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: nodeDER}),
+			pem.EncodeToMemory(nodeKeyBlock),
+			caPEM)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if err := verifyX509Cert(nodeCert, "localhost", config.RootCAs); err != nil {
+			t.Errorf("#%d: Couldn't verify node cert against generated CA: %v", i, err)
+		}
+	}
+}
+
+// generateTestCA generates a CA certificate and key for tests.
+func generateTestCA(t *testing.T) (caPEM, caKeyPEM []byte) {
+	t.Helper()
+	caPEM, caKeyPEM, err := security.GenerateCACertAndKey(security.CACertOptions{
+		KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caPEM, caKeyPEM
+}
+
+func TestGenerateNodeCertAndKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	caPEM, caKeyPEM := generateTestCA(t)
+	opts := security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}}
+
+	if _, _, err := security.GenerateNodeCertAndKey(caPEM, caKeyPEM, nil, opts); !testutils.IsError(err, "at least one host is required") {
+		t.Fatalf("expected missing hosts error, got %v", err)
+	}
+
+	certPEM, keyPEM, err := security.GenerateNodeCertAndKey(
+		caPEM, caKeyPEM, []string{"localhost", "127.0.0.1", "node.local", "::1"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := parseCertAndKey(t, certPEM, keyPEM)
+	require.Equal(t, security.NodeUser, cert.Subject.CommonName)
+	require.Equal(t, []string{"localhost", "node.local"}, cert.DNSNames)
+	require.Len(t, cert.IPAddresses, 2)
+	require.True(t, cert.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+	require.True(t, cert.IPAddresses[1].Equal(net.ParseIP("::1")))
+
+	// The result can be used as the node certificate of a certs directory.
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	for name, contents := range map[string][]byte{
+		security.CACertFilename():   caPEM,
+		security.NodeCertFilename(): certPEM,
+		security.NodeKeyFilename():  keyPEM,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(certsDir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	serverConfig, err := security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := security.LoadClientTLSConfig(
+		filepath.Join(certsDir, security.CACertFilename()),
+		filepath.Join(certsDir, security.NodeCertFilename()),
+		filepath.Join(certsDir, security.NodeKeyFilename()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateClientCertAndKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	caPEM, caKeyPEM := generateTestCA(t)
+	opts := security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}}
+
+	if _, _, err := security.GenerateClientCertAndKey(caPEM, caKeyPEM, "", opts); !testutils.IsError(err, "user cannot be empty") {
+		t.Fatalf("expected empty user error, got %v", err)
+	}
+
+	nodeCertPEM, nodeKeyPEM, err := security.GenerateNodeCertAndKey(
+		caPEM, caKeyPEM, []string{"127.0.0.1"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := security.GenerateClientCertAndKey(caPEM, caKeyPEM, "testuser", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := parseCertAndKey(t, certPEM, keyPEM)
+	require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, cert.ExtKeyUsage)
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	for name, contents := range map[string][]byte{
+		security.CACertFilename():               caPEM,
+		security.NodeCertFilename():             nodeCertPEM,
+		security.NodeKeyFilename():              nodeKeyPEM,
+		security.ClientCertFilename("testuser"): certPEM,
+		security.ClientKeyFilename("testuser"):  keyPEM,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(certsDir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverConfig, err := security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := security.LoadClientTLSConfig(
+		filepath.Join(certsDir, security.CACertFilename()),
+		filepath.Join(certsDir, security.ClientCertFilename("testuser")),
+		filepath.Join(certsDir, security.ClientKeyFilename("testuser")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, serverState, err := testHandshakeStates(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := security.UserFromClientCert(serverState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, "testuser", user)
+}
+
+func TestGenerateCertValidity(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Certificates store times with a one second precision.
+	now := timeutil.Now().Truncate(time.Second)
+	caPEM, caKeyPEM, err := security.GenerateCACertAndKey(security.CACertOptions{
+		KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true},
+		NotBefore:  now.Add(-48 * time.Hour),
+		ValidFor:   72 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := parseCertAndKey(t, caPEM, caKeyPEM)
+	require.True(t, caCert.NotBefore.Equal(now.Add(-48*time.Hour)))
+	require.True(t, caCert.NotAfter.Equal(now.Add(24*time.Hour)))
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	testCases := []struct {
+		name      string
+		notBefore time.Time
+		validFor  time.Duration
+		errStr    string
+	}{
+		{"expired", now.Add(-2 * time.Hour), time.Hour, "certificate has expired or is not yet valid"},
+		{"not yet valid", now.Add(time.Hour), time.Hour, "certificate has expired or is not yet valid"},
+		{"valid", now.Add(-time.Hour), 2 * time.Hour, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			certPEM, keyPEM, err := security.GenerateClientCertAndKey(caPEM, caKeyPEM, "testuser", security.CertOptions{
+				KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true},
+				NotBefore:  tc.notBefore,
+				ValidFor:   tc.validFor,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, _ := parseCertAndKey(t, certPEM, keyPEM)
+			require.True(t, cert.NotBefore.Equal(tc.notBefore))
+			require.True(t, cert.NotAfter.Equal(tc.notBefore.Add(tc.validFor)))
+
+			_, err = cert.Verify(x509.VerifyOptions{
+				Roots:     roots,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			if !testutils.IsError(err, tc.errStr) {
+				t.Fatalf("expected error %q, got %v", tc.errStr, err)
+			}
+		})
+	}
+
+	// Certificates cannot outlast their CA.
+	if _, _, err := security.GenerateNodeCertAndKey(caPEM, caKeyPEM, []string{"localhost"}, security.CertOptions{
+		KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true},
+		NotBefore:  now,
+		ValidFor:   48 * time.Hour,
+	}); !testutils.IsError(err, "CA lifetime is .*, shorter than the requested") {
+		t.Fatalf("expected CA lifetime error, got %v", err)
+	}
+}
+
+func TestGeneratedKeyTypes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		keyType   security.KeyType
+		algorithm string
+	}{
+		{security.RSAKey, "RSA"},
+		{security.ECDSAKey, "ECDSA"},
+		{security.Ed25519Key, "Ed25519"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.algorithm, func(t *testing.T) {
+			keyOpts := security.KeyOptions{KeyType: tc.keyType, KeySize: testKeySize, AllowWeakKey: true}
+			caPEM, caKeyPEM, err := security.GenerateCACertAndKey(security.CACertOptions{KeyOptions: keyOpts})
+			if err != nil {
+				t.Fatal(err)
+			}
+			certOpts := security.CertOptions{KeyOptions: keyOpts}
+			nodePEM, nodeKeyPEM, err := security.GenerateNodeCertAndKey(
+				caPEM, caKeyPEM, []string{"localhost", "127.0.0.1"}, certOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientPEM, clientKeyPEM, err := security.GenerateClientCertAndKey(
+				caPEM, caKeyPEM, security.RootUser, certOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, keyPEM := range [][]byte{caKeyPEM, nodeKeyPEM, clientKeyPEM} {
+				algorithm, err := security.KeyAlgorithm(keyPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if algorithm != tc.algorithm {
+					t.Errorf("expected key algorithm %s, got %s", tc.algorithm, algorithm)
+				}
+			}
+
+			serverConfig, err := security.NewServerTLSConfigWithSNI(
+				security.CertKeyPair{CertPEM: nodePEM, KeyPEM: nodeKeyPEM}, nil, caPEM, caPEM, security.TLSOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig, _, err := security.LoadTLSConfigAndCert(clientPEM, clientKeyPEM, caPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig.ServerName = "localhost"
+			_, serverState, err := testHandshakeStates(t, serverConfig, clientConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(serverState.VerifiedChains) == 0 {
+				t.Error("expected the client certificate to be verified")
+			}
+		})
+	}
+
+	if _, err := security.KeyAlgorithm([]byte("not a key")); !testutils.IsError(err, "no PEM data found") {
+		t.Errorf("expected missing PEM data error, got %v", err)
+	}
+}
+
+func TestGenerateRejectsWeakKeys(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	caPEM, caKeyPEM := generateTestCA(t)
+	weak := security.KeyOptions{KeySize: testKeySize}
+	const expected = "RSA key size 1024 is less than the minimum of 2048 bits"
+	for name, generate := range map[string]func() error{
+		"CA": func() error {
+			_, _, err := security.GenerateCACertAndKey(security.CACertOptions{KeyOptions: weak})
+			return err
+		},
+		"node": func() error {
+			_, _, err := security.GenerateNodeCertAndKey(caPEM, caKeyPEM, []string{"localhost"},
+				security.CertOptions{KeyOptions: weak})
+			return err
+		},
+		"client": func() error {
+			_, _, err := security.GenerateClientCertAndKey(caPEM, caKeyPEM, security.RootUser,
+				security.CertOptions{KeyOptions: weak})
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := generate()
+			if !testutils.IsError(err, expected) {
+				t.Fatalf("expected %q, got %v", expected, err)
+			}
+			if !errors.Is(err, security.ErrWeakKey) {
+				t.Errorf("expected ErrWeakKey, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import "google.golang.org/grpc/credentials"
+
+// NewServerTransportCredentials returns gRPC server credentials serving the
+// certificates in certDir, as loaded by LoadTLSConfigFromDir with the default
+// options: client certificates are verified if given.
+func NewServerTransportCredentials(certDir string) (credentials.TransportCredentials, error) {
+	cfg, err := LoadTLSConfigFromDir(certDir, CertsDirOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
+// NewClientTransportCredentials returns gRPC client credentials presenting the
+// node certificate in certDir, as loaded by LoadClientTLSConfigFromDir.
+func NewClientTransportCredentials(certDir string) (credentials.TransportCredentials, error) {
+	cfg, err := LoadClientTLSConfigFromDir(certDir)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(cfg), nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestTransportCredentials(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	certDir := "embedded=" + security.EmbeddedCertsDir
+	serverCreds, err := security.NewServerTransportCredentials(certDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCreds, err := security.NewClientTransportCredentials(certDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverErrCh := make(chan error, 1)
+	serverInfoCh := make(chan credentials.AuthInfo, 1)
+	go func() {
+		_, info, err := serverCreds.ServerHandshake(serverConn)
+		serverInfoCh <- info
+		serverErrCh <- err
+	}()
+	if _, _, err := clientCreds.ClientHandshake(
+		context.Background(), "127.0.0.1:26257", clientConn,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serverErrCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// The node certificate is used as the client certificate.
+	info, ok := (<-serverInfoCh).(credentials.TLSInfo)
+	if !ok {
+		t.Fatal("expected TLS auth info")
+	}
+	if !security.HasClientCert(info.State) {
+		t.Fatal("expected a client certificate")
+	}
+	if user, err := security.UserFromClientCert(info.State); err != nil {
+		t.Fatal(err)
+	} else if user != security.NodeUser {
+		t.Errorf("expected user %q, got %q", security.NodeUser, user)
+	}
+
+	if _, err := security.NewServerTransportCredentials("/nonexistent"); !os.IsNotExist(err) {
+		t.Errorf("expected missing directory error, got %v", err)
+	}
+	if _, err := security.NewClientTransportCredentials("/nonexistent"); !os.IsNotExist(err) {
+		t.Errorf("expected missing directory error, got %v", err)
+	}
+}
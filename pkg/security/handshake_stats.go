@@ -0,0 +1,164 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+)
+
+// HandshakeStats counts the outcomes of client certificate verification. The
+// counters are updated atomically and can be read at any time, eg: to be
+// exported as metrics. A single HandshakeStats may be shared by several
+// configs and listeners.
+//
+// The server configs it is passed to through TLSOptions count the rejections
+// by their VerifyPeerCertificate hooks, and the handshakes without a client
+// certificate when it is optional. The client certificate verification is left
+// to the tls package, which does not report its failures to the config: they
+// are counted from the handshake errors, by the listeners returned by
+// NewHandshakeStatsListener, or by passing the errors to RecordHandshakeError.
+// The errors are told apart by their type only. The tls package of Go versions
+// before 1.20 does not keep the type of the verification errors, which are
+// then counted as other failures.
+type HandshakeStats struct {
+	expiredCert  int64
+	unknownCA    int64
+	noClientCert int64
+	otherFailure int64
+}
+
+// ExpiredCert returns the number of handshakes rejected because the client
+// certificate, or a certificate in its chain, was expired or not yet valid.
+func (s *HandshakeStats) ExpiredCert() int64 {
+	return atomic.LoadInt64(&s.expiredCert)
+}
+
+// UnknownCA returns the number of handshakes rejected because the client
+// certificate was not signed by a trusted CA.
+func (s *HandshakeStats) UnknownCA() int64 {
+	return atomic.LoadInt64(&s.unknownCA)
+}
+
+// NoClientCert returns the number of handshakes in which the client did not
+// present a certificate. These handshakes are only rejected if the config
+// requires a client certificate.
+func (s *HandshakeStats) NoClientCert() int64 {
+	return atomic.LoadInt64(&s.noClientCert)
+}
+
+// OtherFailure returns the number of handshakes which failed for any other
+// reason, including the rejections by other VerifyPeerCertificate hooks such
+// as the CRLChecker, and the handshakes without a required client certificate.
+// Chains rejected for their length (see TLSOptions.MaxPeerCertificates), the
+// connections of non-TLS clients and the network errors are not counted.
+func (s *HandshakeStats) OtherFailure() int64 {
+	return atomic.LoadInt64(&s.otherFailure)
+}
+
+// install sets up cfg so that the rejections by its VerifyPeerCertificate
+// callback, and the handshakes without a client certificate, update the
+// stats. The callback is only called after the tls package verified the
+// client certificates, if any, so the verification itself is unchanged and
+// the VerifiedChains in the connection state are populated.
+//
+// Configs that do not verify client certificates are left untouched.
+func (s *HandshakeStats) install(cfg *tls.Config) {
+	if cfg.ClientAuth != tls.VerifyClientCertIfGiven && cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		return
+	}
+	next := cfg.VerifyPeerCertificate
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		// The tls package rejects the handshakes without a required client
+		// certificate before calling the callback.
+		if len(rawCerts) == 0 {
+			atomic.AddInt64(&s.noClientCert, 1)
+		}
+		if next != nil {
+			if err := next(rawCerts, verifiedChains); err != nil {
+				atomic.AddInt64(&s.otherFailure, 1)
+				return errors.Mark(err, errUncountedHandshakeFailure)
+			}
+		}
+		return nil
+	}
+}
+
+// errUncountedHandshakeFailure marks the errors returned by the
+// VerifyPeerCertificate hooks which must not be counted from the handshake
+// errors, either because the config counted them already or because they are
+// not counted at all.
+var errUncountedHandshakeFailure = errors.New("handshake failure not counted from its error")
+
+// RecordHandshakeError increments the counter matching the failure of a
+// server handshake. The errors returned by the VerifyPeerCertificate hooks,
+// which are counted by the config instead, the errors of clients not speaking
+// TLS and the network errors are ignored.
+func (s *HandshakeStats) RecordHandshakeError(err error) {
+	if err == nil || errors.Is(err, errUncountedHandshakeFailure) {
+		return
+	}
+	var (
+		recordHeaderErr tls.RecordHeaderError
+		netErr          net.Error
+		unknownCAErr    x509.UnknownAuthorityError
+		invalidErr      x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &recordHeaderErr), errors.As(err, &netErr):
+	case errors.As(err, &unknownCAErr):
+		atomic.AddInt64(&s.unknownCA, 1)
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		atomic.AddInt64(&s.expiredCert, 1)
+	default:
+		// This includes the x509.HostnameError and other
+		// x509.CertificateInvalidError reasons, which are not expected for
+		// client certificates.
+		atomic.AddInt64(&s.otherFailure, 1)
+	}
+}
+
+// NewHandshakeStatsListener returns a listener accepting TLS connections on
+// inner, like tls.NewListener, and counting the client certificate
+// verification failures of their handshakes into stats. config should be set
+// up with the same stats through TLSOptions, so that all the failures are
+// counted.
+//
+// As for NewTimingListener, the accepted connections are not *tls.Conn, but
+// implement the Handshake and ConnectionState methods of *tls.Conn.
+func NewHandshakeStatsListener(
+	inner net.Listener, config *tls.Config, stats *HandshakeStats,
+) net.Listener {
+	return &handshakeStatsListener{Listener: inner, config: config, stats: stats}
+}
+
+// handshakeStatsListener is the listener returned by NewHandshakeStatsListener.
+type handshakeStatsListener struct {
+	net.Listener
+	config *tls.Config
+	stats  *HandshakeStats
+}
+
+// Accept implements the net.Listener interface.
+func (l *handshakeStatsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeHookConn{
+		Conn:        tls.Server(conn, l.config),
+		onHandshake: l.stats.RecordHandshakeError,
+	}, nil
+}
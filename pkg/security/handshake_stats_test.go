@@ -0,0 +1,248 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/security/securitytest"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// statsHandshake is like testHandshakeStates, but the server accepts the
+// connection through a listener returned by NewHandshakeStatsListener.
+func statsHandshake(
+	t *testing.T, stats *security.HandshakeStats, serverConfig, clientConfig *tls.Config,
+) (serverState tls.ConnectionState, _ error) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := security.NewHandshakeStatsListener(inner, serverConfig, stats)
+	defer ln.Close()
+
+	type serverResult struct {
+		state tls.ConnectionState
+		err   error
+	}
+	serverCh := make(chan serverResult, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverCh <- serverResult{err: err}
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(interface {
+			Handshake() error
+			ConnectionState() tls.ConnectionState
+		})
+		err = tlsConn.Handshake()
+		serverCh <- serverResult{state: tlsConn.ConnectionState(), err: err}
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		<-serverCh
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	res := <-serverCh
+	return res.state, res.err
+}
+
+func TestHandshakeStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	caPEM, caKeyPEM := readAsset(security.EmbeddedCACert), readAsset(security.EmbeddedCAKey)
+	otherCAPEM, otherCAKeyPEM := generateTestCA(t)
+
+	clientConfig := func(caPEM, caKeyPEM []byte, opts security.CertOptions) *tls.Config {
+		opts.KeySize, opts.AllowWeakKey = testKeySize, true
+		certPEM, keyPEM, err := security.GenerateClientCertAndKey(caPEM, caKeyPEM, security.RootUser, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := embeddedClientTLSConfig(t)
+		config.Certificates = []tls.Certificate{cert}
+		return config
+	}
+	noCertConfig := embeddedClientTLSConfig(t)
+	noCertConfig.Certificates = nil
+
+	crl, err := security.LoadCRL(
+		makeTestCRL(t, security.EmbeddedTestUserCert), embeddedAsset(t, security.EmbeddedCACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedConfig, err := security.LoadClientTLSConfig(
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedTestUserCert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedTestUserKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats security.HandshakeStats
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{
+		HandshakeStats: &stats,
+		CRLChecker:     crl,
+	})
+
+	type counts struct {
+		expiredCert, unknownCA, noClientCert, otherFailure int64
+	}
+	// The counts are cumulative: each case lists the counter it increments.
+	testCases := []struct {
+		name          string
+		clientConfig  *tls.Config
+		expectedError string
+		incremented   counts
+	}{
+		{"valid", clientConfig(caPEM, caKeyPEM, security.CertOptions{}),
+			"", counts{}},
+		{"expired", clientConfig(caPEM, caKeyPEM, security.CertOptions{
+			NotBefore: timeutil.Now().Add(-48 * time.Hour), ValidFor: time.Hour,
+		}), "certificate has expired", counts{expiredCert: 1}},
+		{"unknown CA", clientConfig(otherCAPEM, otherCAKeyPEM, security.CertOptions{}),
+			"certificate signed by unknown authority", counts{unknownCA: 1}},
+		{"no client cert", noCertConfig,
+			"", counts{noClientCert: 1}},
+		{"revoked", revokedConfig,
+			"has been revoked", counts{otherFailure: 1}},
+	}
+	var expected counts
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			serverState, err := statsHandshake(t, &stats, serverConfig, tc.clientConfig)
+			if tc.expectedError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The client certificate is verified by the tls package, and
+				// can be used for authentication.
+				if tc.clientConfig.Certificates != nil {
+					if user, err := security.UserFromClientCert(serverState); err != nil {
+						t.Error(err)
+					} else if user != security.RootUser {
+						t.Errorf("expected user %s, got %s", security.RootUser, user)
+					}
+				}
+			} else if !testutils.IsError(err, tc.expectedError) {
+				t.Fatalf("expected error %q, got %v", tc.expectedError, err)
+			}
+
+			incremented := tc.incremented
+			// The tls package of Go versions before 1.20 does not keep the
+			// type of the verification errors, which are then counted as
+			// other failures.
+			var invalidErr x509.CertificateInvalidError
+			var unknownCAErr x509.UnknownAuthorityError
+			if (incremented.expiredCert > 0 && !errors.As(err, &invalidErr)) ||
+				(incremented.unknownCA > 0 && !errors.As(err, &unknownCAErr)) {
+				incremented = counts{otherFailure: 1}
+			}
+			expected.expiredCert += incremented.expiredCert
+			expected.unknownCA += incremented.unknownCA
+			expected.noClientCert += incremented.noClientCert
+			expected.otherFailure += incremented.otherFailure
+
+			actual := counts{
+				expiredCert:  stats.ExpiredCert(),
+				unknownCA:    stats.UnknownCA(),
+				noClientCert: stats.NoClientCert(),
+				otherFailure: stats.OtherFailure(),
+			}
+			if actual != expected {
+				t.Errorf("expected counts %+v, got %+v", expected, actual)
+			}
+		})
+	}
+
+	// Clients without a certificate are rejected when a client certificate is
+	// required. The tls package does not type the error: it is counted as an
+	// other failure.
+	var requiredStats security.HandshakeStats
+	requiredConfig := embeddedServerTLSConfig(t, security.TLSOptions{
+		HandshakeStats: &requiredStats,
+		ClientCertMode: security.ClientCertRequired,
+	})
+	if _, err := statsHandshake(t, &requiredStats, requiredConfig, noCertConfig); !testutils.IsError(err, "client didn't provide a certificate") {
+		t.Errorf("expected missing client certificate error, got %v", err)
+	}
+	if n := requiredStats.OtherFailure(); n != 1 {
+		t.Errorf("expected 1 other failure, got %d", n)
+	}
+}
+
+func TestRecordHandshakeError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	type counts struct {
+		expiredCert, unknownCA, otherFailure int64
+	}
+	testCases := []struct {
+		name     string
+		err      error
+		expected counts
+	}{
+		{"nil", nil, counts{}},
+		{"expired", errors.Wrap(x509.CertificateInvalidError{Reason: x509.Expired}, "handshake"),
+			counts{expiredCert: 1}},
+		{"unknown CA", errors.Wrap(x509.UnknownAuthorityError{}, "handshake"),
+			counts{unknownCA: 1}},
+		{"hostname", x509.HostnameError{}, counts{otherFailure: 1}},
+		{"other invalid", x509.CertificateInvalidError{Reason: x509.NotAuthorizedToSign},
+			counts{otherFailure: 1}},
+		{"untyped", io.EOF, counts{otherFailure: 1}},
+		{"not TLS", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"},
+			counts{}},
+		{"network", &net.OpError{Op: "read", Err: errors.New("connection reset")}, counts{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stats security.HandshakeStats
+			stats.RecordHandshakeError(tc.err)
+			actual := counts{
+				expiredCert:  stats.ExpiredCert(),
+				unknownCA:    stats.UnknownCA(),
+				otherFailure: stats.OtherFailure(),
+			}
+			if actual != tc.expected {
+				t.Errorf("expected counts %+v, got %+v", tc.expected, actual)
+			}
+			if n := stats.NoClientCert(); n != 0 {
+				t.Errorf("expected no handshake without client certificate, got %d", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// parseLeafCertificate returns the first certificate found in the
+// PEM-encoded contents. Any following certificates are assumed to be
+// the rest of the chain and are ignored.
+func parseLeafCertificate(certPEM []byte) (*x509.Certificate, error) {
+	certs, err := PEMContentsToX509(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no CERTIFICATE block found in PEM data")
+	}
+	return certs[0], nil
+}
+
+// CertExpiry returns the expiration time ("Not After") of the leaf
+// certificate in the PEM-encoded contents. If the contents hold a chain,
+// the first certificate is the leaf.
+func CertExpiry(certPEM []byte) (time.Time, error) {
+	cert, err := parseLeafCertificate(certPEM)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// CertSerial returns the serial number of the certificate as uppercase hex,
+// without separators and padded to whole bytes. This is the format used by
+// `openssl x509 -serial`.
+func CertSerial(cert *x509.Certificate) string {
+	serial := cert.SerialNumber.Bytes()
+	if len(serial) == 0 {
+		return "00"
+	}
+	return strings.ToUpper(hex.EncodeToString(serial))
+}
+
+// PeerCertSerials returns the serial numbers of the certificates presented by
+// the peer, leaf first, in the format returned by CertSerial.
+func PeerCertSerials(state tls.ConnectionState) []string {
+	serials := make([]string, len(state.PeerCertificates))
+	for i, cert := range state.PeerCertificates {
+		serials[i] = CertSerial(cert)
+	}
+	return serials
+}
+
+// CertSecondsUntilExpiry returns the number of seconds from now until the
+// leaf certificate in the PEM-encoded contents expires, eg: to be exported as
+// a gauge. The result is negative if the certificate has already expired.
+func CertSecondsUntilExpiry(certPEM []byte, now time.Time) (float64, error) {
+	expiry, err := CertExpiry(certPEM)
+	if err != nil {
+		return 0, err
+	}
+	return expiry.Sub(now).Seconds(), nil
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of the DER-encoded
+// certificate, as colon-separated uppercase hex bytes. This is the format
+// used by `openssl x509 -fingerprint -sha256`.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexBytes, ":")
+}
+
+// CertExtensionByOID returns the raw value of the first extension of the
+// certificate identified by oid, eg: a custom extension holding the role of a
+// client to check in a VerifyPeerCertificate callback. The boolean is false if
+// the certificate has no such extension.
+func CertExtensionByOID(cert *x509.Certificate, oid asn1.ObjectIdentifier) ([]byte, bool) {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oid) {
+			return ext.Value, true
+		}
+	}
+	return nil, false
+}
+
+// CertFingerprintFromPEM returns the SHA-256 fingerprint of the leaf
+// certificate in the PEM-encoded contents. See CertFingerprint.
+func CertFingerprintFromPEM(certPEM []byte) (string, error) {
+	cert, err := parseLeafCertificate(certPEM)
+	if err != nil {
+		return "", err
+	}
+	return CertFingerprint(cert), nil
+}
+
+// TrustedCASubjects returns the subjects of the CA certificates in caPEM, in
+// the order they appear, eg: to find out why a peer certificate is reported
+// as signed by an unknown authority. As for the CA pools built from CA files,
+// caPEM may also hold DER-encoded certificates, and duplicate certificates are
+// only listed once.
+func TrustedCASubjects(caPEM []byte) ([]string, error) {
+	certs, err := PEMContentsToX509(derCertsToPEM(caPEM))
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no CERTIFICATE block found in PEM data")
+	}
+	subjects := make([]string, 0, len(certs))
+	seen := make(map[string]bool, len(certs))
+	for _, cert := range certs {
+		if seen[string(cert.Raw)] {
+			continue
+		}
+		seen[string(cert.Raw)] = true
+		subjects = append(subjects, cert.Subject.String())
+	}
+	return subjects, nil
+}
+
+// CertDescription summarizes a certificate, eg: to show its health in the
+// admin UI. If the certificate could not be read or parsed, only Error is set.
+type CertDescription struct {
+	Subject       string    `json:"subject,omitempty"`
+	Expiry        time.Time `json:"expiry"`
+	DaysRemaining int       `json:"days_remaining"`
+	Fingerprint   string    `json:"fingerprint,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// TLSDescription summarizes the certificates of a certs directory. See
+// DescribeTLSConfigDir.
+type TLSDescription struct {
+	NodeCert CertDescription `json:"node_cert"`
+	CACert   CertDescription `json:"ca_cert"`
+}
+
+// DescribeTLSConfigDir describes the node and CA certificates in certDir, as
+// loaded by LoadTLSConfigFromDir. A certificate failing to load does not fail
+// the call: the error is reported in its description and the other one is
+// still described. An error is only returned if certDir itself is invalid.
+func DescribeTLSConfigDir(certDir string) (TLSDescription, error) {
+	src, err := NewDirCertSource(certDir)
+	if err != nil {
+		return TLSDescription{}, err
+	}
+	now := timeutil.Now()
+	var desc TLSDescription
+	certPEM, err := src.Read(NodeCertFilename())
+	if err != nil {
+		desc.NodeCert.Error = err.Error()
+	} else {
+		desc.NodeCert = describeCert(certPEM, now)
+	}
+	// The CA may be bundled in the node certificate file.
+	caPEM, err := readCACertFromSource(src, certPEM)
+	if err != nil {
+		desc.CACert.Error = err.Error()
+	} else {
+		desc.CACert = describeCert(caPEM, now)
+	}
+	return desc, nil
+}
+
+// describeCert describes the leaf certificate in the PEM-encoded contents.
+func describeCert(certPEM []byte, now time.Time) CertDescription {
+	cert, err := parseLeafCertificate(certPEM)
+	if err != nil {
+		return CertDescription{Error: err.Error()}
+	}
+	return CertDescription{
+		Subject:       cert.Subject.String(),
+		Expiry:        cert.NotAfter,
+		DaysRemaining: int(math.Floor(cert.NotAfter.Sub(now).Hours() / 24)),
+		Fingerprint:   CertFingerprint(cert),
+	}
+}
+
+// KeyAlgorithm returns the algorithm of the PEM-encoded private key: "RSA",
+// "ECDSA" or "Ed25519".
+func KeyAlgorithm(keyPEM []byte) (string, error) {
+	key, err := PEMToPrivateKey(keyPEM)
+	if err != nil {
+		return "", err
+	}
+	return privateKeyAlgorithm(key)
+}
+
+// privateKeyAlgorithm returns the algorithm of the private key, as named by
+// KeyAlgorithm.
+func privateKeyAlgorithm(key crypto.PrivateKey) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return "RSA", nil
+	case *ecdsa.PrivateKey:
+		return "ECDSA", nil
+	case ed25519.PrivateKey:
+		return "Ed25519", nil
+	default:
+		return "", errors.Errorf("unknown key type %T", key)
+	}
+}
+
+// MissingHostsError is returned by ValidateCertForHosts when the certificate
+// is not valid for some of the hosts.
+type MissingHostsError struct {
+	// Hosts are the hosts missing from the certificate.
+	Hosts []string
+}
+
+// Error implements the error interface.
+func (e *MissingHostsError) Error() string {
+	return fmt.Sprintf("certificate is not valid for hosts: %s", strings.Join(e.Hosts, ", "))
+}
+
+// ValidateCertForHosts checks that the leaf certificate in the PEM-encoded
+// contents is valid for all the hosts, which may be DNS names or IP addresses.
+// Only the subject alternative names are considered, not the CommonName.
+// DNS names can be matched by wildcard entries covering a single label, eg:
+// *.local matches node1.local. If some hosts are missing, a
+// *MissingHostsError listing them is returned.
+func ValidateCertForHosts(certPEM []byte, hosts []string) error {
+	cert, err := parseLeafCertificate(certPEM)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, host := range hosts {
+		if !certHasHost(cert, host) {
+			missing = append(missing, host)
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingHostsError{Hosts: missing}
+	}
+	return nil
+}
+
+// CertMatchesHost returns true if the leaf certificate in the PEM-encoded
+// contents is valid for host, a DNS name or IP address, eg: to check a server
+// name before dialing. Matching follows the rules of ValidateCertForHosts,
+// which are those of crypto/tls for subject alternative names. It returns
+// false if the certificate cannot be parsed.
+func CertMatchesHost(certPEM []byte, host string) bool {
+	cert, err := parseLeafCertificate(certPEM)
+	if err != nil {
+		return false
+	}
+	return certHasHost(cert, host)
+}
+
+// ValidateCertLifetime returns an error if the leaf certificate in the
+// PEM-encoded contents is valid for longer than max, from its NotBefore to its
+// NotAfter time, eg: to reject the certificates issued for more than the 398
+// days allowed by browsers. A lifetime of exactly max is accepted.
+func ValidateCertLifetime(certPEM []byte, max time.Duration) error {
+	cert, err := parseLeafCertificate(certPEM)
+	if err != nil {
+		return err
+	}
+	if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime > max {
+		return errors.Errorf("certificate %q is valid for %s, more than the maximum of %s",
+			cert.Subject.CommonName, lifetime, max)
+	}
+	return nil
+}
+
+// certHasHost returns true if host is one of the IP addresses or matches one
+// of the DNS names of the certificate.
+func certHasHost(cert *x509.Certificate, host string) bool {
+	// IPv6 addresses may be passed in brackets, as in URLs.
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); ip != nil {
+		for _, certIP := range cert.IPAddresses {
+			if certIP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, name := range cert.DNSNames {
+		if matchHostname(strings.ToLower(name), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHostname returns true if host matches the pattern, which may start with
+// a wildcard label.
+func matchHostname(pattern, host string) bool {
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == host
+	}
+	// The wildcard matches exactly one non-empty label.
+	i := strings.IndexByte(host, '.')
+	return i > 0 && host[i:] == pattern[1:]
+}
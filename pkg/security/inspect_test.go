@@ -0,0 +1,459 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/security/securitytest"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+func TestCertExpiry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	caPEM, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, leafPEM := makeTestCert(t, "node", 0, nil)
+
+	// The leaf is the first certificate, even when followed by its chain.
+	for _, contents := range [][]byte{leafPEM, append(leafPEM, caPEM...)} {
+		expiry, err := security.CertExpiry(contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !expiry.Equal(leaf.NotAfter) {
+			t.Errorf("expected expiration %s, got %s", leaf.NotAfter, expiry)
+		}
+	}
+
+	if _, err := security.CertExpiry([]byte("not a certificate")); !testutils.IsError(err, "no CERTIFICATE block found") {
+		t.Errorf("expected missing block error, got %v", err)
+	}
+}
+
+func TestCertSecondsUntilExpiry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	leaf, leafPEM := makeTestCert(t, "node", 0, nil)
+	testCases := []struct {
+		now      time.Time
+		expected float64
+	}{
+		{leaf.NotAfter.Add(-90 * time.Second), 90},
+		{leaf.NotAfter, 0},
+		// Expired certificates yield negative values.
+		{leaf.NotAfter.Add(time.Hour), -3600},
+	}
+	for i, tc := range testCases {
+		seconds, err := security.CertSecondsUntilExpiry(leafPEM, tc.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seconds != tc.expected {
+			t.Errorf("#%d: expected %f seconds, got %f", i, tc.expected, seconds)
+		}
+	}
+
+	if _, err := security.CertSecondsUntilExpiry(nil, timeutil.Now()); !testutils.IsError(err, "no CERTIFICATE block found") {
+		t.Errorf("expected missing block error, got %v", err)
+	}
+}
+
+func TestPeerCertSerials(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var certs []*x509.Certificate
+	for _, name := range []string{security.EmbeddedNodeCert, security.EmbeddedCACert} {
+		certPEM, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := security.PEMContentsToX509(certPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, parsed[0])
+	}
+
+	// Output of `openssl x509 -noout -serial` on node.crt and ca.crt.
+	expected := []string{"805071C931781A2FE57DFD30B8BA45A5", "4B7BE28FDEBADAE882019A6EFF2FA6F8"}
+	serials := security.PeerCertSerials(tls.ConnectionState{PeerCertificates: certs})
+	if !reflect.DeepEqual(serials, expected) {
+		t.Errorf("expected serials %v, got %v", expected, serials)
+	}
+	if serials := security.PeerCertSerials(tls.ConnectionState{}); len(serials) != 0 {
+		t.Errorf("expected no serials, got %v", serials)
+	}
+
+	// Serials are padded to whole bytes.
+	for serial, expected := range map[int64]string{0: "00", 0xf: "0F", 0xabc: "0ABC"} {
+		if a := security.CertSerial(&x509.Certificate{SerialNumber: big.NewInt(serial)}); a != expected {
+			t.Errorf("expected serial %s, got %s", expected, a)
+		}
+	}
+}
+
+func TestCertFingerprint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	certPEM, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Output of `openssl x509 -in node.crt -noout -fingerprint -sha256`.
+	const expected = "91:F0:C3:88:0C:0E:DC:FC:0F:34:C1:B3:99:1F:64:5A:" +
+		"34:A4:97:DD:64:D1:F9:42:72:62:3F:F9:A4:D3:56:EF"
+
+	fingerprint, err := security.CertFingerprintFromPEM(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != expected {
+		t.Errorf("expected fingerprint %s, got %s", expected, fingerprint)
+	}
+
+	certs, err := security.PEMContentsToX509(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint := security.CertFingerprint(certs[0]); fingerprint != expected {
+		t.Errorf("expected fingerprint %s, got %s", expected, fingerprint)
+	}
+
+	if _, err := security.CertFingerprintFromPEM(nil); !testutils.IsError(err, "no CERTIFICATE block found") {
+		t.Errorf("expected missing block error, got %v", err)
+	}
+}
+
+func TestCertExtensionByOID(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	roleOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	otherOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}
+	role, err := asn1.Marshal("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    timeutil.Now().Add(-time.Hour),
+		NotAfter:     timeutil.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 3}, Value: []byte{0x05, 0x00}},
+			{Id: roleOID, Value: role},
+		},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, ok := security.CertExtensionByOID(cert, roleOID)
+	if !ok {
+		t.Fatal("expected the role extension to be found")
+	}
+	var decoded string
+	if _, err := asn1.Unmarshal(value, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != "admin" {
+		t.Errorf("expected role admin, got %q", decoded)
+	}
+	if value, ok := security.CertExtensionByOID(cert, otherOID); ok || value != nil {
+		t.Errorf("expected no extension, got %v", value)
+	}
+}
+
+func TestTrustedCASubjects(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	caPEM := readAsset(security.EmbeddedCACert)
+	otherCA, otherPEM := makeTestCert(t, "other CA", x509.KeyUsageCertSign, nil)
+	caCerts, err := security.PEMContentsToX509(caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		caPEM    []byte
+		expected []string
+	}{
+		{"single CA", caPEM, []string{caCerts[0].Subject.String()}},
+		{"bundle", append(append(otherPEM, caPEM...), otherPEM...),
+			[]string{"CN=other CA", caCerts[0].Subject.String()}},
+		{"DER", otherCA.Raw, []string{"CN=other CA"}},
+	}
+	for _, tc := range testCases {
+		subjects, err := security.TrustedCASubjects(tc.caPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(subjects, tc.expected) {
+			t.Errorf("%s: expected subjects %q, got %q", tc.name, tc.expected, subjects)
+		}
+	}
+
+	if _, err := security.TrustedCASubjects([]byte("not a certificate")); !testutils.IsError(
+		err, "no CERTIFICATE block found",
+	) {
+		t.Errorf("expected missing block error, got %v", err)
+	}
+}
+
+func TestDescribeTLSConfigDir(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	desc, err := security.DescribeTLSConfigDir("embedded=" + security.EmbeddedCertsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		desc     security.CertDescription
+		certPEM  []byte
+		expected string
+	}{
+		{desc.NodeCert, readAsset(security.EmbeddedNodeCert), "CN=node"},
+		{desc.CACert, readAsset(security.EmbeddedCACert), "CN=Cockroach CA"},
+	} {
+		if tc.desc.Error != "" {
+			t.Fatal(tc.desc.Error)
+		}
+		if !strings.Contains(tc.desc.Subject, tc.expected) {
+			t.Errorf("expected subject with %s, got %s", tc.expected, tc.desc.Subject)
+		}
+		expiry, err := security.CertExpiry(tc.certPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tc.desc.Expiry.Equal(expiry) {
+			t.Errorf("expected expiry %s, got %s", expiry, tc.desc.Expiry)
+		}
+		if days := int(expiry.Sub(timeutil.Now()).Hours() / 24); tc.desc.DaysRemaining < days-1 ||
+			tc.desc.DaysRemaining > days {
+			t.Errorf("expected %d days remaining, got %d", days, tc.desc.DaysRemaining)
+		}
+		fingerprint, err := security.CertFingerprintFromPEM(tc.certPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.desc.Fingerprint != fingerprint {
+			t.Errorf("expected fingerprint %s, got %s", fingerprint, tc.desc.Fingerprint)
+		}
+	}
+	if _, err := json.Marshal(desc); err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing node certificate does not prevent describing the CA.
+	security.ResetAssetLoader()
+	defer ResetTest()
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := ioutil.WriteFile(
+		filepath.Join(certsDir, security.CACertFilename()), readAsset(security.EmbeddedCACert), 0644,
+	); err != nil {
+		t.Fatal(err)
+	}
+	desc, err = security.DescribeTLSConfigDir(certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(desc.NodeCert.Error, "no such file or directory") {
+		t.Errorf("expected missing node certificate error, got %q", desc.NodeCert.Error)
+	}
+	if desc.CACert.Error != "" || !strings.Contains(desc.CACert.Subject, "CN=Cockroach CA") {
+		t.Errorf("unexpected CA certificate description %+v", desc.CACert)
+	}
+}
+
+func TestValidateCertForHosts(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The embedded node certificate is valid for localhost, *.local,
+	// 127.0.0.1 and ::1.
+	certPEM, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		hosts   []string
+		missing []string
+	}{
+		{nil, nil},
+		{[]string{"localhost", "LocalHost.", "127.0.0.1", "::1", "[::1]"}, nil},
+		{[]string{"node1.local", "NODE2.LOCAL"}, nil},
+		// Wildcards only match a single label.
+		{[]string{"local", ".local", "a.b.local"}, []string{"local", ".local", "a.b.local"}},
+		{[]string{"localhost", "example.com", "10.0.0.1"}, []string{"example.com", "10.0.0.1"}},
+		// The CommonName is not a SAN.
+		{[]string{"node"}, []string{"node"}},
+	}
+	for i, tc := range testCases {
+		err := security.ValidateCertForHosts(certPEM, tc.hosts)
+		if tc.missing == nil {
+			if err != nil {
+				t.Errorf("#%d: %v", i, err)
+			}
+			continue
+		}
+		missingErr, ok := err.(*security.MissingHostsError)
+		if !ok {
+			t.Errorf("#%d: expected a MissingHostsError, got %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(missingErr.Hosts, tc.missing) {
+			t.Errorf("#%d: expected missing hosts %v, got %v", i, tc.missing, missingErr.Hosts)
+		}
+	}
+
+	if err := security.ValidateCertForHosts(nil, []string{"localhost"}); !testutils.IsError(err, "no CERTIFICATE block found") {
+		t.Errorf("expected missing block error, got %v", err)
+	}
+}
+
+func TestCertMatchesHost(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// The embedded node certificate is valid for localhost, *.local,
+	// 127.0.0.1 and ::1.
+	certPEM, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		host     string
+		expected bool
+	}{
+		{"localhost", true},
+		{"LOCALHOST.", true},
+		{"other", false},
+		// Wildcards match a single, non-empty label.
+		{"n1.local", true},
+		{"N1.Local", true},
+		{"local", false},
+		{".local", false},
+		{"a.n1.local", false},
+		{"n1.local.example.com", false},
+		// IP addresses only match IP SANs, in any notation.
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"[::1]", true},
+		{"0:0:0:0:0:0:0:1", true},
+		{"127.0.0.2", false},
+		{"10.0.0.1", false},
+	}
+	for _, tc := range testCases {
+		if matches := security.CertMatchesHost(certPEM, tc.host); matches != tc.expected {
+			t.Errorf("%s: expected %t, got %t", tc.host, tc.expected, matches)
+		}
+	}
+
+	if security.CertMatchesHost([]byte("not a certificate"), "localhost") {
+		t.Error("expected an invalid certificate not to match")
+	}
+}
+
+func TestValidateCertLifetime(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// makeCert returns a certificate valid for lifetime. Certificate times
+	// have a precision of one second.
+	notBefore := timeutil.Now().Truncate(time.Second)
+	makeCert := func(lifetime time.Duration) []byte {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "node"},
+			NotBefore:    notBefore,
+			NotAfter:     notBefore.Add(lifetime),
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	}
+
+	const max = 398 * 24 * time.Hour
+	testCases := []struct {
+		lifetime      time.Duration
+		expectedError string
+	}{
+		{time.Hour, ""},
+		{max, ""},
+		{max + time.Second, `certificate "node" is valid for 9552h0m1s, more than the maximum of 9552h0m0s`},
+		{10 * 365 * 24 * time.Hour, "more than the maximum"},
+	}
+	for _, tc := range testCases {
+		err := security.ValidateCertLifetime(makeCert(tc.lifetime), max)
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.lifetime, err)
+			}
+		} else if !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("%s: expected %q, got %v", tc.lifetime, tc.expectedError, err)
+		}
+	}
+
+	if err := security.ValidateCertLifetime(nil, max); !testutils.IsError(err, "no CERTIFICATE block found") {
+		t.Errorf("expected missing block error, got %v", err)
+	}
+}
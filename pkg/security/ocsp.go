@@ -0,0 +1,70 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto/tls"
+
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+)
+
+// OCSPStapler serves a server TLS config whose certificate carries a stapled
+// OCSP response. OCSP responses expire, so the staple can be refreshed at
+// runtime without rebuilding the config.
+type OCSPStapler struct {
+	mu struct {
+		syncutil.RWMutex
+		config *tls.Config
+	}
+}
+
+// NewOCSPStapler returns an OCSPStapler serving a copy of cfg, which must hold
+// a single certificate. The current staple of the certificate, if any, is
+// served until Refresh is called.
+func NewOCSPStapler(cfg *tls.Config) (*OCSPStapler, error) {
+	if len(cfg.Certificates) != 1 {
+		return nil, errors.Errorf("expected a single certificate, found %d", len(cfg.Certificates))
+	}
+	s := &OCSPStapler{}
+	s.mu.config = cfg.Clone()
+	return s, nil
+}
+
+// Config returns a server TLS config with a callback to fetch the config with
+// the latest staple.
+func (s *OCSPStapler) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: s.getConfigForClient,
+	}
+}
+
+// Refresh replaces the stapled OCSP response. Handshakes started afterwards
+// see the new staple.
+func (s *OCSPStapler) Refresh(staple []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Handshakes in progress may still be using the current config: swap in
+	// a copy instead of modifying it.
+	cfg := s.mu.config.Clone()
+	cert := cfg.Certificates[0]
+	cert.OCSPStaple = append([]byte(nil), staple...)
+	cfg.Certificates = []tls.Certificate{cert}
+	s.mu.config = cfg
+}
+
+// getConfigForClient is the callback set in tls.Config.GetConfigForClient.
+// We currently ignore the ClientHelloInfo object.
+func (s *OCSPStapler) getConfigForClient(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mu.config, nil
+}
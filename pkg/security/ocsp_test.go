@@ -0,0 +1,88 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestOCSPStapling(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := generateBaseCerts(certsDir); err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := security.LoadClientTLSConfig(
+		filepath.Join(certsDir, security.CACertFilename()),
+		filepath.Join(certsDir, security.ClientCertFilename(security.RootUser)),
+		filepath.Join(certsDir, security.ClientKeyFilename(security.RootUser)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No staple by default.
+	serverConfig, err := security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := testHandshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.OCSPResponse) != 0 {
+		t.Fatalf("unexpected OCSP response %q", state.OCSPResponse)
+	}
+
+	// The clients do not validate the response: any bytes do.
+	staple := []byte("ocsp response")
+	if err := ioutil.WriteFile(
+		filepath.Join(certsDir, security.NodeOCSPStapleFilename()), staple, 0644,
+	); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err = security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err = testHandshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(state.OCSPResponse, staple) {
+		t.Fatalf("expected OCSP response %q, got %q", staple, state.OCSPResponse)
+	}
+
+	// Refresh the staple at runtime.
+	stapler, err := security.NewOCSPStapler(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed := []byte("refreshed ocsp response")
+	stapler.Refresh(refreshed)
+	state, err = testHandshake(t, stapler.Config(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(state.OCSPResponse, refreshed) {
+		t.Fatalf("expected OCSP response %q, got %q", refreshed, state.OCSPResponse)
+	}
+}
@@ -11,8 +11,10 @@
 package security
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -23,6 +25,63 @@ import (
 	"github.com/cockroachdb/errors"
 )
 
+// pemBeginMarker starts the first line of PEM blocks.
+var pemBeginMarker = []byte("-----BEGIN ")
+
+// maxPEMLineInErrors is the maximum length of the lines of PEM data quoted in
+// error messages.
+const maxPEMLineInErrors = 64
+
+// knownPEMBlockType returns true for the types of the PEM blocks used by the
+// package.
+func knownPEMBlockType(blockType string) bool {
+	return blockType == "CERTIFICATE" || blockType == "X509 CRL" ||
+		blockType == "PRIVATE KEY" || strings.HasSuffix(blockType, " PRIVATE KEY")
+}
+
+// splitPEMBlocks returns the PEM blocks in data, in order. All PEM parsing in
+// the package goes through it, as pem.Decode silently skips what it cannot
+// decode: here, malformed blocks (eg: truncated) and data following the last
+// block are reported. Text preceding a block is allowed, as per RFC 7468, and
+// blocks of types the package does not use (eg: EC PARAMETERS, emitted along
+// with EC keys) are skipped. Data without any PEM block is not an error: no
+// blocks are returned, for callers to report what they expected to find.
+func splitPEMBlocks(data []byte) ([]*pem.Block, error) {
+	var blocks []*pem.Block
+	for i := 0; ; i++ {
+		start := bytes.Index(data, pemBeginMarker)
+		if start < 0 {
+			if i > 0 && len(bytes.TrimSpace(data)) > 0 {
+				return nil, errors.Errorf("unexpected data after PEM block #%d: %q", i-1, firstPEMLine(data))
+			}
+			return blocks, nil
+		}
+		block, rest := pem.Decode(data)
+		// If the block starting at start could not be decoded, pem.Decode
+		// either fails or decodes a later block.
+		if block == nil || bytes.Count(data[start:len(data)-len(rest)], pemBeginMarker) > 1 {
+			return nil, errors.Errorf("malformed PEM block #%d: %q", i, firstPEMLine(data[start:]))
+		}
+		if knownPEMBlockType(block.Type) {
+			blocks = append(blocks, block)
+		}
+		data = rest
+	}
+}
+
+// firstPEMLine returns the first non-blank line of data, truncated for error
+// messages.
+func firstPEMLine(data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = bytes.TrimSpace(data[:i])
+	}
+	if len(data) > maxPEMLineInErrors {
+		data = data[:maxPEMLineInErrors]
+	}
+	return data
+}
+
 // WritePEMToFile writes an arbitrary number of PEM blocks to a file.
 // The file "path" is created with "mode" and WRONLY|CREATE.
 // If overwrite is true, the file will be overwritten if it exists.
@@ -79,6 +138,12 @@ func PrivateKeyToPEM(key crypto.PrivateKey) (*pem.Block, error) {
 			return nil, errors.Errorf("error marshaling ECDSA key: %s", err)
 		}
 		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: bytes}, nil
+	case ed25519.PrivateKey:
+		bytes, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, errors.Errorf("error marshaling Ed25519 key: %s", err)
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: bytes}, nil
 	default:
 		return nil, errors.Errorf("unknown key type: %v", k)
 	}
@@ -93,13 +158,12 @@ func PrivateKeyToPKCS8(key crypto.PrivateKey) ([]byte, error) {
 // Each block must be a certificate.
 // It is allowed to have zero certificates.
 func PEMToCertificates(contents []byte) ([]*pem.Block, error) {
-	certs := make([]*pem.Block, 0)
-	for {
-		var block *pem.Block
-		block, contents = pem.Decode(contents)
-		if block == nil {
-			break
-		}
+	blocks, err := splitPEMBlocks(contents)
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]*pem.Block, 0, len(blocks))
+	for _, block := range blocks {
 		if block.Type != "CERTIFICATE" {
 			return nil, errors.Errorf("block #%d is of type %s, not CERTIFICATE", len(certs), block.Type)
 		}
@@ -110,20 +174,165 @@ func PEMToCertificates(contents []byte) ([]*pem.Block, error) {
 	return certs, nil
 }
 
+// splitCombinedPEM splits PEM data holding both certificates and a private key
+// into the PEM-encoded certificates, in the order they appear, and the key.
+// The blocks can be in any order.
+func splitCombinedPEM(contents []byte) (certPEM, keyPEM []byte, _ error) {
+	blocks, err := splitPEMBlocks(contents)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, block := range blocks {
+		switch {
+		case block.Type == "CERTIFICATE":
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		case block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY"):
+			if keyPEM != nil {
+				return nil, nil, errors.New("more than one PRIVATE KEY block found")
+			}
+			keyPEM = pem.EncodeToMemory(block)
+		default:
+			return nil, nil, errors.Errorf("unexpected PEM block of type %s", block.Type)
+		}
+	}
+	if certPEM == nil {
+		return nil, nil, errors.New("no CERTIFICATE block found")
+	}
+	if keyPEM == nil {
+		return nil, nil, errors.New("no PRIVATE KEY block found")
+	}
+	return certPEM, keyPEM, nil
+}
+
+// derCertsToPEM returns the certificates in contents PEM-encoded if contents
+// holds DER-encoded certificates, eg: read from a .cer file, instead of PEM
+// data. Anything else is returned as is, for the PEM parsing to report.
+func derCertsToPEM(contents []byte) []byte {
+	// As in splitPEMBlocks, data holding a PEM header is PEM data, even if
+	// its blocks are malformed.
+	if bytes.Contains(contents, pemBeginMarker) {
+		return contents
+	}
+	certs, err := x509.ParseCertificates(contents)
+	if err != nil || len(certs) == 0 {
+		return contents
+	}
+	var certPEM []byte
+	for _, cert := range certs {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return certPEM
+}
+
 // PEMToPrivateKey parses a PEM block and returns the private key.
 func PEMToPrivateKey(contents []byte) (crypto.PrivateKey, error) {
-	keyBlock, remaining := pem.Decode(contents)
-	if keyBlock == nil {
+	blocks, err := splitPEMBlocks(contents)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
 		return nil, errors.New("no PEM data found")
 	}
-	if len(remaining) != 0 {
+	if len(blocks) > 1 {
 		return nil, errors.New("more than one PEM block found")
 	}
+	keyBlock := blocks[0]
 	if keyBlock.Type != "PRIVATE KEY" && !strings.HasSuffix(keyBlock.Type, " PRIVATE KEY") {
 		return nil, errors.Errorf("PEM block is of type %s", keyBlock.Type)
 	}
 
-	return parsePrivateKey(keyBlock.Bytes)
+	return parsePrivateKeyBlock(keyBlock)
+}
+
+// IncorrectKeyPasswordError is returned when an encrypted private key cannot
+// be decrypted with the supplied password.
+type IncorrectKeyPasswordError struct{}
+
+// Error implements the error interface.
+func (*IncorrectKeyPasswordError) Error() string {
+	return "incorrect password for encrypted private key"
+}
+
+// decryptPEMPrivateKey decrypts a PEM-encoded private key protected by a
+// "Proc-Type: 4,ENCRYPTED" header, or an encrypted PKCS#8 private key (see
+// decryptPKCS8PrivateKey), and returns the unencrypted PEM block. Keys that are
+// not encrypted are returned as is and the password is ignored.
+func decryptPEMPrivateKey(contents []byte, password string) ([]byte, error) {
+	blocks, err := splitPEMBlocks(contents)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid private key PEM data")
+	}
+	if len(blocks) > 0 && blocks[0].Type == encryptedPKCS8BlockType {
+		der, err := decryptPKCS8PrivateKey(blocks[0].Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parsePKCS8PrivateKey(der); err != nil {
+			return nil, &IncorrectKeyPasswordError{}
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	if len(blocks) == 0 || !x509.IsEncryptedPEMBlock(blocks[0]) {
+		return contents, nil
+	}
+	keyBlock := blocks[0]
+	der, err := x509.DecryptPEMBlock(keyBlock, []byte(password))
+	if err == x509.IncorrectPasswordError {
+		return nil, &IncorrectKeyPasswordError{}
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt private key")
+	}
+	// The padding check in DecryptPEMBlock does not catch all incorrect
+	// passwords: a key that fails to parse was likely decrypted with the
+	// wrong one.
+	if _, err := parsePrivateKey(der); err != nil {
+		return nil, &IncorrectKeyPasswordError{}
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: keyBlock.Type, Bytes: der}), nil
+}
+
+// parsePrivateKeyBlock parses the private key in the PEM block, in the format
+// named by its type: PKCS#8 for PRIVATE KEY blocks, PKCS#1 for RSA PRIVATE KEY
+// blocks and SEC 1 for EC PRIVATE KEY blocks. Mislabeled keys are still parsed,
+// as crypto/tls parses keys regardless of the block type, but the error of the
+// format named by the type is returned if all of them fail.
+func parsePrivateKeyBlock(block *pem.Block) (crypto.PrivateKey, error) {
+	var parse func([]byte) (crypto.PrivateKey, error)
+	var format string
+	switch block.Type {
+	case "PRIVATE KEY":
+		parse, format = parsePKCS8PrivateKey, "PKCS#8"
+	case "RSA PRIVATE KEY":
+		parse = func(der []byte) (crypto.PrivateKey, error) { return x509.ParsePKCS1PrivateKey(der) }
+		format = "PKCS#1"
+	case "EC PRIVATE KEY":
+		parse = func(der []byte) (crypto.PrivateKey, error) { return x509.ParseECPrivateKey(der) }
+		format = "SEC 1"
+	default:
+		return parsePrivateKey(block.Bytes)
+	}
+	key, err := parse(block.Bytes)
+	if err == nil {
+		return key, nil
+	}
+	if key, fallbackErr := parsePrivateKey(block.Bytes); fallbackErr == nil {
+		return key, nil
+	}
+	return nil, errors.Wrapf(err, "invalid %s private key", format)
+}
+
+// parsePKCS8PrivateKey parses a PKCS#8 private key of a supported type.
+func parsePKCS8PrivateKey(der []byte) (crypto.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, errors.Errorf("found unknown private key type %T in PKCS#8 wrapping", key)
+	}
 }
 
 // Taken straight from: golang.org/src/crypto/tls/tls.go
@@ -136,7 +345,7 @@ func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
 	}
 	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
 		switch key := key.(type) {
-		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
 			return key, nil
 		default:
 			return nil, errors.New("found unknown private key type in PKCS#8 wrapping")
@@ -0,0 +1,114 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/security/securitytest"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+)
+
+func TestPEMToCertificatesMalformed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) string {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+	caPEM, nodePEM := readAsset(security.EmbeddedCACert), readAsset(security.EmbeddedNodeCert)
+	otherPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: []byte("csr")}))
+	truncatedPEM := nodePEM[:len(nodePEM)/2]
+
+	testCases := []struct {
+		name          string
+		contents      string
+		expectedCerts int
+		expectedError string
+	}{
+		{"chain", nodePEM + caPEM, 2, ""},
+		{"text before blocks", "Certificate:\n  node\n" + nodePEM + "CA:\n" + caPEM, 2, ""},
+		{"unknown block type", otherPEM + nodePEM, 1, ""},
+		{"no PEM data", "not a certificate", 0, ""},
+		{"trailing data", nodePEM + "garbage\n", 0, `unexpected data after PEM block #0: "garbage"`},
+		{"truncated block", truncatedPEM + "\n" + caPEM, 0,
+			`malformed PEM block #0: "-----BEGIN CERTIFICATE-----"`},
+		{"truncated last block", nodePEM + truncatedPEM, 0, `malformed PEM block #1`},
+	}
+	for _, tc := range testCases {
+		certs, err := security.PEMToCertificates([]byte(tc.contents))
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			} else if len(certs) != tc.expectedCerts {
+				t.Errorf("%s: expected %d certificates, got %d", tc.name, tc.expectedCerts, len(certs))
+			}
+		} else if !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("%s: expected error %q, got %v", tc.name, tc.expectedError, err)
+		}
+	}
+
+	// The loaders report the malformed data.
+	keyPEM := readAsset(security.EmbeddedNodeKey)
+	_, _, err := security.LoadTLSConfigAndCert([]byte(nodePEM+"garbage"), []byte(keyPEM), []byte(caPEM))
+	if !errors.Is(err, security.ErrBadKeyPair) || !testutils.IsError(err, "unexpected data after PEM block #0") {
+		t.Errorf("expected trailing data error, got %v", err)
+	}
+	// As well as malformed CA bundles and CRLs.
+	for _, bundle := range []string{caPEM + "garbage", caPEM + truncatedPEM} {
+		_, _, err := security.LoadTLSConfigAndCert([]byte(nodePEM), []byte(keyPEM), []byte(bundle))
+		if !errors.Is(err, security.ErrBadCAPEM) || !testutils.IsError(err, "PEM block #") {
+			t.Errorf("expected malformed CA bundle error, got %v", err)
+		}
+	}
+	crlPEM := string(makeTestCRL(t))
+	if _, err := security.LoadCRL([]byte(crlPEM+"garbage"), []byte(caPEM)); !testutils.IsError(
+		err, "failed to parse CRL: unexpected data after PEM block #0",
+	) {
+		t.Errorf("expected malformed CRL error, got %v", err)
+	}
+}
+
+func TestPEMToPrivateKeyECParameters(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The EC PARAMETERS block emitted by "openssl ecparam -genkey" is skipped.
+	keyPEM := append(
+		pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{0x06, 0x08}}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+	parsed, err := security.PEMToPrivateKey(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ecKey, ok := parsed.(*ecdsa.PrivateKey); !ok || ecKey.D.Cmp(key.D) != 0 {
+		t.Errorf("unexpected private key %T", parsed)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Object identifiers of the PKCS#12 (RFC 7292) structures written by
+// ExportToPKCS12.
+var (
+	oidDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+
+	oidPKCS8ShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidLocalKeyID          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+const (
+	// pkcs12Iterations is the iteration count of the key derivations, the
+	// default of OpenSSL.
+	pkcs12Iterations = 2048
+	// pkcs12SaltSize is the size of the random salts.
+	pkcs12SaltSize = 8
+)
+
+// pfxPDU is the top-level PFX structure of PKCS#12.
+type pfxPDU struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData
+}
+
+// pkcs12ContentInfo is a PKCS#7 ContentInfo. Content is the explicitly tagged
+// content.
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// pkcs12MacData authenticates the contents of a PFX.
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+// pkcs12DigestInfo is a PKCS#7 DigestInfo.
+type pkcs12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// pkcs12SafeBag holds a certificate or a key. Value is the explicitly tagged
+// value.
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+// pkcs12Attribute is an attribute of a safe bag. Value is the SET of values.
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// pkcs12CertBag holds a DER-encoded certificate.
+type pkcs12CertBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// pkcs12PBEParams are the parameters of the PKCS#12 password-based encryption
+// schemes.
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// ExportToPKCS12 encodes the node certificate, its private key and the CA
+// certificates as a PKCS#12 bundle protected by password, eg: for Java tools.
+// It is the reverse of LoadTLSConfigFromPKCS12. certPEM may also hold the
+// chain of the node certificate, which is exported along with the CA
+// certificates.
+//
+// As the bundles are usually read by older tools, the private key is encrypted
+// with pbeWithSHAAnd3-KeyTripleDES-CBC, the certificates are not encrypted,
+// and the bundle is authenticated with HMAC-SHA1, as commonly done. Only RSA
+// and ECDSA keys are supported.
+func ExportToPKCS12(certPEM, keyPEM, caPEM []byte, password string) ([]byte, error) {
+	cert, err := loadX509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	switch cert.PrivateKey.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		keyAlgo, _ := privateKeyAlgorithm(cert.PrivateKey)
+		return nil, errors.Errorf("cannot export %s private keys to PKCS#12: only RSA and ECDSA are supported",
+			keyAlgo)
+	}
+	caCerts, err := PEMContentsToX509(caPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid CA certificate PEM data")
+	}
+	if len(caCerts) == 0 {
+		return nil, errors.New("at least one CA certificate is required")
+	}
+	encodedPassword, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+
+	// The key and the node certificate are associated through their local key
+	// ID, the SHA-1 digest of the certificate as for OpenSSL.
+	localKeyID := sha1.Sum(cert.Certificate[0])
+	keyIDAttr, err := pkcs12SetAttribute(oidLocalKeyID, localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	certBags := make([]pkcs12SafeBag, 0, len(cert.Certificate)+len(caCerts))
+	addCertBag := func(der []byte, attrs []pkcs12Attribute) error {
+		bag, err := asn1.Marshal(pkcs12CertBag{ID: oidX509Certificate, Data: der})
+		if err != nil {
+			return err
+		}
+		certBags = append(certBags, pkcs12SafeBag{ID: oidCertBag, Value: explicitTag0(bag), Attributes: attrs})
+		return nil
+	}
+	if err := addCertBag(cert.Certificate[0], []pkcs12Attribute{keyIDAttr}); err != nil {
+		return nil, err
+	}
+	for _, der := range cert.Certificate[1:] {
+		if err := addCertBag(der, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, caCert := range caCerts {
+		if err := addCertBag(caCert.Raw, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	keyBag, err := encryptPKCS12Key(cert.PrivateKey, encodedPassword)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encrypt private key")
+	}
+	keyBags := []pkcs12SafeBag{{
+		ID: oidPKCS8ShroudedKeyBag, Value: explicitTag0(keyBag), Attributes: []pkcs12Attribute{keyIDAttr},
+	}}
+
+	var authSafe []pkcs12ContentInfo
+	for _, bags := range [][]pkcs12SafeBag{certBags, keyBags} {
+		contentInfo, err := pkcs12DataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, contentInfo)
+	}
+	authSafeDER, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	authSafeContent, err := asn1.Marshal(authSafeDER)
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt, err := randomSalt()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pkcs12KDF(encodedPassword, macSalt, pkcs12Iterations, 3, sha1.Size))
+	_, _ = mac.Write(authSafeDER)
+	return asn1.Marshal(pfxPDU{
+		Version: 3,
+		AuthSafe: pkcs12ContentInfo{
+			ContentType: oidDataContentType,
+			Content:     explicitTag0(authSafeContent),
+		},
+		MacData: pkcs12MacData{
+			Mac: pkcs12DigestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// encryptPKCS12Key returns the DER-encoded EncryptedPrivateKeyInfo of key, as
+// held by a shrouded key bag.
+func encryptPKCS12Key(key interface{}, encodedPassword []byte) ([]byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := randomSalt()
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pkcs12PBEParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return nil, err
+	}
+	block, err := des.NewTripleDESCipher(pkcs12KDF(encodedPassword, salt, pkcs12Iterations, 1, 24))
+	if err != nil {
+		return nil, err
+	}
+	iv := pkcs12KDF(encodedPassword, salt, pkcs12Iterations, 2, block.BlockSize())
+
+	// The data is padded as specified in RFC 8018, section 6.1.1.
+	padding := block.BlockSize() - len(keyDER)%block.BlockSize()
+	encrypted := append(keyDER, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBEWithSHAAnd3KeyTripleDESCBC,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: encrypted,
+	})
+}
+
+// pkcs12DataContentInfo returns an unencrypted ContentInfo holding bags.
+func pkcs12DataContentInfo(bags []pkcs12SafeBag) (pkcs12ContentInfo, error) {
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+	content, err := asn1.Marshal(safeContents)
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+	return pkcs12ContentInfo{ContentType: oidDataContentType, Content: explicitTag0(content)}, nil
+}
+
+// pkcs12SetAttribute returns an attribute with the single octet string value.
+func pkcs12SetAttribute(id asn1.ObjectIdentifier, value []byte) (pkcs12Attribute, error) {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		return pkcs12Attribute{}, err
+	}
+	return pkcs12Attribute{
+		ID:    id,
+		Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der},
+	}, nil
+}
+
+// explicitTag0 wraps the DER-encoded value in an explicit [0] tag. The struct
+// tags of the fields holding raw values are ignored when marshaling.
+func explicitTag0(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// randomSalt returns a random salt for the key derivations.
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, pkcs12SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// bmpString encodes the password as a null-terminated BMPString (UCS-2), as
+// expected by the PKCS#12 key derivation.
+func bmpString(password string) ([]byte, error) {
+	encoded := make([]byte, 0, 2*len(password)+2)
+	for _, r := range password {
+		if r > 0xFFFF {
+			return nil, errors.New("the password contains characters that cannot be encoded in UCS-2")
+		}
+		encoded = append(encoded, byte(r>>8), byte(r))
+	}
+	return append(encoded, 0, 0), nil
+}
+
+// pkcs12KDF derives size bytes of key material for the purpose id (1 for
+// encryption keys, 2 for initialization vectors and 3 for MAC keys) from the
+// encoded password, using SHA-1 as specified in RFC 7292, appendix B.2.
+func pkcs12KDF(encodedPassword, salt []byte, iterations int, id byte, size int) []byte {
+	const v = 64
+	fill := func(b []byte) []byte {
+		filled := make([]byte, v*((len(b)+v-1)/v))
+		for i := range filled {
+			filled[i] = b[i%len(b)]
+		}
+		return filled
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(encodedPassword)...)
+
+	var derived []byte
+	for len(derived) < size {
+		h := sha1.New()
+		_, _ = h.Write(d)
+		_, _ = h.Write(i)
+		a := h.Sum(nil)
+		for n := 1; n < iterations; n++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		derived = append(derived, a...)
+
+		// Each v-byte block of i is replaced by (block + b + 1) mod 2^(8v),
+		// where b is a repeated to v bytes.
+		b := fill(a)
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(i[j+k]) + int(b[k]) + carry
+				i[j+k], carry = byte(sum), sum>>8
+			}
+		}
+	}
+	return derived[:size]
+}
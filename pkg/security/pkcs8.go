@@ -0,0 +1,207 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"hash"
+
+	"github.com/cockroachdb/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// encryptedPKCS8BlockType is the type of the PEM blocks holding encrypted
+// PKCS#8 private keys, as written by `openssl pkcs8 -topk8`.
+const encryptedPKCS8BlockType = "ENCRYPTED PRIVATE KEY"
+
+// maxPBKDF2Iterations bounds the PBKDF2 iteration count read from a key file,
+// so that a crafted key cannot stall the loading of the certificates. It is
+// far above the counts written by OpenSSL (2048 by default).
+const maxPBKDF2Iterations = 10000000
+
+// Object identifiers of the PKCS#5 v2.0 (RFC 8018) encryption scheme, key
+// derivation function and pseudorandom functions, and of the ciphers.
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// encryptedPrivateKeyInfo is the EncryptedPrivateKeyInfo structure of PKCS#8
+// (RFC 5208, section 6).
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+// pbes2Params are the parameters of the PBES2 encryption scheme.
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the parameters of the PBKDF2 key derivation function. Only
+// the salts specified as octet strings are supported, the other sources of
+// salt being reserved for future use by RFC 8018.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// pbes2Cipher describes a block cipher usable in the PBES2 scheme, in CBC
+// mode.
+type pbes2Cipher struct {
+	keySize  int
+	newBlock func(key []byte) (cipher.Block, error)
+}
+
+// pbes2Ciphers are the supported PBES2 ciphers, by object identifier.
+var pbes2Ciphers = map[string]pbes2Cipher{
+	oidAES128CBC.String():  {16, aes.NewCipher},
+	oidAES192CBC.String():  {24, aes.NewCipher},
+	oidAES256CBC.String():  {32, aes.NewCipher},
+	oidDESEDE3CBC.String(): {24, des.NewTripleDESCipher},
+}
+
+// pbkdf2PRFs are the supported PBKDF2 pseudorandom functions, by object
+// identifier.
+var pbkdf2PRFs = map[string]func() hash.Hash{
+	oidHMACWithSHA1.String():   sha1.New,
+	oidHMACWithSHA224.String(): sha256.New224,
+	oidHMACWithSHA256.String(): sha256.New,
+	oidHMACWithSHA384.String(): sha512.New384,
+	oidHMACWithSHA512.String(): sha512.New,
+}
+
+// decryptPKCS8PrivateKey decrypts the DER-encoded EncryptedPrivateKeyInfo of
+// an ENCRYPTED PRIVATE KEY block, and returns the DER-encoded PKCS#8 private
+// key. Only the PBES2 scheme with the PBKDF2 key derivation function is
+// supported, as used by default by OpenSSL since 1.1.0.
+//
+// As for the legacy encrypted PEM blocks, an incorrect password is reported
+// through an *IncorrectKeyPasswordError if the decrypted data has invalid
+// padding, and is otherwise only caught when parsing the key.
+func decryptPKCS8PrivateKey(der []byte, password string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if err := unmarshalDER(der, &info); err != nil {
+		return nil, errors.Wrap(err, "invalid encrypted PKCS#8 private key")
+	}
+	if algo := info.EncryptionAlgorithm.Algorithm; !algo.Equal(oidPBES2) {
+		return nil, errors.Errorf("unsupported PKCS#8 private key encryption scheme %s: only PBES2 is supported", algo)
+	}
+	var params pbes2Params
+	if err := unmarshalDER(info.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.Wrap(err, "invalid PBES2 parameters")
+	}
+
+	c, ok := pbes2Ciphers[params.EncryptionScheme.Algorithm.String()]
+	if !ok {
+		return nil, errors.Errorf("unsupported PBES2 cipher %s", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if err := unmarshalDER(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.Wrap(err, "invalid PBES2 cipher parameters")
+	}
+	key, err := deriveKeyPBKDF2(params.KeyDerivationFunc, password, c.keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := c.newBlock(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errors.Errorf("invalid PBES2 initialization vector of %d bytes", len(iv))
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid PBES2 encrypted data length")
+	}
+	decrypted := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, data)
+
+	// The data is padded as specified in RFC 8018, section 6.2.1.
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, &IncorrectKeyPasswordError{}
+	}
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			return nil, &IncorrectKeyPasswordError{}
+		}
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+// deriveKeyPBKDF2 derives a key of keySize bytes from the password, as
+// specified by kdf.
+func deriveKeyPBKDF2(kdf pkix.AlgorithmIdentifier, password string, keySize int) ([]byte, error) {
+	if !kdf.Algorithm.Equal(oidPBKDF2) {
+		return nil, errors.Errorf("unsupported PBES2 key derivation function %s: only PBKDF2 is supported",
+			kdf.Algorithm)
+	}
+	var params pbkdf2Params
+	if err := unmarshalDER(kdf.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.Wrap(err, "invalid PBKDF2 parameters")
+	}
+	if params.IterationCount <= 0 {
+		return nil, errors.Errorf("invalid PBKDF2 iteration count %d", params.IterationCount)
+	}
+	if params.IterationCount > maxPBKDF2Iterations {
+		return nil, errors.Errorf("PBKDF2 iteration count %d exceeds the maximum of %d",
+			params.IterationCount, maxPBKDF2Iterations)
+	}
+	if params.KeyLength != 0 && params.KeyLength != keySize {
+		return nil, errors.Errorf("PBKDF2 key length %d does not match the cipher key size %d",
+			params.KeyLength, keySize)
+	}
+	// The PRF defaults to HMAC-SHA1.
+	prf := sha1.New
+	if params.PRF.Algorithm != nil {
+		var ok bool
+		if prf, ok = pbkdf2PRFs[params.PRF.Algorithm.String()]; !ok {
+			return nil, errors.Errorf("unsupported PBKDF2 pseudorandom function %s", params.PRF.Algorithm)
+		}
+	}
+	return pbkdf2.Key([]byte(password), params.Salt, params.IterationCount, keySize, prf), nil
+}
+
+// unmarshalDER parses the DER-encoded data into val, which must hold all of
+// it.
+func unmarshalDER(der []byte, val interface{}) error {
+	rest, err := asn1.Unmarshal(der, val)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("trailing data after ASN.1 structure")
+	}
+	return nil
+}
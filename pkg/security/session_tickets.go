@@ -0,0 +1,93 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/errors"
+)
+
+// Session tickets let clients resume a previous TLS session without a full
+// handshake. They are encrypted with session ticket keys: by default, each
+// tls.Config uses its own random keys, so that sessions can only be resumed
+// with the config, hence the node, that created them. Clients connecting
+// through a load balancer can only resume their sessions on any node if all
+// the nodes behind the load balancer share the same keys.
+
+// NewSessionTicketKey returns a random session ticket key.
+func NewSessionTicketKey() ([32]byte, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return key, errors.Wrap(err, "could not generate session ticket key")
+	}
+	return key, nil
+}
+
+// SetSessionTicketKeys sets the session ticket keys of the server config. The
+// first key is used to encrypt new tickets, and all of them to decrypt
+// tickets: keeping the previous keys around after a rotation lets clients
+// resume the sessions created before it.
+func SetSessionTicketKeys(config *tls.Config, keys [][32]byte) error {
+	if len(keys) == 0 {
+		return errors.New("at least one session ticket key is required")
+	}
+	config.SetSessionTicketKeys(keys)
+	return nil
+}
+
+// RotateSessionTicketKeys sets the session ticket keys of the server config to
+// the ones returned by keysFn, then refreshes them every interval until the
+// stopper quiesces. keysFn is expected to return the current key first,
+// followed by the keys still accepted for decryption (see
+// SetSessionTicketKeys). For cross-node resumption, it must return the same
+// keys on all the nodes.
+//
+// An error is returned if the initial keys cannot be set. Later failures are
+// logged, and the previous keys are kept.
+func RotateSessionTicketKeys(
+	stopper *stop.Stopper,
+	config *tls.Config,
+	interval time.Duration,
+	keysFn func() ([][32]byte, error),
+) error {
+	setKeys := func() error {
+		keys, err := keysFn()
+		if err != nil {
+			return errors.Wrap(err, "could not get session ticket keys")
+		}
+		return SetSessionTicketKeys(config, keys)
+	}
+	if err := setKeys(); err != nil {
+		return err
+	}
+
+	stopper.RunWorker(context.Background(), func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopper.ShouldQuiesce():
+				return
+			case <-ticker.C:
+				if err := setKeys(); err != nil {
+					log.Warningf(ctx, "could not rotate session ticket keys: %v", err)
+				}
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+)
+
+// resumingClientTLSConfig returns a client config caching its sessions. TLS
+// 1.2 is used so that the session ticket is received during the handshake.
+func resumingClientTLSConfig(t *testing.T) *tls.Config {
+	config := embeddedClientTLSConfig(t)
+	config.MaxVersion = tls.VersionTLS12
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	return config
+}
+
+// didResume performs a handshake and returns whether the session was resumed.
+func didResume(t *testing.T, serverConfig, clientConfig *tls.Config) bool {
+	t.Helper()
+	state, err := testHandshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.DidResume
+}
+
+func TestSetSessionTicketKeys(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	newKey := func() [32]byte {
+		key, err := security.NewSessionTicketKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	oldKey, currentKey := newKey(), newKey()
+
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{})
+	if err := security.SetSessionTicketKeys(serverConfig, nil); !testutils.IsError(err, "at least one session ticket key is required") {
+		t.Fatalf("expected missing keys error, got %v", err)
+	}
+
+	// Sessions created with the old key can be resumed by servers still
+	// accepting it, eg: other nodes, after a rotation.
+	if err := security.SetSessionTicketKeys(serverConfig, [][32]byte{oldKey}); err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := resumingClientTLSConfig(t)
+	if didResume(t, serverConfig, clientConfig) {
+		t.Fatal("unexpected resumption on the first handshake")
+	}
+	otherServerConfig := embeddedServerTLSConfig(t, security.TLSOptions{})
+	if err := security.SetSessionTicketKeys(otherServerConfig, [][32]byte{currentKey, oldKey}); err != nil {
+		t.Fatal(err)
+	}
+	if !didResume(t, otherServerConfig, clientConfig) {
+		t.Error("expected the session to be resumed by a server sharing the key")
+	}
+
+	// Servers with other keys cannot resume the session.
+	clientConfig = resumingClientTLSConfig(t)
+	didResume(t, serverConfig, clientConfig)
+	if didResume(t, embeddedServerTLSConfig(t, security.TLSOptions{}), clientConfig) {
+		t.Error("unexpected resumption by a server with a different key")
+	}
+}
+
+func TestRotateSessionTicketKeys(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{})
+	if err := security.RotateSessionTicketKeys(stopper, serverConfig, time.Millisecond,
+		func() ([][32]byte, error) { return nil, errors.New("boom") },
+	); !testutils.IsError(err, "could not get session ticket keys: boom") {
+		t.Fatalf("expected keys error, got %v", err)
+	}
+
+	var mu struct {
+		syncutil.Mutex
+		calls int
+	}
+	if err := security.RotateSessionTicketKeys(stopper, serverConfig, time.Millisecond,
+		func() ([][32]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			mu.calls++
+			key, err := security.NewSessionTicketKey()
+			return [][32]byte{key}, err
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	testutils.SucceedsSoon(t, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if mu.calls < 3 {
+			return errors.Errorf("keys rotated %d times", mu.calls-1)
+		}
+		return nil
+	})
+}
+
+func TestSessionTicketsDisabled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, disabled := range []bool{false, true} {
+		serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{SessionTicketsDisabled: disabled})
+		clientConfig := resumingClientTLSConfig(t)
+		didResume(t, serverConfig, clientConfig)
+		if resumed := didResume(t, serverConfig, clientConfig); resumed == disabled {
+			t.Errorf("session tickets disabled: %t, but resumed: %t", disabled, resumed)
+		}
+	}
+}
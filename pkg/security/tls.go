@@ -11,10 +11,28 @@
 package security
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
+	"golang.org/x/crypto/pkcs12"
 )
 
 // EmbeddedCertsDir is the certs directory inside embedded assets.
@@ -35,6 +53,449 @@ const (
 	EmbeddedTestUserKey  = "client.testuser.key"
 )
 
+// Errors returned by the loaders when certificates or keys are malformed or
+// empty, as opposed to eg: missing or unreadable. They can be tested for with
+// errors.Is.
+var (
+	// ErrBadCAPEM indicates that no CA certificates could be parsed.
+	ErrBadCAPEM = errors.New("invalid CA certificate PEM data")
+	// ErrBadKeyPair indicates that a certificate and private key could not be
+	// parsed, or do not match.
+	ErrBadKeyPair = errors.New("invalid certificate and key pair")
+	// ErrEmptyCAFile indicates that the CA certificate data is empty or only
+	// holds whitespace, eg: because the file was mounted before being
+	// populated. Unlike ErrBadCAPEM, loading it again later may succeed.
+	ErrEmptyCAFile = errors.New("empty CA certificate file")
+	// ErrEmptyCertFile is the equivalent of ErrEmptyCAFile for certificate and
+	// private key files.
+	ErrEmptyCertFile = errors.New("empty certificate or key file")
+)
+
+// ClientCertMode is the policy of a server regarding client certificates.
+type ClientCertMode int
+
+const (
+	// ClientCertVerifyIfGiven verifies the client certificates, but lets
+	// clients without a certificate through. This is the default.
+	ClientCertVerifyIfGiven ClientCertMode = iota
+	// ClientCertNone does not request client certificates.
+	ClientCertNone
+	// ClientCertRequired requires a valid client certificate, and rejects
+	// clients without one. This is the right mode for node-to-node traffic.
+	ClientCertRequired
+)
+
+// clientAuthType returns the tls.ClientAuthType implementing the mode.
+func (m ClientCertMode) clientAuthType() (tls.ClientAuthType, error) {
+	switch m {
+	case ClientCertVerifyIfGiven:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientCertNone:
+		return tls.NoClientCert, nil
+	case ClientCertRequired:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return 0, errors.Errorf("unknown client certificate mode %d", m)
+	}
+}
+
+// TLSOptions holds optional settings for server TLS configs.
+// The zero value preserves the default settings.
+type TLSOptions struct {
+	// MinVersion is the minimum TLS version accepted by the server. It must be
+	// one of the tls.Version* constants, SSLv3 excluded. If zero, TLS 1.2 is
+	// used.
+	MinVersion uint16
+	// CipherSuites is the list of cipher suites the server accepts, in order of
+	// preference. Only TLS 1.0-1.2 suites can be configured. If empty, the
+	// default list set in newBaseTLSConfig is used.
+	CipherSuites []uint16
+	// CRLChecker, if set, is used to reject revoked client certificates.
+	CRLChecker *CRLChecker
+	// CurvePreferences is the list of elliptic curves accepted for key
+	// exchange, in order of preference. If empty, the Go defaults are used.
+	CurvePreferences []tls.CurveID
+	// SessionTicketsDisabled disables session resumption through session
+	// tickets, which may undermine forward secrecy.
+	SessionTicketsDisabled bool
+	// NextProtos is the list of application protocols advertised through
+	// ALPN, in order of preference. If empty, ALPN is not used.
+	NextProtos []string
+	// VerifyPeerCertificate, if set, is called after the standard
+	// verification of peer certificates, with the chains built from the
+	// configured CAs, and after the CRLChecker if any. Returning an error
+	// aborts the handshake. It can be used to implement custom acceptance
+	// policies, eg: based on the certificate subject.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+	// RootCAs and ClientCAs, if set, replace the pools built from the CA and
+	// client CA certificates passed to the loader, eg: to trust several CAs
+	// with the Pool of a CAPool. See NewCertPoolFromFiles and MergeCertPools.
+	//
+	// CAFilesGlob, if set, is a pattern matching CA certificate files, eg:
+	// "/certs/ca-*.crt", whose certificates replace both pools, unless they
+	// are set. See LoadCertPoolFromGlob.
+	RootCAs, ClientCAs *x509.CertPool
+	CAFilesGlob        string
+	// ClientCertMode is the policy regarding client certificates. By default,
+	// they are verified if given.
+	ClientCertMode ClientCertMode
+	// CheckExtKeyUsage, if set, requires the server certificates to allow
+	// server authentication through their extended key usage: loading a
+	// certificate without it fails.
+	CheckExtKeyUsage bool
+	// MinRSAKeyBits, if non-zero, is the minimum size in bits of RSA private
+	// keys: loading a certificate with a shorter RSA key fails. Other key
+	// types are not checked.
+	MinRSAKeyBits int
+	// AllowedCommonNames, if non-empty, is the list of CommonNames accepted in
+	// verified client certificates: a certificate signed by the client CA but
+	// with any other CommonName is rejected. If empty, any CommonName is
+	// accepted.
+	AllowedCommonNames []string
+	// NotIssuedBefore, if non-zero, rejects the client certificates whose
+	// validity starts (NotBefore) before it, eg: to invalidate all the
+	// certificates issued before a CA compromise once they are reissued.
+	NotIssuedBefore time.Time
+	// MaxPeerCertificates is the maximum number of certificates a client can
+	// present: longer chains are rejected, so that clients cannot make the
+	// server spend time on huge chains. If zero, defaultMaxPeerCertificates is
+	// used.
+	//
+	// The check is done in VerifyPeerCertificate, which the tls package calls
+	// after verifying the chain itself.
+	MaxPeerCertificates int
+	// CAPools, if set, holds the CA pools replacing RootCAs and ClientCAs
+	// once they are updated: see CAPoolHolder.
+	CAPools *CAPoolHolder
+	// HandshakeStats, if set, counts the client certificate verification
+	// failures by reason. The failures detected by the tls package are only
+	// counted by the listeners returned by NewHandshakeStatsListener: see
+	// HandshakeStats.
+	HandshakeStats *HandshakeStats
+	// GetConfigForClient, if set, is called on each handshake with the
+	// ClientHello and the config otherwise served, and returns the config to
+	// serve instead, eg: to require client certificates or trust other CAs
+	// depending on hello.Conn.RemoteAddr(). Returning nil serves the passed-in
+	// config, and returning an error aborts the handshake.
+	//
+	// The passed-in config must not be modified: the callback should return a
+	// copy made with Clone or CloneWithOverrides, which keeps the peer
+	// certificate checks set up by the other options.
+	GetConfigForClient func(hello *tls.ClientHelloInfo, base *tls.Config) (*tls.Config, error)
+}
+
+// apply validates the options and sets them on the passed-in config.
+func (opts TLSOptions) apply(cfg *tls.Config) error {
+	if opts.CAFilesGlob != "" {
+		pool, err := LoadCertPoolFromGlob(opts.CAFilesGlob)
+		if err != nil {
+			return err
+		}
+		cfg.RootCAs, cfg.ClientCAs = pool.Pool, pool.Pool
+	}
+	if opts.RootCAs != nil {
+		cfg.RootCAs = opts.RootCAs
+	}
+	if opts.ClientCAs != nil {
+		cfg.ClientCAs = opts.ClientCAs
+	}
+	if opts.MinVersion != 0 {
+		if err := validateTLSVersion(opts.MinVersion); err != nil {
+			return err
+		}
+		cfg.MinVersion = opts.MinVersion
+	}
+	if len(opts.CipherSuites) > 0 {
+		if err := validateCipherSuites(opts.CipherSuites); err != nil {
+			return err
+		}
+		cfg.CipherSuites = append([]uint16(nil), opts.CipherSuites...)
+	}
+	clientAuth, err := opts.ClientCertMode.clientAuthType()
+	if err != nil {
+		return err
+	}
+	cfg.ClientAuth = clientAuth
+	for i := range cfg.Certificates {
+		if err := opts.checkCertificate(&cfg.Certificates[i]); err != nil {
+			return err
+		}
+	}
+	if opts.CRLChecker != nil {
+		cfg.VerifyPeerCertificate = chainVerifyPeerCertificate(
+			cfg.VerifyPeerCertificate, opts.CRLChecker.VerifyPeerCertificate)
+	}
+	if len(opts.AllowedCommonNames) > 0 {
+		cfg.VerifyPeerCertificate = chainVerifyPeerCertificate(
+			cfg.VerifyPeerCertificate, verifyCommonNames(opts.AllowedCommonNames))
+	}
+	if !opts.NotIssuedBefore.IsZero() {
+		cfg.VerifyPeerCertificate = chainVerifyPeerCertificate(
+			cfg.VerifyPeerCertificate, verifyNotIssuedBefore(opts.NotIssuedBefore))
+	}
+	if opts.VerifyPeerCertificate != nil {
+		cfg.VerifyPeerCertificate = chainVerifyPeerCertificate(
+			cfg.VerifyPeerCertificate, opts.VerifyPeerCertificate)
+	}
+	if len(opts.CurvePreferences) > 0 {
+		if err := validateCurves(opts.CurvePreferences); err != nil {
+			return err
+		}
+		cfg.CurvePreferences = append([]tls.CurveID(nil), opts.CurvePreferences...)
+	}
+	cfg.SessionTicketsDisabled = opts.SessionTicketsDisabled
+	if len(opts.NextProtos) > 0 {
+		cfg.NextProtos = append([]string(nil), opts.NextProtos...)
+	}
+	if opts.GetConfigForClient != nil {
+		tailorConfigForClient(cfg, opts.GetConfigForClient)
+	}
+	// This must come last but for the chain length check, as it wraps the
+	// client certificate verification set up above.
+	if opts.HandshakeStats != nil {
+		opts.HandshakeStats.install(cfg)
+	}
+	maxPeerCerts := opts.MaxPeerCertificates
+	if maxPeerCerts < 0 {
+		return errors.Errorf("invalid maximum number of peer certificates %d", maxPeerCerts)
+	} else if maxPeerCerts == 0 {
+		maxPeerCerts = defaultMaxPeerCertificates
+	}
+	cfg.VerifyPeerCertificate = chainVerifyPeerCertificate(
+		verifyPeerCertificateCount(maxPeerCerts), cfg.VerifyPeerCertificate)
+	return nil
+}
+
+// tailorConfigForClient sets up cfg to serve the configs returned by fn, which
+// is passed the config served by the GetConfigForClient callback already set,
+// if any, or cfg itself.
+func tailorConfigForClient(
+	cfg *tls.Config, fn func(*tls.ClientHelloInfo, *tls.Config) (*tls.Config, error),
+) {
+	next := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		var served *tls.Config
+		if next != nil {
+			var err error
+			if served, err = next(hello); err != nil {
+				return nil, err
+			}
+		}
+		base := served
+		if base == nil {
+			base = cfg
+		}
+		tailored, err := fn(hello, base)
+		if err != nil {
+			return nil, err
+		}
+		if tailored == nil {
+			return served, nil
+		}
+		return tailored, nil
+	}
+}
+
+// checkCertificate returns an error if the certificate does not satisfy
+// CheckExtKeyUsage, or its key MinRSAKeyBits.
+func (opts TLSOptions) checkCertificate(cert *tls.Certificate) error {
+	if opts.CheckExtKeyUsage {
+		if err := checkExtKeyUsage(cert.Leaf, x509.ExtKeyUsageServerAuth, "serverAuth"); err != nil {
+			return err
+		}
+	}
+	return opts.checkPrivateKey(cert.PrivateKey)
+}
+
+// checkPrivateKey returns an error if key is an RSA key shorter than
+// MinRSAKeyBits.
+func (opts TLSOptions) checkPrivateKey(key crypto.PrivateKey) error {
+	if opts.MinRSAKeyBits == 0 {
+		return nil
+	}
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		if bits := rsaKey.N.BitLen(); bits < opts.MinRSAKeyBits {
+			return errors.Errorf("RSA key of %d bits is shorter than the minimum of %d bits",
+				bits, opts.MinRSAKeyBits)
+		}
+	}
+	return nil
+}
+
+// checkExtKeyUsage returns an error if the certificate does not list usage,
+// named usageName, or the "any" usage in its extended key usages.
+func checkExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage, usageName string) error {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage || u == x509.ExtKeyUsageAny {
+			return nil
+		}
+	}
+	return errors.Errorf("certificate %q does not have the %s extended key usage",
+		cert.Subject.CommonName, usageName)
+}
+
+// sctListOID is the OID of the certificate extension holding the signed
+// certificate timestamps embedded by the CA (RFC 6962, section 3.3).
+var sctListOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// verifyEmbeddedSCT is a VerifyPeerCertificate callback returning an error if
+// the peer certificate has no embedded signed certificate timestamp.
+func verifyEmbeddedSCT(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no peer certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return errors.Wrap(err, "failed to parse peer certificate")
+	}
+	if _, ok := CertExtensionByOID(cert, sctListOID); ok {
+		return nil
+	}
+	return errors.Errorf("certificate %q has no embedded signed certificate timestamp",
+		cert.Subject.CommonName)
+}
+
+// defaultMaxPeerCertificates is the default of
+// TLSOptions.MaxPeerCertificates. Legitimate chains rarely hold more than a
+// leaf and a couple of intermediates.
+const defaultMaxPeerCertificates = 10
+
+// verifyPeerCertificateCount returns a VerifyPeerCertificate callback
+// returning an error if the peer presented more than max certificates.
+func verifyPeerCertificateCount(max int) verifyPeerCertificateFn {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) > max {
+			return errors.Mark(errors.Errorf("peer presented %d certificates, more than the maximum of %d",
+				len(rawCerts), max), errUncountedHandshakeFailure)
+		}
+		return nil
+	}
+}
+
+// verifyCommonNames returns a VerifyPeerCertificate callback returning an
+// error if the leaf of a verified chain has a CommonName not in allowed.
+func verifyCommonNames(allowed []string) verifyPeerCertificateFn {
+	allowedSet := make(map[string]struct{}, len(allowed))
+	for _, cn := range allowed {
+		allowedSet[cn] = struct{}{}
+	}
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			if len(chain) == 0 {
+				continue
+			}
+			cn := chain[0].Subject.CommonName
+			if _, ok := allowedSet[cn]; !ok {
+				return errors.Errorf("certificate CommonName %q is not allowed", cn)
+			}
+		}
+		return nil
+	}
+}
+
+// verifyNotIssuedBefore returns a VerifyPeerCertificate callback rejecting the
+// peer certificates whose validity starts before cutoff.
+func verifyNotIssuedBefore(cutoff time.Time) verifyPeerCertificateFn {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return nil
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return errors.Wrap(err, "failed to parse peer certificate")
+		}
+		if cert.NotBefore.Before(cutoff) {
+			return errors.Errorf("certificate %q (serial %s) was issued on %s, before the cutoff of %s",
+				cert.Subject.CommonName, CertSerial(cert), cert.NotBefore, cutoff)
+		}
+		return nil
+	}
+}
+
+// verifyPeerCertificateFn is the type of the tls.Config.VerifyPeerCertificate
+// callback.
+type verifyPeerCertificateFn = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+// chainVerifyPeerCertificate returns a VerifyPeerCertificate callback calling
+// first, then second, if set. It stops at the first error.
+func chainVerifyPeerCertificate(first, second verifyPeerCertificateFn) verifyPeerCertificateFn {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if err := first(rawCerts, verifiedChains); err != nil {
+			return err
+		}
+		return second(rawCerts, verifiedChains)
+	}
+}
+
+// validateTLSVersion returns an error if version is not a known TLS version.
+func validateTLSVersion(version uint16) error {
+	switch version {
+	case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+		return nil
+	default:
+		return errors.Errorf("unknown or unsupported TLS version 0x%04x", version)
+	}
+}
+
+// validateCurves returns an error if some of the curves are unknown.
+func validateCurves(curves []tls.CurveID) error {
+	for _, curve := range curves {
+		switch curve {
+		case tls.CurveP256, tls.CurveP384, tls.CurveP521, tls.X25519:
+		default:
+			return errors.Errorf("unknown or unsupported curve %d", curve)
+		}
+	}
+	return nil
+}
+
+// cipherSuiteNames maps the configurable cipher suites to their names.
+var cipherSuiteNames = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                "TLS_RSA_WITH_RC4_128_SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+}
+
+// validateCipherSuites returns an error listing all the passed-in cipher
+// suites that are not known configurable suites.
+func validateCipherSuites(suites []uint16) error {
+	var unknown []string
+	for _, id := range suites {
+		if _, ok := cipherSuiteNames[id]; !ok {
+			unknown = append(unknown, fmt.Sprintf("0x%04x", id))
+		}
+	}
+	if len(unknown) > 0 {
+		return errors.Errorf("unknown cipher suites: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
 // LoadServerTLSConfig creates a server TLSConfig by loading the CA and server certs.
 // The following paths must be passed:
 // - sslCA: path to the CA certificate
@@ -42,25 +503,550 @@ const (
 //                can be the same as sslCA
 // - sslCert: path to the server certificate
 // - sslCertKey: path to the server key
+// The CA certificates can be PEM or DER-encoded, eg: .cer files.
 // If the path is prefixed with "embedded=", load the embedded certs.
 func LoadServerTLSConfig(sslCA, sslClientCA, sslCert, sslCertKey string) (*tls.Config, error) {
-	certPEM, err := assetLoaderImpl.ReadFile(sslCert)
+	return LoadServerTLSConfigWithOptions(sslCA, sslClientCA, sslCert, sslCertKey, TLSOptions{})
+}
+
+// LoadServerTLSConfigWithOptions is like LoadServerTLSConfig, but applies the
+// passed-in options on top of the default server settings.
+func LoadServerTLSConfigWithOptions(
+	sslCA, sslClientCA, sslCert, sslCertKey string, opts TLSOptions,
+) (*tls.Config, error) {
+	certPEM, err := readAsset(sslCert)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readAsset(sslCertKey)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := readAsset(sslCA)
+	if err != nil {
+		return nil, err
+	}
+	clientCAPEM, err := readAsset(sslClientCA)
+	if err != nil {
+		return nil, err
+	}
+	return newServerTLSConfig(certPEM, keyPEM, caPEM, clientCAPEM, opts)
+}
+
+// CertKeyPair holds a PEM-encoded certificate and its private key.
+type CertKeyPair struct {
+	CertPEM, KeyPEM []byte
+}
+
+// NewServerTLSConfigWithSNI creates a server TLSConfig presenting the
+// certificate registered for the server name requested by the client through
+// SNI, or defaultPair if there is none. Server names are matched exactly, case
+// insensitively. caPEM and caClientPEM are used to verify server and client
+// certificates respectively, as in LoadServerTLSConfig.
+func NewServerTLSConfigWithSNI(
+	defaultPair CertKeyPair, pairs map[string]CertKeyPair, caPEM, caClientPEM []byte, opts TLSOptions,
+) (*tls.Config, error) {
+	cfg, err := newServerTLSConfig(defaultPair.CertPEM, defaultPair.KeyPEM, caPEM, caClientPEM, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := make(map[string]*tls.Certificate, len(pairs))
+	for serverName, pair := range pairs {
+		cert, err := loadX509KeyPair(pair.CertPEM, pair.KeyPEM)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not load certificate for server name %q", serverName)
+		}
+		if err := opts.checkCertificate(&cert); err != nil {
+			return nil, errors.Wrapf(err, "invalid certificate for server name %q", serverName)
+		}
+		certs[strings.ToLower(serverName)] = &cert
+	}
+	defaultCert := &cfg.Certificates[0]
+	// GetCertificate is only called when the client sends a server name:
+	// other clients get Certificates[0], the default certificate.
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert, ok := certs[strings.ToLower(hello.ServerName)]; ok {
+			return cert, nil
+		}
+		return defaultCert, nil
+	}
+	return cfg, nil
+}
+
+// LoadTLSConfigAndCert creates a server TLSConfig from the supplied node
+// certificate and key, using caPEM to verify both server and client
+// certificates. It also returns the parsed node certificate.
+func LoadTLSConfigAndCert(certPEM, keyPEM, caPEM []byte) (*tls.Config, *x509.Certificate, error) {
+	cfg, err := newServerTLSConfig(certPEM, keyPEM, caPEM, caPEM, TLSOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, cfg.Certificates[0].Leaf, nil
+}
+
+// LoadTLSConfigFromCombinedPEM is like LoadTLSConfigAndCert, but the node
+// certificate, with its chain if any, and its private key are in the same PEM
+// data, in any order.
+func LoadTLSConfigFromCombinedPEM(combinedPEM, caPEM []byte) (*tls.Config, error) {
+	certPEM, keyPEM, err := splitCombinedPEM(combinedPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid combined certificate and key")
+	}
+	return newServerTLSConfig(certPEM, keyPEM, caPEM, caPEM, TLSOptions{})
+}
+
+// LoadTLSConfigWith is like LoadTLSConfigAndCert, but calls configure, if not
+// nil, with the config before returning it, so that callers can set the fields
+// that have no equivalent in TLSOptions. The Certificates, RootCAs, ClientCAs
+// and ClientAuth are set before configure runs, and may be overridden,
+// including the pools.
+//
+// The config is not checked again after configure runs.
+func LoadTLSConfigWith(
+	certPEM, keyPEM, caPEM []byte, configure func(*tls.Config),
+) (*tls.Config, error) {
+	cfg, err := newServerTLSConfig(certPEM, keyPEM, caPEM, caPEM, TLSOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	return cfg, nil
+}
+
+// LoadTLSConfigDistinctCAs creates a server TLSConfig from the supplied node
+// certificate and key, verifying peer server certificates with rootCAPEM and
+// client certificates with clientCAPEM only. This narrows the CAs allowed to
+// authenticate clients, eg: to a single one of the CAs trusted for server
+// certificates. Unlike rootCAPEM, which falls back to the system pool if nil,
+// clientCAPEM is required.
+func LoadTLSConfigDistinctCAs(certPEM, keyPEM, rootCAPEM, clientCAPEM []byte) (*tls.Config, error) {
+	if clientCAPEM == nil {
+		return nil, errors.New("a client CA certificate is required")
+	}
+	return newServerTLSConfig(certPEM, keyPEM, rootCAPEM, clientCAPEM, TLSOptions{})
+}
+
+// CertsDirOptions holds optional settings for loading a server TLS config
+// from a certs directory.
+type CertsDirOptions struct {
+	TLSOptions
+
+	// Password is used to decrypt the node key if it is encrypted. It is
+	// ignored otherwise.
+	Password string
+	// SkipCAVerification disables checking that the node certificate is
+	// signed by the CA certificate. This is only meant for setups whose
+	// chain cannot be built from the certs directory alone.
+	SkipCAVerification bool
+}
+
+// LoadTLSConfigFromDir creates a server TLSConfig from the CA and node
+// certificates in certDir. RootCAs and ClientCAs are populated independently:
+// peer server certificates are verified using the CA certificate, and client
+// certificates using the client CA certificate if present, falling back to the
+// CA certificate otherwise. If present, the intermediate CA certificates are
+// appended to the node certificate chain, and the OCSP response in the node
+// OCSP staple file is stapled to the node certificate. Use NewOCSPStapler to
+// refresh the staple at runtime.
+//
+// Unless opts.SkipCAVerification is set, the node certificate must chain up to
+// the CA certificate: a mismatched pair is reported here instead of failing
+// every handshake later on.
+//
+// If the CA certificate file is absent, the certificates following the leaf in
+// the node certificate file are used as the CA certificates, for issuers
+// bundling the CA chain with the node certificate.
+//
+// If an ECDSA node certificate and key are also present, they are served to
+// the clients supporting ECDSA, and the node certificate to the others. The
+// ECDSA certificate is the second entry of Certificates.
+//
+// If certDir is prefixed with "embedded=", the embedded certs are loaded.
+func LoadTLSConfigFromDir(certDir string, opts CertsDirOptions) (*tls.Config, error) {
+	return loadTLSConfigFromDirNamed(certDir, FileNames{}, opts)
+}
+
+// FileNames are the names of the node certificate, node key and CA
+// certificate files in a certs directory. The empty fields default to the
+// standard names: node.crt, node.key and ca.crt.
+type FileNames struct {
+	Cert, Key, CA string
+}
+
+// source returns a CertSource serving the files of src named by n under the
+// standard names.
+func (n FileNames) source(src CertSource) CertSource {
+	names := make(map[string]string, 3)
+	for std, name := range map[string]string{
+		NodeCertFilename(): n.Cert, NodeKeyFilename(): n.Key, CACertFilename(): n.CA,
+	} {
+		if name != "" && name != std {
+			names[std] = name
+		}
+	}
+	if len(names) == 0 {
+		return src
+	}
+	return renamedCertSource{src: src, names: names}
+}
+
+// LoadTLSConfigFromDirNamed is like LoadTLSConfigFromDir, but the node
+// certificate, node key and CA certificate files are named by names, for
+// deployments using other naming conventions. The other files of the certs
+// directory, eg: the intermediate CA certificates, keep their standard names.
+func LoadTLSConfigFromDirNamed(certDir string, names FileNames) (*tls.Config, error) {
+	return loadTLSConfigFromDirNamed(certDir, names, CertsDirOptions{})
+}
+
+// loadTLSConfigFromDirNamed loads the certs directory with the files named by
+// names.
+func loadTLSConfigFromDirNamed(
+	certDir string, names FileNames, opts CertsDirOptions,
+) (*tls.Config, error) {
+	src, err := NewDirCertSource(certDir)
+	if err != nil {
+		return nil, err
+	}
+	return LoadTLSConfigFromDirWithSource(names.source(src), opts)
+}
+
+// LoadTLSConfigFromEnv is like LoadTLSConfigFromDir, with the certs directory
+// named by the environment variable envVar, eg: COCKROACH_CERTS_DIR. The errors
+// name the variable and its value, and tell apart an unset variable and a path
+// which is not a directory from a directory missing some files.
+func LoadTLSConfigFromEnv(envVar string) (*tls.Config, error) {
+	certDir, ok := os.LookupEnv(envVar)
+	if !ok {
+		return nil, errors.Errorf("the certs directory environment variable %s is not set", envVar)
+	}
+	if certDir == "" {
+		return nil, errors.Errorf("the certs directory environment variable %s is empty", envVar)
+	}
+	cfg, err := loadTLSConfigFromEnvDir(certDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load the certs directory %s=%s", envVar, certDir)
+	}
+	return cfg, nil
+}
+
+// loadTLSConfigFromEnvDir checks that certDir is a directory and loads it.
+func loadTLSConfigFromEnvDir(certDir string) (*tls.Config, error) {
+	al, dir, err := resolveAssetPath(certDir)
+	if err != nil {
+		return nil, err
+	}
+	// Directories cannot be stated through the embedded asset loader, but can
+	// be listed.
+	if _, err := al.ReadDir(dir); err != nil {
+		if info, statErr := al.Stat(dir); statErr == nil && !info.IsDir() {
+			return nil, errors.Errorf("%s is not a directory", certDir)
+		}
+		return nil, err
+	}
+	return LoadTLSConfigFromDir(certDir, CertsDirOptions{})
+}
+
+// LoadTLSConfigFromMemory is like LoadTLSConfigFromDir, but the files of the
+// certs directory are passed in, by file name: eg: the node certificate is
+// certs["node.crt"]. Nothing is read from disk or through the asset loader,
+// so tests can build configs without overriding it.
+func LoadTLSConfigFromMemory(certs map[string][]byte) (*tls.Config, error) {
+	return LoadTLSConfigFromDirWithSource(MemoryCertSource(certs), CertsDirOptions{})
+}
+
+// LoadTLSConfigFromDirWithSource is like LoadTLSConfigFromDir, but the files
+// of the certs directory are read from src.
+func LoadTLSConfigFromDirWithSource(src CertSource, opts CertsDirOptions) (*tls.Config, error) {
+	certPath := sourcePath(src, NodeCertFilename())
+	certPEM, err := src.Read(NodeCertFilename())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotEmpty(certPEM, certPath, ErrEmptyCertFile); err != nil {
+		return nil, err
+	}
+	// The CA certificate may be bundled in the node certificate file.
+	caPath := sourcePath(src, CACertFilename())
+	caPEM, err := readCACertFromSource(src, certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotEmpty(caPEM, caPath, ErrEmptyCAFile); err != nil {
+		return nil, err
+	}
+	// Serve the intermediate CA certificates, if any, along with the node
+	// certificate so that peers can build the chain up to their root.
+	intermediatePEM, err := readOptionalFromSource(src, IntermediateCACertFilename())
+	if err != nil {
+		return nil, err
+	}
+	if intermediatePEM != nil {
+		certPEM = append(append(append([]byte(nil), certPEM...), '\n'), intermediatePEM...)
+	}
+	keyPath := sourcePath(src, NodeKeyFilename())
+	keyPEM, err := src.Read(NodeKeyFilename())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotEmpty(keyPEM, keyPath, ErrEmptyCertFile); err != nil {
+		return nil, err
+	}
+	keyPEM, err = decryptPEMPrivateKey(keyPEM, opts.Password)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load node key %s", keyPath)
+	}
+	clientCAPEM, err := readOptionalFromSource(src, "ca-client"+certExtension)
+	if err != nil {
+		return nil, err
+	}
+	if clientCAPEM == nil {
+		clientCAPEM = caPEM
+	}
+
+	cfg, err := newServerTLSConfig(certPEM, keyPEM, caPEM, clientCAPEM, opts.TLSOptions)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.SkipCAVerification {
+		if err := verifyCertificateChain(cfg.Certificates[0], cfg.RootCAs); err != nil {
+			return nil, errors.Wrapf(err, "node certificate %s is not signed by CA %s", certPath, caPath)
+		}
+	}
+
+	staple, err := readOptionalFromSource(src, NodeOCSPStapleFilename())
+	if err != nil {
+		return nil, err
+	}
+	cfg.Certificates[0].OCSPStaple = staple
+
+	ecCert, err := loadNodeECKeyPair(src, intermediatePEM, opts)
+	if err != nil {
+		return nil, err
+	}
+	if ecCert != nil {
+		if !opts.SkipCAVerification {
+			if err := verifyCertificateChain(*ecCert, cfg.RootCAs); err != nil {
+				return nil, errors.Wrapf(err, "ECDSA node certificate %s is not signed by CA %s",
+					sourcePath(src, NodeECCertFilename()), caPath)
+			}
+		}
+		if err := serveECDSACertificate(cfg, *ecCert); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// LoadTLSConfigFromDirContext is like LoadTLSConfigFromDir, but gives up
+// when the context is canceled: reads can block indefinitely on a hung
+// networked filesystem. The reads are performed in a separate goroutine. A
+// read in progress cannot be interrupted: it is left to finish in the
+// background, but no file is read after the cancellation, and the goroutine
+// exits as soon as the read returns.
+func LoadTLSConfigFromDirContext(
+	ctx context.Context, certDir string, opts CertsDirOptions,
+) (*tls.Config, error) {
+	src, err := NewDirCertSource(certDir)
 	if err != nil {
 		return nil, err
 	}
-	keyPEM, err := assetLoaderImpl.ReadFile(sslCertKey)
+	type result struct {
+		cfg *tls.Config
+		err error
+	}
+	// Buffered so that the goroutine can exit after we stopped waiting.
+	resCh := make(chan result, 1)
+	go func() {
+		cfg, err := LoadTLSConfigFromDirWithSource(contextCertSource{ctx: ctx, src: src}, opts)
+		resCh <- result{cfg: cfg, err: err}
+	}()
+	select {
+	case res := <-resCh:
+		return res.cfg, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// The file names used by Kubernetes TLS secrets (of type kubernetes.io/tls),
+// with the CA certificate added by cert-manager and similar tools.
+const (
+	k8sCACertFilename = "ca.crt"
+	k8sCertFilename   = "tls.crt"
+	k8sKeyFilename    = "tls.key"
+)
+
+// LoadTLSConfigFromK8sDir creates a server TLSConfig from a directory laid out
+// like a mounted Kubernetes TLS secret: the node certificate and key are in
+// tls.crt and tls.key, and the CA certificate, used for both server and client
+// certificates, in ca.crt. It is otherwise equivalent to LoadServerTLSConfig.
+func LoadTLSConfigFromK8sDir(certDir string) (*tls.Config, error) {
+	src, err := NewDirCertSource(certDir)
 	if err != nil {
 		return nil, err
 	}
-	caPEM, err := assetLoaderImpl.ReadFile(sslCA)
+	return LoadTLSConfigFromK8sDirWithSource(src)
+}
+
+// LoadTLSConfigFromK8sDirWithSource is like LoadTLSConfigFromK8sDir, but the
+// files of the Kubernetes TLS secret are read from src.
+func LoadTLSConfigFromK8sDirWithSource(src CertSource) (*tls.Config, error) {
+	certPEM, err := src.Read(k8sCertFilename)
 	if err != nil {
 		return nil, err
 	}
-	clientCAPEM, err := assetLoaderImpl.ReadFile(sslClientCA)
+	keyPEM, err := src.Read(k8sKeyFilename)
 	if err != nil {
 		return nil, err
 	}
-	return newServerTLSConfig(certPEM, keyPEM, caPEM, clientCAPEM)
+	caPEM, err := src.Read(k8sCACertFilename)
+	if err != nil {
+		return nil, err
+	}
+	return newServerTLSConfig(certPEM, keyPEM, caPEM, caPEM, TLSOptions{})
+}
+
+// LoadTLSConfigFromDirWithPassword is like LoadTLSConfigFromDir, but decrypts
+// the node key using password if it is encrypted, either in the legacy
+// OpenSSL format or as a PKCS#8 ENCRYPTED PRIVATE KEY using PBES2 with PBKDF2.
+// An *IncorrectKeyPasswordError is returned if the password is incorrect.
+func LoadTLSConfigFromDirWithPassword(certDir, password string) (*tls.Config, error) {
+	return LoadTLSConfigFromDir(certDir, CertsDirOptions{Password: password})
+}
+
+// ValidateTLSConfigDir checks that the certificates in certDir can be loaded
+// to create server and client TLS configs, that the CA and node certificates
+// are currently valid, and that the node certificate is signed by the CA
+// certificate. Unlike the loaders, it does not stop at the first problem: all
+// the problems found are returned, and none if the directory is usable.
+func ValidateTLSConfigDir(certDir string) []error {
+	var errs []error
+	now := timeutil.Now()
+
+	// The CA verification is done below to report it alongside the other
+	// problems.
+	serverConfig, err := LoadTLSConfigFromDir(certDir, CertsDirOptions{SkipCAVerification: true})
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "could not load server TLS config"))
+	}
+	if _, err := LoadClientTLSConfigFromDir(certDir); err != nil {
+		errs = append(errs, errors.Wrap(err, "could not load client TLS config"))
+	}
+
+	caPath := filepath.Join(certDir, CACertFilename())
+	if caPEM, err := readAsset(caPath); err == nil {
+		if caCert, err := parseLeafCertificate(caPEM); err != nil {
+			errs = append(errs, errors.Wrapf(err, "could not parse CA certificate %s", caPath))
+		} else if err := checkCertValidity(caCert, now); err != nil {
+			errs = append(errs, errors.Wrapf(err, "CA certificate %s", caPath))
+		}
+	}
+
+	if serverConfig != nil {
+		certPath := filepath.Join(certDir, NodeCertFilename())
+		nodeCert := serverConfig.Certificates[0]
+		if err := checkCertValidity(nodeCert.Leaf, now); err != nil {
+			errs = append(errs, errors.Wrapf(err, "node certificate %s", certPath))
+		}
+		if err := verifyCertificateChain(nodeCert, serverConfig.RootCAs); err != nil {
+			errs = append(errs, errors.Wrapf(err, "node certificate %s is not signed by CA %s", certPath, caPath))
+		}
+	}
+	return errs
+}
+
+// checkCertValidity returns an error if the certificate is not valid at now.
+func checkCertValidity(cert *x509.Certificate, now time.Time) error {
+	if now.Before(cert.NotBefore) {
+		return errors.Errorf("is not valid before %s", cert.NotBefore)
+	}
+	if now.After(cert.NotAfter) {
+		return errors.Errorf("expired on %s", cert.NotAfter)
+	}
+	return nil
+}
+
+// verifyCertificateChain checks that the leaf of cert chains up to roots,
+// using the rest of cert as intermediates. The hostname and the extended key
+// usages are not checked.
+func verifyCertificateChain(cert tls.Certificate, roots *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// LoadTLSConfigFromPKCS12 creates a server TLSConfig from a PKCS#12 bundle
+// holding the node certificate and key, and the CA certificates. The CA
+// certificates are used both to verify other server certificates and client
+// certificates.
+func LoadTLSConfigFromPKCS12(p12Path, password string) (*tls.Config, error) {
+	p12, err := assetLoaderImpl().ReadFile(p12Path)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, keyPEM, caPEM, err := pkcs12ToPEM(p12, password)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decode PKCS#12 bundle %s", p12Path)
+	}
+	return newServerTLSConfig(certPEM, keyPEM, caPEM, caPEM, TLSOptions{})
+}
+
+// pkcs12ToPEM decodes a PKCS#12 bundle and returns the PEM-encoded leaf
+// certificate, its private key and the remaining (CA) certificates. The leaf
+// is the certificate matching the private key.
+func pkcs12ToPEM(p12 []byte, password string) (certPEM, keyPEM, caPEM []byte, _ error) {
+	blocks, err := pkcs12.ToPEM(p12, password)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var certBlocks []*pem.Block
+	for _, block := range blocks {
+		switch {
+		case block.Type == "CERTIFICATE":
+			certBlocks = append(certBlocks, block)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			if keyPEM != nil {
+				return nil, nil, nil, errors.New("more than one private key found")
+			}
+			keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes})
+		}
+	}
+	if keyPEM == nil {
+		return nil, nil, nil, errors.New("no private key found")
+	}
+
+	for _, block := range certBlocks {
+		// Drop the PKCS#12 bag attributes carried over as PEM headers.
+		encoded := pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes})
+		if certPEM == nil {
+			if _, err := tls.X509KeyPair(encoded, keyPEM); err == nil {
+				certPEM = encoded
+				continue
+			}
+		}
+		caPEM = append(caPEM, encoded...)
+	}
+	if certPEM == nil {
+		return nil, nil, nil, errors.New("no certificate matching the private key found")
+	}
+	if caPEM == nil {
+		return nil, nil, nil, errors.New("no CA certificates found")
+	}
+	return certPEM, keyPEM, caPEM, nil
 }
 
 // newServerTLSConfig creates a server TLSConfig from the supplied byte strings containing
@@ -70,7 +1056,10 @@ func LoadServerTLSConfig(sslCA, sslClientCA, sslCert, sslCertKey string) (*tls.C
 // - the certificate of the client CA, used to verify client certificates
 //
 // caClientPEM can be equal to caPEM (shared CA) or nil (use system CA pool).
-func newServerTLSConfig(certPEM, keyPEM, caPEM, caClientPEM []byte) (*tls.Config, error) {
+// The options are applied last.
+func newServerTLSConfig(
+	certPEM, keyPEM, caPEM, caClientPEM []byte, opts TLSOptions,
+) (*tls.Config, error) {
 	cfg, err := newBaseTLSConfigWithCertificate(certPEM, keyPEM, caPEM)
 	if err != nil {
 		return nil, err
@@ -78,10 +1067,12 @@ func newServerTLSConfig(certPEM, keyPEM, caPEM, caClientPEM []byte) (*tls.Config
 	cfg.ClientAuth = tls.VerifyClientCertIfGiven
 
 	if caClientPEM != nil {
-		certPool := x509.NewCertPool()
-
-		if !certPool.AppendCertsFromPEM(caClientPEM) {
-			return nil, errors.Errorf("failed to parse client CA PEM data to pool")
+		if isEmptyPEM(caClientPEM) {
+			return nil, errors.Mark(errors.New("client CA certificate PEM data is empty"), ErrEmptyCAFile)
+		}
+		certPool, err := certPoolFromPEM(caClientPEM)
+		if err != nil {
+			return nil, errors.Mark(errors.Wrap(err, "failed to parse client CA PEM data to pool"), ErrBadCAPEM)
 		}
 		cfg.ClientCAs = certPool
 	}
@@ -89,8 +1080,15 @@ func newServerTLSConfig(certPEM, keyPEM, caPEM, caClientPEM []byte) (*tls.Config
 	// Use the default cipher suite from golang (RC4 is going away in 1.5).
 	// Prefer the server-specified suite.
 	cfg.PreferServerCipherSuites = true
-	// Should we disable session resumption? This may break forward secrecy.
-	// cfg.SessionTicketsDisabled = true
+	// Session resumption may break forward secrecy. It can be disabled through
+	// TLSOptions.SessionTicketsDisabled.
+
+	if opts.CAPools != nil {
+		opts.CAPools.install(cfg)
+	}
+	if err := opts.apply(cfg); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
@@ -120,22 +1118,262 @@ func newUIServerTLSConfig(certPEM, keyPEM []byte) (*tls.Config, error) {
 // - sslCertKey: path to the client key
 // If the path is prefixed with "embedded=", load the embedded certs.
 func LoadClientTLSConfig(sslCA, sslCert, sslCertKey string) (*tls.Config, error) {
-	certPEM, err := assetLoaderImpl.ReadFile(sslCert)
+	return LoadClientTLSConfigWithOptions(sslCA, sslCert, sslCertKey, ClientTLSOptions{})
+}
+
+// ClientTLSOptions holds optional settings for client TLS configs.
+// The zero value preserves the default settings.
+type ClientTLSOptions struct {
+	// MinVersion is the minimum TLS version accepted by the client. It must be
+	// one of the tls.Version* constants, SSLv3 excluded. If zero, TLS 1.2 is
+	// used.
+	MinVersion uint16
+	// RootCAs, if set, replaces the pool built from the CA certificate passed
+	// to the loader. See NewCertPoolFromFiles.
+	RootCAs *x509.CertPool
+	// CAFilesGlob, if set, is a pattern matching CA certificate files, eg:
+	// "/certs/ca-*.crt", whose certificates replace the pool built from the CA
+	// certificate passed to the loader, unless RootCAs is set. See
+	// LoadCertPoolFromGlob.
+	CAFilesGlob string
+	// CheckExtKeyUsage, if set, requires the client certificate to allow
+	// client authentication through its extended key usage: loading a
+	// certificate without it fails.
+	CheckExtKeyUsage bool
+	// RequireSCT, if set, rejects server certificates without an embedded
+	// signed certificate timestamp, ie: not logged for Certificate
+	// Transparency by their CA. The timestamps themselves are not verified.
+	RequireSCT bool
+	// NotIssuedBefore, if non-zero, rejects the server certificates whose
+	// validity starts (NotBefore) before it. See TLSOptions.NotIssuedBefore.
+	NotIssuedBefore time.Time
+	// Renegotiation is the renegotiation policy of the client, for legacy
+	// servers requesting renegotiation, eg: to ask for a client certificate
+	// for some resources only. By default, renegotiation is refused and the
+	// connection fails.
+	//
+	// Renegotiation makes the identity of the peer change mid-connection,
+	// which has enabled attacks such as the triple handshake, and lets the
+	// server make the client do expensive handshakes: only allow it, and
+	// preferably once, when talking to such servers. There is no server
+	// equivalent: Go servers never renegotiate. Renegotiation is not part of
+	// TLS 1.3.
+	Renegotiation tls.RenegotiationSupport
+}
+
+// apply validates the options and sets them on the passed-in config.
+func (opts ClientTLSOptions) apply(cfg *tls.Config) error {
+	if opts.CAFilesGlob != "" {
+		pool, err := LoadCertPoolFromGlob(opts.CAFilesGlob)
+		if err != nil {
+			return err
+		}
+		cfg.RootCAs = pool.Pool
+	}
+	if opts.RootCAs != nil {
+		cfg.RootCAs = opts.RootCAs
+	}
+	if opts.CheckExtKeyUsage {
+		if err := checkExtKeyUsage(cfg.Certificates[0].Leaf, x509.ExtKeyUsageClientAuth, "clientAuth"); err != nil {
+			return err
+		}
+	}
+	if opts.MinVersion != 0 {
+		if err := validateTLSVersion(opts.MinVersion); err != nil {
+			return err
+		}
+		cfg.MinVersion = opts.MinVersion
+	}
+	if opts.RequireSCT {
+		cfg.VerifyPeerCertificate = chainVerifyPeerCertificate(cfg.VerifyPeerCertificate, verifyEmbeddedSCT)
+	}
+	if !opts.NotIssuedBefore.IsZero() {
+		cfg.VerifyPeerCertificate = chainVerifyPeerCertificate(
+			cfg.VerifyPeerCertificate, verifyNotIssuedBefore(opts.NotIssuedBefore))
+	}
+	switch opts.Renegotiation {
+	case tls.RenegotiateNever, tls.RenegotiateOnceAsClient, tls.RenegotiateFreelyAsClient:
+		cfg.Renegotiation = opts.Renegotiation
+	default:
+		return errors.Errorf("unknown renegotiation policy %d", opts.Renegotiation)
+	}
+	return nil
+}
+
+// LoadClientTLSConfigWithOptions is like LoadClientTLSConfig, but applies the
+// passed-in options on top of the default client settings.
+func LoadClientTLSConfigWithOptions(
+	sslCA, sslCert, sslCertKey string, opts ClientTLSOptions,
+) (*tls.Config, error) {
+	certPEM, err := readAsset(sslCert)
 	if err != nil {
 		return nil, err
 	}
-	keyPEM, err := assetLoaderImpl.ReadFile(sslCertKey)
+	keyPEM, err := readAsset(sslCertKey)
 	if err != nil {
 		return nil, err
 	}
-	caPEM, err := assetLoaderImpl.ReadFile(sslCA)
+	caPEM, err := readAsset(sslCA)
 	if err != nil {
 		return nil, err
 	}
 
+	cfg, err := newClientTLSConfig(certPEM, keyPEM, caPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.apply(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadClientTLSConfigFromDir creates a client TLSConfig from the certificates
+// in certDir, for node-to-node connections: the node certificate and key are
+// used as the client certificate, and the CA certificate to verify servers.
+// As with LoadTLSConfigFromDir, the CA certificates can be bundled in the node
+// certificate file instead. If certDir is prefixed with "embedded=", the embedded certs are loaded.
+func LoadClientTLSConfigFromDir(certDir string) (*tls.Config, error) {
+	src, err := NewDirCertSource(certDir)
+	if err != nil {
+		return nil, err
+	}
+	return LoadClientTLSConfigFromDirWithSource(src)
+}
+
+// LoadClientTLSConfigFromDirWithSource is like LoadClientTLSConfigFromDir, but
+// the files of the certs directory are read from src.
+func LoadClientTLSConfigFromDirWithSource(src CertSource) (*tls.Config, error) {
+	certPEM, err := src.Read(NodeCertFilename())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotEmpty(certPEM, sourcePath(src, NodeCertFilename()), ErrEmptyCertFile); err != nil {
+		return nil, err
+	}
+	keyPEM, err := src.Read(NodeKeyFilename())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotEmpty(keyPEM, sourcePath(src, NodeKeyFilename()), ErrEmptyCertFile); err != nil {
+		return nil, err
+	}
+	caPEM, err := readCACertFromSource(src, certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotEmpty(caPEM, sourcePath(src, CACertFilename()), ErrEmptyCAFile); err != nil {
+		return nil, err
+	}
 	return newClientTLSConfig(certPEM, keyPEM, caPEM)
 }
 
+// LoadClientTLSConfigForHost creates a client TLSConfig from the supplied
+// client certificate, key and CA certificate, which verifies that the server
+// certificate is valid for serverName instead of the dialed address. This is
+// needed when connecting through a proxy or load balancer whose address is not
+// in the server certificate.
+func LoadClientTLSConfigForHost(certPEM, keyPEM, caPEM []byte, serverName string) (*tls.Config, error) {
+	if serverName == "" {
+		return nil, errors.New("server name cannot be empty")
+	}
+	cfg, err := newClientTLSConfig(certPEM, keyPEM, caPEM)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ServerName = serverName
+	return cfg, nil
+}
+
+// LoadSystemClientTLSConfig creates a client TLSConfig presenting the supplied
+// client certificate, which verifies servers against the system trust store
+// instead of the cluster CA. It is meant for outbound connections to external
+// services, eg: webhooks or cloud APIs.
+//
+// If the system pool cannot be loaded, eg: on Windows where it is not exposed,
+// RootCAs is left nil: the tls package then verifies servers against the
+// system roots through the platform APIs.
+func LoadSystemClientTLSConfig(certPEM, keyPEM []byte) (*tls.Config, error) {
+	cfg, err := newClientTLSConfig(certPEM, keyPEM, nil)
+	if err != nil {
+		return nil, err
+	}
+	if pool, err := x509.SystemCertPool(); err == nil {
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// LoadPinnedClientTLSConfig creates a client TLSConfig which does not verify
+// the server certificate against a CA, but requires its SHA-256 fingerprint to
+// be expectedFingerprint, in the format returned by CertFingerprint (compared
+// case insensitively). This is a safer alternative to InsecureSkipVerify when
+// the server certificate is known in advance. No client certificate is set.
+//
+// The digests are compared in constant time, not to leak through timing how
+// much of the fingerprint of a certificate matches.
+func LoadPinnedClientTLSConfig(expectedFingerprint string) *tls.Config {
+	// An invalid fingerprint matches no certificate: the error is reported
+	// when verifying the server certificate.
+	expectedDigest, parseErr := hex.DecodeString(strings.Replace(expectedFingerprint, ":", "", -1))
+	// newBaseTLSConfig cannot fail without a CA certificate.
+	cfg, _ := newBaseTLSConfig(nil)
+	// The chain is not verified, but VerifyPeerCertificate is still called
+	// with the raw certificates.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server did not present a certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return errors.Wrap(err, "failed to parse server certificate")
+		}
+		if parseErr != nil {
+			return errors.Wrapf(parseErr, "invalid expected fingerprint %q", expectedFingerprint)
+		}
+		if digest := sha256.Sum256(cert.Raw); subtle.ConstantTimeCompare(digest[:], expectedDigest) != 1 {
+			return errors.Errorf("server certificate fingerprint %s does not match the expected %s",
+				CertFingerprint(cert), expectedFingerprint)
+		}
+		return nil
+	}
+	return cfg
+}
+
+// CloneWithOverrides returns a copy of base modified by fn, eg: to set the
+// ServerName of a config returned by a loader without loading the files
+// again. Unlike base.Clone, the slices fn is most likely to modify are copied
+// so that modifying them does not affect base: Certificates, NextProtos,
+// CipherSuites and CurvePreferences. The copy of Certificates is shallow: the
+// certificates and keys themselves are shared, and must not be modified.
+//
+// The callbacks of base are kept, but the configs returned by its
+// GetConfigForClient, if any, eg: with the CA pools set by UpdateCAPool, are
+// modified by fn too. fn is then called on the handshakes served such a config,
+// and must be safe for concurrent use.
+func CloneWithOverrides(base *tls.Config, fn func(*tls.Config)) *tls.Config {
+	cfg := base.Clone()
+	cfg.Certificates = append([]tls.Certificate(nil), base.Certificates...)
+	cfg.NextProtos = append([]string(nil), base.NextProtos...)
+	cfg.CipherSuites = append([]uint16(nil), base.CipherSuites...)
+	cfg.CurvePreferences = append([]tls.CurveID(nil), base.CurvePreferences...)
+	if fn == nil {
+		return cfg
+	}
+	if next := cfg.GetConfigForClient; next != nil {
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			served, err := next(hello)
+			if err != nil || served == nil {
+				return served, err
+			}
+			return CloneWithOverrides(served, fn), nil
+		}
+	}
+	fn(cfg)
+	return cfg
+}
+
 // newClientTLSConfig creates a client TLSConfig from the supplied byte strings containing:
 // - the certificate of this client (should be signed by the CA),
 // - the private key of this client.
@@ -144,6 +1382,76 @@ func newClientTLSConfig(certPEM, keyPEM, caPEM []byte) (*tls.Config, error) {
 	return newBaseTLSConfigWithCertificate(certPEM, keyPEM, caPEM)
 }
 
+// NewCertPoolFromFiles returns a pool holding the CA certificates in all the
+// passed-in files, eg: to trust both the old and new CAs while migrating
+// between PKIs. Each file must hold at least one certificate, PEM or
+// DER-encoded. Paths prefixed with "embedded=" are loaded from the embedded
+// certs. The certificates found in several files are only added once.
+func NewCertPoolFromFiles(paths ...string) (*CAPool, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("at least one CA certificate file is required")
+	}
+	b := newCertPoolBuilder()
+	for _, path := range paths {
+		contents, err := readAsset(path)
+		if err != nil {
+			return nil, err
+		}
+		contents = derCertsToPEM(contents)
+		certs, err := PEMContentsToX509(contents)
+		if err != nil {
+			return nil, errors.Mark(makeErrorf(err, "failed to parse CA certificate file %s", path), ErrBadCAPEM)
+		}
+		if len(certs) == 0 {
+			return nil, errors.Mark(errors.Errorf("no certificates found in CA certificate file %s", path), ErrBadCAPEM)
+		}
+		for _, cert := range certs {
+			b.add(cert)
+		}
+	}
+	return b.pool, nil
+}
+
+// LoadCertPoolFromGlob is like NewCertPoolFromFiles, with the files matching
+// pattern, eg: "/certs/ca-*.crt" for a trust bundle split across files. The
+// wildcards are only allowed in the file name, and the files are read through
+// the asset loader: pattern may be prefixed with "embedded=". It is an error
+// for no file to match.
+func LoadCertPoolFromGlob(pattern string) (*CAPool, error) {
+	al, path, err := resolveAssetPath(pattern)
+	if err != nil {
+		return nil, err
+	}
+	dir, glob := filepath.Split(path)
+	if strings.ContainsAny(dir, `*?[\`) {
+		return nil, errors.Errorf("wildcards are only allowed in the file name of %s", pattern)
+	}
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid CA certificate files pattern %s", pattern)
+	}
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := al.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		// The pattern is known to be valid.
+		if matched, _ := filepath.Match(glob, info.Name()); matched {
+			paths = append(paths, strings.TrimSuffix(pattern, glob)+info.Name())
+		}
+	}
+	if len(paths) == 0 {
+		return nil, errors.Errorf("no CA certificate files match %s", pattern)
+	}
+	return NewCertPoolFromFiles(paths...)
+}
+
 // newUIClientTLSConfig creates a client TLSConfig to talk to the Admin UI.
 // It does not include client certificates and takes an optional CA certificate.
 func newUIClientTLSConfig(caPEM []byte) (*tls.Config, error) {
@@ -153,7 +1461,7 @@ func newUIClientTLSConfig(caPEM []byte) (*tls.Config, error) {
 // newBaseTLSConfigWithCertificate returns a tls.Config initialized with the
 // passed-in certificate and optional CA certificate.
 func newBaseTLSConfigWithCertificate(certPEM, keyPEM, caPEM []byte) (*tls.Config, error) {
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	cert, err := loadX509KeyPair(certPEM, keyPEM)
 	if err != nil {
 		return nil, err
 	}
@@ -167,14 +1475,182 @@ func newBaseTLSConfigWithCertificate(certPEM, keyPEM, caPEM []byte) (*tls.Config
 	return cfg, nil
 }
 
+// loadX509KeyPair parses a certificate and key pair. Unlike tls.X509KeyPair,
+// it keeps the parsed leaf around so callers can inspect the certificate (eg:
+// its expiration) without having to parse it again. The certificates may be in
+// any order: see orderCertificateChain.
+func loadX509KeyPair(certPEM, keyPEM []byte) (tls.Certificate, error) {
+	if isEmptyPEM(certPEM) || isEmptyPEM(keyPEM) {
+		return tls.Certificate{}, errors.Mark(
+			errors.New("certificate or key PEM data is empty"), ErrEmptyCertFile)
+	}
+	certBlocks, err := splitPEMBlocks(certPEM)
+	if err != nil {
+		return tls.Certificate{}, errors.Mark(errors.Wrap(err, "invalid certificate PEM data"), ErrBadKeyPair)
+	}
+	keyBlocks, err := splitPEMBlocks(keyPEM)
+	if err != nil {
+		return tls.Certificate{}, errors.Mark(errors.Wrap(err, "invalid private key PEM data"), ErrBadKeyPair)
+	}
+
+	// As in tls.X509KeyPair, other blocks in the certificate data and the
+	// blocks following the private key are ignored.
+	var cert tls.Certificate
+	for _, block := range certBlocks {
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.Mark(
+			errors.New("no CERTIFICATE block found in certificate PEM data"), ErrBadKeyPair)
+	}
+	var keyBlock *pem.Block
+	for _, block := range keyBlocks {
+		if block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY") {
+			keyBlock = block
+			break
+		}
+	}
+	if keyBlock == nil {
+		return tls.Certificate{}, errors.Mark(
+			errors.New("no PRIVATE KEY block found in private key PEM data"), ErrBadKeyPair)
+	}
+
+	cert.PrivateKey, err = parsePrivateKeyBlock(keyBlock)
+	if err != nil {
+		return tls.Certificate{}, errors.Mark(err, ErrBadKeyPair)
+	}
+	cert.Certificate, cert.Leaf, err = orderCertificateChain(cert.Certificate, cert.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, errors.Mark(err, ErrBadKeyPair)
+	}
+	return cert, nil
+}
+
+// orderCertificateChain reorders the DER-encoded certificates so that the one
+// matching the private key, the leaf, is first, followed by its issuer, the
+// issuer of its issuer, and so on, as expected by peers. The certificates that
+// are not part of the chain follow, in their original order. Some issuers
+// ship the leaf after the intermediate certificates, which tls.X509KeyPair
+// rejects.
+//
+// If no certificate matches the key, the mismatch with the first one, or its
+// parsing error, is reported.
+func orderCertificateChain(
+	der [][]byte, key crypto.PrivateKey,
+) (chain [][]byte, leaf *x509.Certificate, _ error) {
+	// The certificates which cannot be parsed are only reported if none
+	// matches, and otherwise kept as is, like the chain of tls.X509KeyPair.
+	certs := make([]*x509.Certificate, len(der))
+	leafIdx := -1
+	var firstErr error
+	for i := range der {
+		cert, err := x509.ParseCertificate(der[i])
+		if err != nil {
+			if i == 0 {
+				firstErr = err
+			}
+			continue
+		}
+		certs[i] = cert
+		if leafIdx < 0 && checkKeyMatchesCert(key, cert) == nil {
+			leafIdx = i
+		}
+	}
+	if leafIdx < 0 {
+		if firstErr != nil {
+			return nil, nil, firstErr
+		}
+		return nil, nil, checkKeyMatchesCert(key, certs[0])
+	}
+
+	used := make([]bool, len(der))
+	used[leafIdx] = true
+	chain = append(make([][]byte, 0, len(der)), der[leafIdx])
+	// Follow the issuers up to a self-signed certificate, or one whose issuer
+	// is missing.
+	for cur := certs[leafIdx]; !bytes.Equal(cur.RawIssuer, cur.RawSubject); {
+		next := -1
+		for i, cert := range certs {
+			if !used[i] && cert != nil && bytes.Equal(cert.RawSubject, cur.RawIssuer) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		used[next] = true
+		chain = append(chain, der[next])
+		cur = certs[next]
+	}
+	for i := range der {
+		if !used[i] {
+			chain = append(chain, der[i])
+		}
+	}
+	return chain, certs[leafIdx], nil
+}
+
+// checkKeyMatchesCert checks that the private key is the one of the public key
+// of the certificate. Unlike tls.X509KeyPair, the error tells apart keys of the
+// wrong algorithm from keys of another pair, and names the certificate.
+func checkKeyMatchesCert(key crypto.PrivateKey, cert *x509.Certificate) error {
+	keyAlgo, err := privateKeyAlgorithm(key)
+	if err != nil {
+		return err
+	}
+	var matches bool
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		priv, ok := key.(*rsa.PrivateKey)
+		matches = ok && pub.E == priv.E && pub.N.Cmp(priv.N) == 0
+	case *ecdsa.PublicKey:
+		priv, ok := key.(*ecdsa.PrivateKey)
+		matches = ok && pub.Curve == priv.Curve && pub.X.Cmp(priv.X) == 0 && pub.Y.Cmp(priv.Y) == 0
+	case ed25519.PublicKey:
+		priv, ok := key.(ed25519.PrivateKey)
+		matches = ok && bytes.Equal(priv.Public().(ed25519.PublicKey), pub)
+	default:
+		return errors.Errorf("unknown public key type %T in certificate %q", pub, cert.Subject.CommonName)
+	}
+	if matches {
+		return nil
+	}
+	if certAlgo := cert.PublicKeyAlgorithm.String(); certAlgo != keyAlgo {
+		return errors.Errorf("private key is %s, but the public key of certificate %q is %s",
+			keyAlgo, cert.Subject.CommonName, certAlgo)
+	}
+	return errors.Errorf("private key does not match the public key of certificate %q (serial %s)",
+		cert.Subject.CommonName, CertSerial(cert))
+}
+
+// isEmptyPEM returns true if contents only hold whitespace.
+func isEmptyPEM(contents []byte) bool {
+	return len(bytes.TrimSpace(contents)) == 0
+}
+
+// checkNotEmpty returns an error marked with sentinel if contents, read from
+// path, only hold whitespace. It is used by the certs directory loaders to
+// report the empty file before its contents get concatenated or decoded.
+func checkNotEmpty(contents []byte, path string, sentinel error) error {
+	if isEmptyPEM(contents) {
+		return errors.Mark(errors.Errorf("%s is empty", path), sentinel)
+	}
+	return nil
+}
+
 // newBaseTLSConfig returns a tls.Config. If caPEM != nil, it is set in RootCAs.
 func newBaseTLSConfig(caPEM []byte) (*tls.Config, error) {
 	var certPool *x509.CertPool
 	if caPEM != nil {
-		certPool = x509.NewCertPool()
-
-		if !certPool.AppendCertsFromPEM(caPEM) {
-			return nil, errors.Errorf("failed to parse PEM data to pool")
+		if isEmptyPEM(caPEM) {
+			return nil, errors.Mark(errors.New("CA certificate PEM data is empty"), ErrEmptyCAFile)
+		}
+		var err error
+		if certPool, err = certPoolFromPEM(caPEM); err != nil {
+			return nil, errors.Mark(errors.Wrap(err, "failed to parse PEM data to pool"), ErrBadCAPEM)
 		}
 	}
 
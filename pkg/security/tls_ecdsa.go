@@ -0,0 +1,203 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
+
+	"github.com/cockroachdb/errors"
+)
+
+// ecdsaCipherSuites are the TLS 1.0-1.2 cipher suites usable with an ECDSA
+// certificate.
+var ecdsaCipherSuites = map[uint16]bool{
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: true,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  true,
+}
+
+// loadNodeECKeyPair loads the ECDSA node certificate and key from src,
+// appending intermediatePEM to the certificate chain. It returns nil if
+// neither is present.
+func loadNodeECKeyPair(
+	src CertSource, intermediatePEM []byte, opts CertsDirOptions,
+) (*tls.Certificate, error) {
+	certPath := sourcePath(src, NodeECCertFilename())
+	keyPath := sourcePath(src, NodeECKeyFilename())
+	certPEM, err := readOptionalFromSource(src, NodeECCertFilename())
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readOptionalFromSource(src, NodeECKeyFilename())
+	if err != nil {
+		return nil, err
+	}
+	if certPEM == nil && keyPEM == nil {
+		return nil, nil
+	}
+	if certPEM == nil || keyPEM == nil {
+		return nil, errors.Errorf("ECDSA node certificate %s and key %s must be both present or both absent",
+			certPath, keyPath)
+	}
+	if err := checkNotEmpty(certPEM, certPath, ErrEmptyCertFile); err != nil {
+		return nil, err
+	}
+	if err := checkNotEmpty(keyPEM, keyPath, ErrEmptyCertFile); err != nil {
+		return nil, err
+	}
+
+	if intermediatePEM != nil {
+		certPEM = append(append(append([]byte(nil), certPEM...), '\n'), intermediatePEM...)
+	}
+	keyPEM, err = decryptPEMPrivateKey(keyPEM, opts.Password)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load ECDSA node key %s", keyPath)
+	}
+	cert, err := loadX509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load ECDSA node certificate %s", certPath)
+	}
+	if _, ok := cert.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		return nil, errors.Errorf("ECDSA node key %s is a %T, not an ECDSA key", keyPath, cert.PrivateKey)
+	}
+	if err := opts.checkCertificate(&cert); err != nil {
+		return nil, errors.Wrapf(err, "invalid ECDSA node certificate %s", certPath)
+	}
+	return &cert, nil
+}
+
+// serveECDSACertificate appends ecCert to the certificates of cfg, and sets up
+// cfg to present it to the clients supporting it.
+//
+// The tls package only picks a certificate other than the first one by server
+// name, so the client is checked in GetConfigForClient, which returns a copy
+// of the config otherwise served with its ECDSA certificate first. The copy is
+// made on each handshake so that later changes, such as new session ticket
+// keys or CA pools, are picked up. Configs without an ECDSA certificate, eg:
+// returned by a TLSOptions.GetConfigForClient callback, are served unchanged.
+func serveECDSACertificate(cfg *tls.Config, ecCert tls.Certificate) error {
+	curve, err := curveForKey(ecCert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+
+	cfg.Certificates = append(cfg.Certificates, ecCert)
+	next := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		base := cfg
+		var served *tls.Config
+		if next != nil {
+			var err error
+			if served, err = next(hello); err != nil {
+				return nil, err
+			}
+			if served != nil {
+				base = served
+			}
+		}
+		ecIdx := ecdsaCertificateIndex(base.Certificates)
+		if ecIdx < 0 || !clientSupportsECDSA(hello, base, curve) {
+			return served, nil
+		}
+		ecConfig := base.Clone()
+		ecConfig.GetConfigForClient = nil
+		ecConfig.Certificates = append(
+			[]tls.Certificate{base.Certificates[ecIdx]}, base.Certificates[:ecIdx]...)
+		ecConfig.Certificates = append(ecConfig.Certificates, base.Certificates[ecIdx+1:]...)
+		return ecConfig, nil
+	}
+	return nil
+}
+
+// ecdsaCertificateIndex returns the index of the first certificate with an
+// ECDSA key in certs, or -1 if there is none.
+func ecdsaCertificateIndex(certs []tls.Certificate) int {
+	for i := range certs {
+		if _, ok := certs[i].PrivateKey.(*ecdsa.PrivateKey); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// curveForKey returns the TLS identifier of the curve of key.
+func curveForKey(key *ecdsa.PrivateKey) (tls.CurveID, error) {
+	switch key.Curve {
+	case elliptic.P256():
+		return tls.CurveP256, nil
+	case elliptic.P384():
+		return tls.CurveP384, nil
+	case elliptic.P521():
+		return tls.CurveP521, nil
+	default:
+		return 0, errors.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+	}
+}
+
+// clientSupportsECDSA returns whether the client sending hello can be served
+// an ECDSA certificate on curve by cfg: it must support the curve and an ECDSA
+// signature scheme and, unless TLS 1.3 can be negotiated, an ECDSA cipher
+// suite allowed by cfg.
+func clientSupportsECDSA(hello *tls.ClientHelloInfo, cfg *tls.Config, curve tls.CurveID) bool {
+	supportsCurve := false
+	for _, c := range hello.SupportedCurves {
+		if c == curve {
+			supportsCurve = true
+			break
+		}
+	}
+	if !supportsCurve {
+		return false
+	}
+
+	// Clients not sending signature schemes at all have no say in it.
+	if len(hello.SignatureSchemes) > 0 {
+		supportsScheme := false
+		for _, s := range hello.SignatureSchemes {
+			switch s {
+			case tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384,
+				tls.ECDSAWithP521AndSHA512, tls.ECDSAWithSHA1:
+				supportsScheme = true
+			}
+		}
+		if !supportsScheme {
+			return false
+		}
+	}
+
+	if cfg.MaxVersion == 0 || cfg.MaxVersion >= tls.VersionTLS13 {
+		for _, v := range hello.SupportedVersions {
+			if v == tls.VersionTLS13 {
+				return true
+			}
+		}
+	}
+	for _, suite := range hello.CipherSuites {
+		if !ecdsaCipherSuites[suite] {
+			continue
+		}
+		if len(cfg.CipherSuites) == 0 {
+			return true
+		}
+		for _, allowed := range cfg.CipherSuites {
+			if allowed == suite {
+				return true
+			}
+		}
+	}
+	return false
+}
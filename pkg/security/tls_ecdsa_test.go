@@ -0,0 +1,196 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestLoadTLSConfigFromDirECDSA(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := generateBaseCerts(certsDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the ECDSA pair, only the node certificate is served.
+	serverConfig, err := security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serverConfig.Certificates) != 1 {
+		t.Fatalf("expected a single certificate, found %d", len(serverConfig.Certificates))
+	}
+
+	caPEM, err := ioutil.ReadFile(filepath.Join(certsDir, security.CACertFilename()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKeyPEM, err := ioutil.ReadFile(filepath.Join(certsDir, security.EmbeddedCAKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecOpts := security.CertOptions{
+		KeyOptions: security.KeyOptions{KeyType: security.ECDSAKey},
+		ValidFor:   48 * time.Hour,
+	}
+	ecCertPEM, ecKeyPEM, err := security.GenerateNodeCertAndKey(
+		caPEM, caKeyPEM, []string{"127.0.0.1"}, ecOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecCertPath := filepath.Join(certsDir, security.NodeECCertFilename())
+	if err := ioutil.WriteFile(ecCertPath, ecCertPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pair must be complete.
+	if _, err := security.LoadTLSConfigFromDir(
+		certsDir, security.CertsDirOptions{},
+	); !testutils.IsError(err, "must be both present or both absent") {
+		t.Fatalf("expected incomplete pair error, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(
+		filepath.Join(certsDir, security.NodeECKeyFilename()), ecKeyPEM, 0600,
+	); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err = security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serverConfig.Certificates) != 2 {
+		t.Fatalf("expected 2 certificates, found %d", len(serverConfig.Certificates))
+	}
+	clientConfig, err := security.LoadClientTLSConfigFromDir(certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name         string
+		maxVersion   uint16
+		cipherSuites []uint16
+		expectECDSA  bool
+	}{
+		{"default", 0, nil, true},
+		{"TLS 1.2", tls.VersionTLS12, nil, true},
+		{"RSA only", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, false},
+		{"ECDSA only", tls.VersionTLS12, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConfig := clientConfig.Clone()
+			clientConfig.MaxVersion = tc.maxVersion
+			clientConfig.CipherSuites = tc.cipherSuites
+			state, err := testHandshake(t, serverConfig, clientConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch key := state.PeerCertificates[0].PublicKey.(type) {
+			case *ecdsa.PublicKey:
+				if !tc.expectECDSA {
+					t.Error("expected the RSA certificate, got the ECDSA one")
+				}
+			case *rsa.PublicKey:
+				if tc.expectECDSA {
+					t.Error("expected the ECDSA certificate, got the RSA one")
+				}
+			default:
+				t.Fatalf("unexpected key type %T", key)
+			}
+		})
+	}
+
+	// Configs without the ECDSA certificate, returned by a GetConfigForClient
+	// callback, are served as is.
+	rsaConfig, err := security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{
+		TLSOptions: security.TLSOptions{
+			GetConfigForClient: func(_ *tls.ClientHelloInfo, base *tls.Config) (*tls.Config, error) {
+				cfg := base.Clone()
+				cfg.Certificates = cfg.Certificates[:1]
+				return cfg, nil
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := testHandshake(t, rsaConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := state.PeerCertificates[0].PublicKey; !isRSAPublicKey(key) {
+		t.Errorf("expected the RSA certificate, got a %T key", key)
+	}
+
+	// The ECDSA pair must be signed by the CA too.
+	otherCAPEM, otherCAKeyPEM := generateTestCA(t)
+	otherCertPEM, otherKeyPEM, err := security.GenerateNodeCertAndKey(
+		otherCAPEM, otherCAKeyPEM, []string{"127.0.0.1"}, ecOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ecCertPath, otherCertPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(certsDir, security.NodeECKeyFilename()), otherKeyPEM, 0600,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := security.LoadTLSConfigFromDir(
+		certsDir, security.CertsDirOptions{},
+	); !testutils.IsError(err, "ECDSA node certificate .* is not signed by CA") {
+		t.Fatalf("expected CA verification error, got %v", err)
+	}
+
+	// The key must be an ECDSA key.
+	for from, to := range map[string]string{
+		security.NodeCertFilename(): security.NodeECCertFilename(),
+		security.NodeKeyFilename():  security.NodeECKeyFilename(),
+	} {
+		contents, err := ioutil.ReadFile(filepath.Join(certsDir, from))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(certsDir, to), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := security.LoadTLSConfigFromDir(
+		certsDir, security.CertsDirOptions{},
+	); !testutils.IsError(err, "not an ECDSA key") {
+		t.Fatalf("expected key type error, got %v", err)
+	}
+}
+
+// isRSAPublicKey returns whether key is an RSA public key.
+func isRSAPublicKey(key interface{}) bool {
+	_, ok := key.(*rsa.PublicKey)
+	return ok
+}
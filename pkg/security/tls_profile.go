@@ -0,0 +1,72 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto/tls"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Profile selects the settings of the server TLS config of a listener, on top
+// of the certificates: see LoadTLSConfigProfile.
+type Profile int
+
+const (
+	// ProfileRPC is the profile of the node-to-node RPC listener: all peers
+	// must present a valid client certificate.
+	ProfileRPC Profile = iota
+	// ProfileSQL is the profile of the SQL listener: clients must present a
+	// valid client certificate.
+	ProfileSQL
+	// ProfileHTTP is the profile of the HTTP listener serving the admin UI:
+	// client certificates are verified if given, but browsers without one are
+	// let through to authenticate otherwise.
+	ProfileHTTP
+)
+
+// String implements the fmt.Stringer interface.
+func (p Profile) String() string {
+	switch p {
+	case ProfileRPC:
+		return "rpc"
+	case ProfileSQL:
+		return "sql"
+	case ProfileHTTP:
+		return "http"
+	default:
+		return "unknown"
+	}
+}
+
+// tlsOptions returns the options implementing the profile.
+func (p Profile) tlsOptions() (TLSOptions, error) {
+	switch p {
+	case ProfileRPC, ProfileSQL:
+		return TLSOptions{MinVersion: tls.VersionTLS12, ClientCertMode: ClientCertRequired}, nil
+	case ProfileHTTP:
+		return TLSOptions{MinVersion: tls.VersionTLS12, ClientCertMode: ClientCertVerifyIfGiven}, nil
+	default:
+		return TLSOptions{}, errors.Errorf("unknown TLS profile %d", p)
+	}
+}
+
+// LoadTLSConfigProfile is like LoadTLSConfigFromDir, with the client
+// certificate policy and minimum TLS version of the profile, so that each
+// listener can be given a config suited to its clients without tuning it after
+// loading.
+func LoadTLSConfigProfile(certDir string, profile Profile) (*tls.Config, error) {
+	opts, err := profile.tlsOptions()
+	if err != nil {
+		return nil, err
+	}
+	return LoadTLSConfigFromDir(certDir, CertsDirOptions{TLSOptions: opts})
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestLoadTLSConfigProfile(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	certDir := "embedded=" + security.EmbeddedCertsDir
+	clientConfig := embeddedClientTLSConfig(t)
+	anonymousConfig := embeddedClientTLSConfig(t)
+	anonymousConfig.Certificates = nil
+
+	testCases := []struct {
+		profile           security.Profile
+		clientAuth        tls.ClientAuthType
+		anonymousAccepted bool
+	}{
+		{security.ProfileRPC, tls.RequireAndVerifyClientCert, false},
+		{security.ProfileSQL, tls.RequireAndVerifyClientCert, false},
+		{security.ProfileHTTP, tls.VerifyClientCertIfGiven, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.profile.String(), func(t *testing.T) {
+			serverConfig, err := security.LoadTLSConfigProfile(certDir, tc.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if serverConfig.ClientAuth != tc.clientAuth {
+				t.Errorf("expected client auth %v, got %v", tc.clientAuth, serverConfig.ClientAuth)
+			}
+			if serverConfig.MinVersion != tls.VersionTLS12 {
+				t.Errorf("expected TLS 1.2 as the minimum version, got 0x%04x", serverConfig.MinVersion)
+			}
+			if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+				t.Fatal(err)
+			}
+			_, err = testHandshake(t, serverConfig, anonymousConfig)
+			if tc.anonymousAccepted && err != nil {
+				t.Fatal(err)
+			} else if !tc.anonymousAccepted && !testutils.IsError(err, "client didn't provide a certificate") {
+				t.Fatalf("expected missing client certificate error, got %v", err)
+			}
+		})
+	}
+
+	if _, err := security.LoadTLSConfigProfile(certDir, security.Profile(42)); !testutils.IsError(
+		err, "unknown TLS profile 42",
+	) {
+		t.Errorf("expected unknown profile error, got %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/errors"
+)
+
+// certReloadPollInterval is the interval at which the node certificate and
+// key modification times are checked.
+const certReloadPollInterval = 10 * time.Second
+
+// ReloadingTLSConfig is a server tls.Config that picks up a new node
+// certificate and key without a restart. It is backed by a CertificateManager:
+// the returned config fetches the latest certificates on each handshake
+// through GetConfigForClient, and a background goroutine reloads the
+// certificates directory whenever the node certificate or key changes on disk.
+// When created by LoadTLSConfigFromVault, it is backed by Vault instead, and
+// the goroutine requests a new certificate before the current one expires.
+type ReloadingTLSConfig struct {
+	cm     *CertificateManager
+	vault  *vaultIssuer
+	config *tls.Config
+
+	stopper  chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu struct {
+		syncutil.Mutex
+		// Modification times of the node certificate and key at the last
+		// successful (re)load.
+		certModTime, keyModTime time.Time
+		// leaf is the node certificate served since the last (re)load.
+		leaf *x509.Certificate
+		// onReload are the callbacks registered with OnReload.
+		onReload []func(old, new *x509.Certificate)
+	}
+}
+
+// NewReloadingTLSConfig loads the certificates in certsDir and starts watching
+// the node certificate and key for changes. Stop must be called to stop the
+// watcher goroutine.
+func NewReloadingTLSConfig(certsDir string) (*ReloadingTLSConfig, error) {
+	r, err := newReloadingTLSConfig(certsDir)
+	if err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+// WatchSignalReload is like NewReloadingTLSConfig, but the certificates are
+// reloaded when the process receives sig (eg: SIGHUP), instead of when the
+// files change. Stop must be called to unregister the signal handler.
+func WatchSignalReload(certsDir string, sig os.Signal) (*ReloadingTLSConfig, error) {
+	r, err := newReloadingTLSConfig(certsDir)
+	if err != nil {
+		return nil, err
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, sig)
+	go r.watchSignal(sigCh)
+	return r, nil
+}
+
+// newReloadingTLSConfig loads the certificates in certsDir. No watcher is
+// started.
+func newReloadingTLSConfig(certsDir string) (*ReloadingTLSConfig, error) {
+	cm, err := NewCertificateManager(certsDir)
+	if err != nil {
+		return nil, err
+	}
+	config, err := cm.GetServerTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReloadingTLSConfig{
+		cm:      cm,
+		config:  config,
+		stopper: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	r.mu.certModTime, r.mu.keyModTime, err = r.nodeModTimes()
+	if err != nil {
+		return nil, err
+	}
+	r.mu.leaf = r.currentLeaf()
+	return r, nil
+}
+
+// Config returns the server tls.Config. It always serves the most recently
+// loaded certificates.
+func (r *ReloadingTLSConfig) Config() *tls.Config {
+	return r.config
+}
+
+// Stop stops the watcher goroutine and waits for it to exit. The signal
+// handler, if any, is unregistered. It may be called several times.
+func (r *ReloadingTLSConfig) Stop() {
+	r.stopOnce.Do(func() { close(r.stopper) })
+	<-r.done
+}
+
+// OnReload registers fn to be called whenever a new node certificate is
+// swapped in, with the previously served and the new leaf certificates, eg: to
+// log the serial number of the new certificate. Reloads of an unchanged
+// certificate do not call fn.
+//
+// The callbacks are called in a new goroutine for each change, so that they
+// cannot hold up the reloads: the callbacks for successive changes may run
+// concurrently.
+func (r *ReloadingTLSConfig) OnReload(fn func(old, new *x509.Certificate)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mu.onReload = append(r.mu.onReload, fn)
+}
+
+// currentLeaf returns the node certificate currently served, or nil if it
+// cannot be determined.
+func (r *ReloadingTLSConfig) currentLeaf() *x509.Certificate {
+	if r.vault != nil {
+		r.vault.mu.RLock()
+		defer r.vault.mu.RUnlock()
+		return r.vault.mu.config.Certificates[0].Leaf
+	}
+	nodeCert := r.cm.NodeCert()
+	if nodeCert == nil || len(nodeCert.ParsedCertificates) == 0 {
+		return nil
+	}
+	return nodeCert.ParsedCertificates[0]
+}
+
+// notifyReloadLocked calls the OnReload callbacks if the node certificate
+// served changed since the last call.
+func (r *ReloadingTLSConfig) notifyReloadLocked() {
+	leaf := r.currentLeaf()
+	old := r.mu.leaf
+	if leaf == nil || (old != nil && bytes.Equal(old.Raw, leaf.Raw)) {
+		return
+	}
+	r.mu.leaf = leaf
+	if len(r.mu.onReload) == 0 {
+		return
+	}
+	// Capping the capacity makes OnReload append to a copy of the slice read
+	// by the goroutine.
+	callbacks := r.mu.onReload[:len(r.mu.onReload):len(r.mu.onReload)]
+	go func() {
+		for _, fn := range callbacks {
+			fn(old, leaf)
+		}
+	}()
+}
+
+// renewFromVault requests a new certificate from Vault. r.mu is only held to
+// notify the OnReload callbacks, not during the request.
+func (r *ReloadingTLSConfig) renewFromVault(ctx context.Context) error {
+	if err := r.vault.issue(ctx); err != nil {
+		return err
+	}
+	r.notifyReload()
+	return nil
+}
+
+// notifyReload is notifyReloadLocked, acquiring r.mu.
+func (r *ReloadingTLSConfig) notifyReload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifyReloadLocked()
+}
+
+// MaybeReload reloads the certificates if the node certificate or key were
+// modified since the last successful load. It returns true if the certificates
+// were reloaded.
+//
+// The new certificate and key are checked to form a valid pair before being
+// swapped in: a pair caught in the middle of being rewritten is not loaded,
+// and will be retried on the next call.
+//
+// For configs backed by Vault, a new certificate is requested if it is time
+// to renew the current one. The request is canceled with ctx.
+func (r *ReloadingTLSConfig) MaybeReload(ctx context.Context) (bool, error) {
+	if r.vault != nil {
+		renewed, err := r.vault.maybeRenew(ctx)
+		if renewed {
+			r.notifyReload()
+		}
+		return renewed, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certModTime, keyModTime, err := r.nodeModTimes()
+	if err != nil {
+		return false, err
+	}
+	if certModTime.Equal(r.mu.certModTime) && keyModTime.Equal(r.mu.keyModTime) {
+		return false, nil
+	}
+	if err := r.reloadLocked(certModTime, keyModTime); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Reload reloads the certificates, whether or not they were modified. As for
+// MaybeReload, an invalid certificate and key pair is not swapped in. For
+// configs backed by Vault, a new certificate is requested, as for MaybeReload.
+func (r *ReloadingTLSConfig) Reload(ctx context.Context) error {
+	if r.vault != nil {
+		return r.renewFromVault(ctx)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certModTime, keyModTime, err := r.nodeModTimes()
+	if err != nil {
+		return err
+	}
+	return r.reloadLocked(certModTime, keyModTime)
+}
+
+// reloadLocked reloads the certificates and records the passed-in
+// modification times of the node certificate and key. The node certificate
+// and key are read once: the pair checked is the pair swapped in.
+func (r *ReloadingTLSConfig) reloadLocked(certModTime, keyModTime time.Time) error {
+	if err := r.cm.loadCertificates(checkNodeKeyPair); err != nil {
+		return err
+	}
+	r.mu.certModTime, r.mu.keyModTime = certModTime, keyModTime
+	r.notifyReloadLocked()
+	return nil
+}
+
+// nodeModTimes returns the modification times of the node certificate and key.
+func (r *ReloadingTLSConfig) nodeModTimes() (certModTime, keyModTime time.Time, _ error) {
+	certInfo, err := assetLoaderImpl().Stat(r.cm.NodeCertPath())
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Errorf("could not stat node certificate: %v", err)
+	}
+	keyInfo, err := assetLoaderImpl().Stat(r.cm.NodeKeyPath())
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Errorf("could not stat node key: %v", err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// watch calls MaybeReload periodically until the config is stopped.
+func (r *ReloadingTLSConfig) watch() {
+	defer close(r.done)
+	ticker := time.NewTicker(certReloadPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopper:
+			return
+		case <-ticker.C:
+			if reloaded, err := r.MaybeReload(context.Background()); err != nil {
+				log.Warningf(context.Background(), "could not reload certificates: %v", err)
+			} else if reloaded {
+				log.Info(context.Background(), "successfully reloaded certificates")
+			}
+		}
+	}
+}
+
+// watchSignal reloads the certificates whenever a signal is received on sigCh,
+// until the config is stopped.
+func (r *ReloadingTLSConfig) watchSignal(sigCh chan os.Signal) {
+	defer close(r.done)
+	defer signal.Stop(sigCh)
+	for {
+		select {
+		case <-r.stopper:
+			return
+		case sig := <-sigCh:
+			log.Infof(context.Background(), "received signal %q, triggering certificate reload", sig)
+			if err := r.Reload(context.Background()); err != nil {
+				log.Warningf(context.Background(), "could not reload certificates: %v", err)
+			} else {
+				log.Info(context.Background(), "successfully reloaded certificates")
+			}
+		}
+	}
+}
+
+// checkNodeKeyPair returns an error if the loaded node certificate and key do
+// not form a valid pair. The pair is parsed as by the loaders, so that the
+// pairs they accept are reloaded too.
+func checkNodeKeyPair(nodeCert *CertInfo) error {
+	if nodeCert == nil {
+		return errors.Errorf("no node certificate found")
+	}
+	if nodeCert.Error != nil {
+		return makeErrorf(nodeCert.Error, "invalid node certificate %s", nodeCert.Filename)
+	}
+	if _, err := loadX509KeyPair(nodeCert.FileContents, nodeCert.KeyFileContents); err != nil {
+		return errors.Mark(makeErrorf(err, "invalid certificate %s and key %s",
+			nodeCert.Filename, nodeCert.KeyFilename), ErrBadKeyPair)
+	}
+	return nil
+}
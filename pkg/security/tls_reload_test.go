@@ -0,0 +1,206 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// servedSerial returns the serial number of the certificate served by config.
+func servedSerial(t *testing.T, config *tls.Config) *big.Int {
+	t.Helper()
+	cfg, err := config.GetConfigForClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Certificates[0].Leaf.SerialNumber
+}
+
+// touch bumps the modification time of the file. Rewritten files may
+// otherwise keep the same modification time on filesystems with a coarse
+// timestamp granularity.
+func touch(t *testing.T, path string, offset time.Duration) {
+	t.Helper()
+	ts := timeutil.Now().Add(offset)
+	if err := os.Chtimes(path, ts, ts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadingTLSConfig(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := generateBaseCerts(certsDir); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := security.NewReloadingTLSConfig(certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	initialSerial := servedSerial(t, r.Config())
+	if reloaded, err := r.MaybeReload(context.Background()); err != nil || reloaded {
+		t.Fatalf("expected no reload, got %t, %v", reloaded, err)
+	}
+
+	// Generate a new node certificate.
+	if err := security.CreateNodePair(
+		certsDir, filepath.Join(certsDir, security.EmbeddedCAKey),
+		testKeySize, time.Hour*48, true, []string{"127.0.0.1"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	nodeCertPath := filepath.Join(certsDir, security.NodeCertFilename())
+	nodeKeyPath := filepath.Join(certsDir, security.NodeKeyFilename())
+	touch(t, nodeCertPath, time.Minute)
+	touch(t, nodeKeyPath, time.Minute)
+
+	if reloaded, err := r.MaybeReload(context.Background()); err != nil || !reloaded {
+		t.Fatalf("expected reload, got %t, %v", reloaded, err)
+	}
+	newSerial := servedSerial(t, r.Config())
+	if newSerial.Cmp(initialSerial) == 0 {
+		t.Fatal("expected a new node certificate to be served")
+	}
+
+	// Node certificates preceded by their issuer are reloaded, as they are
+	// loaded. With a node client certificate, the first certificate of the
+	// file is not checked to be a client certificate.
+	if err := security.CreateClientPair(
+		certsDir, filepath.Join(certsDir, security.EmbeddedCAKey),
+		testKeySize, time.Hour*48, true, security.NodeUser, false,
+	); err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := ioutil.ReadFile(filepath.Join(certsDir, security.CACertFilename()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodePEM, err := ioutil.ReadFile(nodeCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(nodeCertPath, append(caPEM, nodePEM...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, nodeCertPath, 90*time.Second)
+	if reloaded, err := r.MaybeReload(context.Background()); err != nil || !reloaded {
+		t.Fatalf("expected reload, got %t, %v", reloaded, err)
+	}
+	if servedSerial(t, r.Config()).Cmp(newSerial) != 0 {
+		t.Fatal("expected the reordered node certificate to be served")
+	}
+
+	// Replace the node key with one that does not match the certificate:
+	// the bad pair must not be swapped in.
+	rootKey, err := ioutil.ReadFile(filepath.Join(certsDir, security.ClientKeyFilename(security.RootUser)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(nodeKeyPath, rootKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, nodeKeyPath, 2*time.Minute)
+
+	if reloaded, err := r.MaybeReload(context.Background()); !errors.Is(err, security.ErrBadKeyPair) || reloaded {
+		t.Fatalf("expected failed reload, got %t, %v", reloaded, err)
+	}
+	if servedSerial(t, r.Config()).Cmp(newSerial) != 0 {
+		t.Fatal("expected the previous node certificate to still be served")
+	}
+
+	// Stop may be called several times, including by the deferred call.
+	r.Stop()
+	r.Stop()
+}
+
+func TestReloadingTLSConfigOnReload(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := generateBaseCerts(certsDir); err != nil {
+		t.Fatal(err)
+	}
+	r, err := security.NewReloadingTLSConfig(certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	type change struct{ old, new *big.Int }
+	changes := make(chan change, 10)
+	release := make(chan struct{})
+	defer close(release)
+	r.OnReload(func(old, new *x509.Certificate) {
+		changes <- change{old.SerialNumber, new.SerialNumber}
+		// A blocked callback does not hold up the following reloads.
+		<-release
+	})
+
+	rotate := func(offset time.Duration) *big.Int {
+		if err := security.CreateNodePair(
+			certsDir, filepath.Join(certsDir, security.EmbeddedCAKey),
+			testKeySize, time.Hour*48, true, []string{"127.0.0.1"},
+		); err != nil {
+			t.Fatal(err)
+		}
+		touch(t, filepath.Join(certsDir, security.NodeCertFilename()), offset)
+		touch(t, filepath.Join(certsDir, security.NodeKeyFilename()), offset)
+		if reloaded, err := r.MaybeReload(context.Background()); err != nil || !reloaded {
+			t.Fatalf("expected reload, got %t, %v", reloaded, err)
+		}
+		return servedSerial(t, r.Config())
+	}
+	expectChange := func(old, new *big.Int) {
+		select {
+		case c := <-changes:
+			if c.old.Cmp(old) != 0 || c.new.Cmp(new) != 0 {
+				t.Errorf("expected change from %s to %s, got %s to %s", old, new, c.old, c.new)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the OnReload callback")
+		}
+	}
+
+	// Reloading the same certificate does not call the callback.
+	initialSerial := servedSerial(t, r.Config())
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	serial := rotate(time.Minute)
+	expectChange(initialSerial, serial)
+	newSerial := rotate(2 * time.Minute)
+	expectChange(serial, newSerial)
+}
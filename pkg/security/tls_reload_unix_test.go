@@ -0,0 +1,81 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+// +build !windows
+
+package security_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+	"golang.org/x/sys/unix"
+)
+
+func TestWatchSignalReload(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := generateBaseCerts(certsDir); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := security.WatchSignalReload(certsDir, unix.SIGHUP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	initialSerial := servedSerial(t, r.Config())
+
+	// Generate a new node certificate. The modification times are left
+	// untouched: the reload is triggered by the signal alone.
+	if err := security.CreateNodePair(
+		certsDir, filepath.Join(certsDir, security.EmbeddedCAKey),
+		testKeySize, time.Hour*48, true, []string{"127.0.0.1"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Kill(unix.Getpid(), unix.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	testutils.SucceedsSoon(t, func() error {
+		if servedSerial(t, r.Config()).Cmp(initialSerial) == 0 {
+			return errors.New("node certificate not reloaded yet")
+		}
+		return nil
+	})
+	newSerial := servedSerial(t, r.Config())
+
+	// A bad reload keeps the previous certificate.
+	rootKey, err := ioutil.ReadFile(filepath.Join(certsDir, security.ClientKeyFilename(security.RootUser)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(certsDir, security.NodeKeyFilename()), rootKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(context.Background()); err == nil {
+		t.Fatal("expected failed reload")
+	}
+	if servedSerial(t, r.Config()).Cmp(newSerial) != 0 {
+		t.Fatal("expected the previous node certificate to still be served")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/errors"
+)
+
+// BackoffConfig configures the delays between the attempts of
+// LoadTLSConfigFromDirWithRetry. Zero fields use the defaults of the retry
+// package.
+type BackoffConfig struct {
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum delay between retries.
+	MaxBackoff time.Duration
+	// Multiplier is the factor the delay grows by after each retry.
+	Multiplier float64
+}
+
+// IsTransientCertError returns true if err, returned by a loader, may go away
+// by itself: the certificate files are missing or empty, eg: because the
+// secret holding them is not mounted or populated yet. Other errors, eg:
+// malformed certificates, are permanent.
+func IsTransientCertError(err error) bool {
+	return os.IsNotExist(errors.UnwrapAll(err)) ||
+		errors.Is(err, ErrEmptyCAFile) || errors.Is(err, ErrEmptyCertFile)
+}
+
+// LoadTLSConfigFromDirWithRetry is like LoadTLSConfigFromDir, but retries with
+// backoff while the error is transient (see IsTransientCertError), until the
+// context is canceled. This lets nodes start before their certificate files
+// show up. Permanent errors are returned right away.
+func LoadTLSConfigFromDirWithRetry(
+	ctx context.Context, certDir string, backoff BackoffConfig,
+) (*tls.Config, error) {
+	opts := retry.Options{
+		InitialBackoff: backoff.InitialBackoff,
+		MaxBackoff:     backoff.MaxBackoff,
+		Multiplier:     backoff.Multiplier,
+	}
+	var err error
+	for r := retry.StartWithCtx(ctx, opts); r.Next(); {
+		var cfg *tls.Config
+		cfg, err = LoadTLSConfigFromDir(certDir, CertsDirOptions{})
+		if err == nil || !IsTransientCertError(err) {
+			return cfg, err
+		}
+		log.Infof(ctx, "certificates in %s are not ready yet: %v", certDir, err)
+	}
+	if err == nil {
+		return nil, ctx.Err()
+	}
+	return nil, errors.Wrapf(err, "gave up waiting for the certificates in %s", certDir)
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/security/securitytest"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+)
+
+func TestIsTransientCertError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testCases := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{errors.Wrap(&os.PathError{Op: "open", Path: "ca.crt", Err: os.ErrNotExist}, "loading"), true},
+		{errors.Mark(errors.New("ca.crt is empty"), security.ErrEmptyCAFile), true},
+		{errors.Mark(errors.New("node.crt is empty"), security.ErrEmptyCertFile), true},
+		{errors.Mark(errors.New("bad"), security.ErrBadCAPEM), false},
+		{errors.Mark(errors.New("bad"), security.ErrBadKeyPair), false},
+		{os.ErrPermission, false},
+	}
+	for i, tc := range testCases {
+		if transient := security.IsTransientCertError(tc.err); transient != tc.transient {
+			t.Errorf("#%d: expected %t for %v, got %t", i, tc.transient, tc.err, transient)
+		}
+	}
+}
+
+func TestLoadTLSConfigFromDirWithRetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	clientConfig := embeddedClientTLSConfig(t)
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	// writeFile atomically writes a file in certsDir, so that it is never read
+	// partially written.
+	writeFile := func(name string, contents []byte) {
+		tmpPath := filepath.Join(certsDir, "."+name+".tmp")
+		if err := ioutil.WriteFile(tmpPath, contents, 0600); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := os.Rename(tmpPath, filepath.Join(certsDir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	assets := make(map[string][]byte)
+	for _, name := range []string{security.EmbeddedCACert, security.EmbeddedNodeCert, security.EmbeddedNodeKey} {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assets[name] = contents
+	}
+	backoff := security.BackoffConfig{InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	// Retries are given up on when the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := security.LoadTLSConfigFromDirWithRetry(ctx, certsDir, backoff)
+	if !security.IsTransientCertError(err) {
+		t.Fatalf("expected a missing file error, got %v", err)
+	}
+
+	// The files show up while retrying, the CA certificate being empty at
+	// first.
+	writeFile(security.CACertFilename(), nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(20 * time.Millisecond)
+		writeFile(security.NodeCertFilename(), assets[security.EmbeddedNodeCert])
+		writeFile(security.NodeKeyFilename(), assets[security.EmbeddedNodeKey])
+		time.Sleep(20 * time.Millisecond)
+		writeFile(security.CACertFilename(), assets[security.EmbeddedCACert])
+	}()
+	serverConfig, err := security.LoadTLSConfigFromDirWithRetry(context.Background(), certsDir, backoff)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// Permanent errors are not retried.
+	writeFile(security.CACertFilename(), []byte("garbage"))
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := security.LoadTLSConfigFromDirWithRetry(
+		ctx, certsDir, backoff,
+	); !errors.Is(err, security.ErrBadCAPEM) {
+		t.Fatalf("expected ErrBadCAPEM, got %v", err)
+	}
+}
@@ -11,12 +11,34 @@
 package security_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/security/securitytest"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadTLSConfig(t *testing.T) {
@@ -41,6 +63,10 @@ func TestLoadTLSConfig(t *testing.T) {
 		t.Fatalf("Couldn't parse test cert: %v", err)
 	}
 
+	if cert.Leaf == nil || !cert.Leaf.Equal(x509Cert) {
+		t.Errorf("expected parsed leaf certificate %v, got %v", x509Cert.Subject, cert.Leaf)
+	}
+
 	if err = verifyX509Cert(x509Cert, "localhost", config.RootCAs); err != nil {
 		t.Errorf("Couldn't verify test cert against server CA: %v", err)
 	}
@@ -66,3 +92,2649 @@ func verifyX509Cert(cert *x509.Certificate, dnsName string, roots *x509.CertPool
 	_, err := cert.Verify(verifyOptions)
 	return err
 }
+
+func TestLoadTLSConfigWithOptions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	load := func(opts security.TLSOptions) (*tls.Config, error) {
+		return security.LoadServerTLSConfigWithOptions(
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeCert),
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeKey),
+			opts)
+	}
+
+	testCases := []struct {
+		minVersion uint16
+		expected   uint16
+		errStr     string
+	}{
+		{0, tls.VersionTLS12, ""},
+		{tls.VersionTLS10, tls.VersionTLS10, ""},
+		{tls.VersionTLS13, tls.VersionTLS13, ""},
+		{tls.VersionSSL30, 0, "unknown or unsupported TLS version 0x0300"},
+		{0x1234, 0, "unknown or unsupported TLS version 0x1234"},
+	}
+
+	for i, tc := range testCases {
+		config, err := load(security.TLSOptions{MinVersion: tc.minVersion})
+		if !testutils.IsError(err, tc.errStr) {
+			t.Errorf("#%d: expected error %q, got %v", i, tc.errStr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if config.MinVersion != tc.expected {
+			t.Errorf("#%d: expected MinVersion 0x%04x, got 0x%04x", i, tc.expected, config.MinVersion)
+		}
+	}
+}
+
+// embeddedServerTLSConfig returns a server config using the embedded node
+// certificate and CA, with the passed-in options.
+func TestLoadClientTLSConfigWithOptions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	load := func(opts security.ClientTLSOptions) (*tls.Config, error) {
+		return security.LoadClientTLSConfigWithOptions(
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedRootCert),
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedRootKey),
+			opts)
+	}
+
+	testCases := []struct {
+		minVersion uint16
+		expected   uint16
+		errStr     string
+	}{
+		{0, tls.VersionTLS12, ""},
+		{tls.VersionTLS10, tls.VersionTLS10, ""},
+		{tls.VersionTLS13, tls.VersionTLS13, ""},
+		{tls.VersionSSL30, 0, "unknown or unsupported TLS version 0x0300"},
+		{0x1234, 0, "unknown or unsupported TLS version 0x1234"},
+	}
+
+	for i, tc := range testCases {
+		config, err := load(security.ClientTLSOptions{MinVersion: tc.minVersion})
+		if !testutils.IsError(err, tc.errStr) {
+			t.Errorf("#%d: expected error %q, got %v", i, tc.errStr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if config.MinVersion != tc.expected {
+			t.Errorf("#%d: expected MinVersion 0x%04x, got 0x%04x", i, tc.expected, config.MinVersion)
+		}
+	}
+
+	// The client version is independent of the server one.
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{})
+	serverConfig.MaxVersion = tls.VersionTLS12
+	clientConfig, err := load(security.ClientTLSOptions{MinVersion: tls.VersionTLS13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, clientConfig); err == nil {
+		t.Error("expected handshake with a TLS 1.2 server to fail")
+	}
+
+	// Renegotiation is refused unless configured.
+	for _, renegotiation := range []tls.RenegotiationSupport{
+		tls.RenegotiateNever, tls.RenegotiateOnceAsClient, tls.RenegotiateFreelyAsClient,
+	} {
+		config, err := load(security.ClientTLSOptions{Renegotiation: renegotiation})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Renegotiation != renegotiation {
+			t.Errorf("expected renegotiation policy %d, got %d", renegotiation, config.Renegotiation)
+		}
+	}
+	if _, err := load(security.ClientTLSOptions{Renegotiation: 42}); !testutils.IsError(
+		err, "unknown renegotiation policy 42",
+	) {
+		t.Errorf("expected unknown policy error, got %v", err)
+	}
+}
+
+func embeddedServerTLSConfig(t *testing.T, opts security.TLSOptions) *tls.Config {
+	config, err := security.LoadServerTLSConfigWithOptions(
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeCert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeKey),
+		opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// embeddedClientTLSConfig returns a client config using the embedded root
+// client certificate and CA.
+func embeddedClientTLSConfig(t *testing.T) *tls.Config {
+	config, err := security.LoadClientTLSConfig(
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedRootCert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedRootKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// testHandshake performs a TLS handshake between a server using serverConfig
+// and a client using clientConfig over a local TCP connection. It returns the
+// connection state seen by the client and the first error encountered on
+// either side.
+func testHandshake(
+	t *testing.T, serverConfig, clientConfig *tls.Config,
+) (tls.ConnectionState, error) {
+	state, _, err := testHandshakeStates(t, serverConfig, clientConfig)
+	return state, err
+}
+
+// testHandshakeStates is like testHandshake, but also returns the connection
+// state seen by the server.
+func testHandshakeStates(
+	t *testing.T, serverConfig, clientConfig *tls.Config,
+) (clientState, serverState tls.ConnectionState, _ error) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type serverResult struct {
+		state tls.ConnectionState
+		err   error
+	}
+	serverCh := make(chan serverResult, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverCh <- serverResult{err: err}
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		err = tlsConn.Handshake()
+		serverCh <- serverResult{state: tlsConn.ConnectionState(), err: err}
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		<-serverCh
+		return tls.ConnectionState{}, tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	clientState = conn.ConnectionState()
+	// With TLS 1.3, the client handshake completes before the server has
+	// verified the client certificate: wait for the server result.
+	res := <-serverCh
+	return clientState, res.state, res.err
+}
+
+func TestLoadTLSConfigCipherSuites(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	_, err := security.LoadServerTLSConfigWithOptions(
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeCert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeKey),
+		security.TLSOptions{CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, 0x1234, tls.TLS_AES_128_GCM_SHA256}})
+	if expected := "unknown cipher suites: 0x1234, 0x1301"; !testutils.IsError(err, expected) {
+		t.Fatalf("expected error %q, got %v", expected, err)
+	}
+
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	})
+	if a, e := serverConfig.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}; len(a) != 1 || a[0] != e[0] {
+		t.Fatalf("expected cipher suites %v, got %v", e, a)
+	}
+
+	// Cipher suites are not configurable in TLS 1.3.
+	clientConfig := embeddedClientTLSConfig(t)
+	clientConfig.MaxVersion = tls.VersionTLS12
+
+	state, err := testHandshake(t, serverConfig, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("unexpected cipher suite 0x%04x", state.CipherSuite)
+	}
+
+	clientConfig.CipherSuites = []uint16{tls.TLS_RSA_WITH_RC4_128_SHA}
+	if _, err := testHandshake(t, serverConfig, clientConfig); err == nil {
+		t.Error("expected handshake with RC4-only client to fail")
+	}
+}
+
+func TestLoadTLSConfigFromDirWithPassword(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := generateBaseCerts(certsDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The password is ignored for unencrypted keys.
+	if _, err := security.LoadTLSConfigFromDirWithPassword(certsDir, "ignored"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Encrypt the node key.
+	keyPath := filepath.Join(certsDir, security.NodeKeyFilename())
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	encryptedBlock, err := x509.EncryptPEMBlock(
+		rand.Reader, keyBlock.Type, keyBlock.Bytes, []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(encryptedBlock), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := security.LoadTLSConfigFromDirWithPassword(certsDir, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 {
+		t.Fatalf("config.Certificates should have 1 cert; found %d", len(config.Certificates))
+	}
+
+	for _, password := range []string{"", "wrong"} {
+		_, err := security.LoadTLSConfigFromDirWithPassword(certsDir, password)
+		if pwErr := (*security.IncorrectKeyPasswordError)(nil); !errors.As(err, &pwErr) {
+			t.Errorf("expected an incorrect password error for %q, got %v", password, err)
+		}
+	}
+}
+
+func TestLoadTLSConfigFromDirWithPasswordPKCS8(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	clientConfig := embeddedClientTLSConfig(t)
+	// Do not mock cert access for the server config.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, name := range []string{security.EmbeddedCACert, security.EmbeddedNodeCert} {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(certsDir, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	useKey := func(name string) {
+		keyPEM, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(certsDir, security.NodeKeyFilename()), keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The keys were encrypted by OpenSSL 3, with its default PBES2 settings
+	// and with HMAC-SHA1, the default PBKDF2 pseudorandom function.
+	for _, name := range []string{"node.pbes2.key", "node.pbes2-sha1.key"} {
+		useKey(name)
+		config, err := security.LoadTLSConfigFromDirWithPassword(certsDir, "secret")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := testHandshake(t, config, clientConfig); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, password := range []string{"", "wrong"} {
+			_, err := security.LoadTLSConfigFromDirWithPassword(certsDir, password)
+			if pwErr := (*security.IncorrectKeyPasswordError)(nil); !errors.As(err, &pwErr) {
+				t.Errorf("%s: expected an incorrect password error for %q, got %v", name, password, err)
+			}
+		}
+	}
+
+	useKey("node.scrypt.key")
+	if _, err := security.LoadTLSConfigFromDirWithPassword(certsDir, "secret"); !testutils.IsError(
+		err, "unsupported PBES2 key derivation function 1.3.6.1.4.1.11591.4.11: only PBKDF2 is supported",
+	) {
+		t.Errorf("expected unsupported KDF error, got %v", err)
+	}
+
+	// The iteration count is read from the key file: counts that would take
+	// too long to derive the key are rejected.
+	keyPEM, err := ioutil.ReadFile(filepath.Join("testdata", "node.pbes2.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Data      []byte
+	}
+	var pbes2 struct{ KDF, Cipher pkix.AlgorithmIdentifier }
+	var pbkdf2 struct {
+		Salt           []byte
+		IterationCount int
+		KeyLength      int                      `asn1:"optional"`
+		PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+	}
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &pbes2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(pbes2.KDF.Parameters.FullBytes, &pbkdf2); err != nil {
+		t.Fatal(err)
+	}
+	pbkdf2.IterationCount = 1<<31 - 1
+	marshal := func(val interface{}) []byte {
+		der, err := asn1.Marshal(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	pbes2.KDF.Parameters = asn1.RawValue{FullBytes: marshal(pbkdf2)}
+	info.Algorithm.Parameters = asn1.RawValue{FullBytes: marshal(pbes2)}
+	block.Bytes = marshal(info)
+	if err := ioutil.WriteFile(
+		filepath.Join(certsDir, security.NodeKeyFilename()), pem.EncodeToMemory(block), 0600,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := security.LoadTLSConfigFromDirWithPassword(certsDir, "secret"); !testutils.IsError(
+		err, "PBKDF2 iteration count 2147483647 exceeds the maximum of 10000000",
+	) {
+		t.Errorf("expected iteration count error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigFromPKCS12(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	p12Path := filepath.Join("testdata", "node.p12")
+	config, err := security.LoadTLSConfigFromPKCS12(p12Path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 {
+		t.Fatalf("config.Certificates should have 1 cert; found %d", len(config.Certificates))
+	}
+	if cn := config.Certificates[0].Leaf.Subject.CommonName; cn != security.NodeUser {
+		t.Errorf("expected node certificate, got %q", cn)
+	}
+	if err := verifyX509Cert(config.Certificates[0].Leaf, "localhost", config.RootCAs); err != nil {
+		t.Errorf("Couldn't verify test cert against server CA: %v", err)
+	}
+	if err := verifyX509Cert(config.Certificates[0].Leaf, "localhost", config.ClientCAs); err != nil {
+		t.Errorf("Couldn't verify test cert against client CA: %v", err)
+	}
+
+	if _, err := security.LoadTLSConfigFromPKCS12(p12Path, "wrong"); !testutils.IsError(err, "decryption password incorrect") {
+		t.Errorf("expected incorrect password error, got %v", err)
+	}
+}
+
+func TestExportToPKCS12(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	embeddedCAPEM := readAsset(security.EmbeddedCACert)
+	embeddedPair := security.CertKeyPair{
+		CertPEM: readAsset(security.EmbeddedNodeCert), KeyPEM: readAsset(security.EmbeddedNodeKey),
+	}
+	ecCAPEM, ecCAKeyPEM, err := security.GenerateCACertAndKey(security.CACertOptions{
+		KeyOptions: security.KeyOptions{KeyType: security.ECDSAKey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ecPair security.CertKeyPair
+	ecPair.CertPEM, ecPair.KeyPEM, err = security.GenerateNodeCertAndKey(
+		ecCAPEM, ecCAKeyPEM, []string{"localhost"},
+		security.CertOptions{KeyOptions: security.KeyOptions{KeyType: security.ECDSAKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Do not mock cert access for the rest of this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// The exported bundles round-trip through LoadTLSConfigFromPKCS12.
+	for _, tc := range []struct {
+		name      string
+		pair      security.CertKeyPair
+		caPEM     []byte
+		algorithm x509.PublicKeyAlgorithm
+	}{
+		{"RSA", embeddedPair, embeddedCAPEM, x509.RSA},
+		{"ECDSA", ecPair, ecCAPEM, x509.ECDSA},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p12, err := security.ExportToPKCS12(tc.pair.CertPEM, tc.pair.KeyPEM, tc.caPEM, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			p12Path := filepath.Join(certsDir, tc.name+".p12")
+			if err := ioutil.WriteFile(p12Path, p12, 0600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := security.LoadTLSConfigFromPKCS12(p12Path, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf := config.Certificates[0].Leaf
+			if leaf.Subject.CommonName != security.NodeUser || leaf.PublicKeyAlgorithm != tc.algorithm {
+				t.Errorf("expected %s node certificate, got %s %q",
+					tc.algorithm, leaf.PublicKeyAlgorithm, leaf.Subject.CommonName)
+			}
+			if err := verifyX509Cert(leaf, "localhost", config.RootCAs); err != nil {
+				t.Errorf("Couldn't verify test cert against server CA: %v", err)
+			}
+			if _, err := security.LoadTLSConfigFromPKCS12(p12Path, "wrong"); !testutils.IsError(
+				err, "decryption password incorrect",
+			) {
+				t.Errorf("expected incorrect password error, got %v", err)
+			}
+		})
+	}
+
+	if _, err := security.ExportToPKCS12(
+		embeddedPair.CertPEM, embeddedPair.KeyPEM, nil, "secret",
+	); !testutils.IsError(err, "at least one CA certificate is required") {
+		t.Errorf("expected missing CA error, got %v", err)
+	}
+	if _, err := security.ExportToPKCS12(
+		embeddedPair.CertPEM, ecPair.KeyPEM, embeddedCAPEM, "secret",
+	); !testutils.IsError(err, `private key is ECDSA, but the public key of certificate "node" is RSA`) {
+		t.Errorf("expected key mismatch error, got %v", err)
+	}
+	edCAPEM, edCAKeyPEM, err := security.GenerateCACertAndKey(security.CACertOptions{
+		KeyOptions: security.KeyOptions{KeyType: security.Ed25519Key},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := security.ExportToPKCS12(
+		edCAPEM, edCAKeyPEM, edCAPEM, "secret",
+	); !testutils.IsError(err, "cannot export Ed25519 private keys to PKCS#12") {
+		t.Errorf("expected unsupported key error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigAndCert(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	certPEM := readAsset(security.EmbeddedNodeCert)
+	config, cert, err := security.LoadTLSConfigAndCert(
+		certPEM, readAsset(security.EmbeddedNodeKey), readAsset(security.EmbeddedCACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := security.PEMContentsToX509(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Equal(certs[0]) {
+		t.Errorf("expected node certificate %v, got %v", certs[0].Subject, cert.Subject)
+	}
+	if err := verifyX509Cert(cert, "localhost", config.ClientCAs); err != nil {
+		t.Errorf("Couldn't verify test cert against client CA: %v", err)
+	}
+}
+
+func TestLoadTLSConfigPKCS8Key(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	caPEM, caKeyPEM := generateTestCA(t)
+	generatePKCS8 := func(keyType security.KeyType) (certPEM, keyPEM []byte) {
+		certPEM, keyPEM, err := security.GenerateNodeCertAndKey(caPEM, caKeyPEM, []string{"localhost"},
+			security.CertOptions{KeyOptions: security.KeyOptions{KeyType: keyType, KeySize: testKeySize, AllowWeakKey: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := security.PEMToPrivateKey(keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := security.PrivateKeyToPKCS8(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+
+	// An EC key in a PKCS#8 PRIVATE KEY block is served.
+	certPEM, keyPEM := generatePKCS8(security.ECDSAKey)
+	config, _, err := security.LoadTLSConfigAndCert(certPEM, keyPEM, caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	if _, err := testHandshake(t, config, &tls.Config{RootCAs: roots, ServerName: "localhost"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherECKeyPEM := generatePKCS8(security.ECDSAKey)
+	_, rsaKeyPEM := generatePKCS8(security.RSAKey)
+	testCases := []struct {
+		name          string
+		keyPEM        []byte
+		expectedError string
+	}{
+		{"other key", otherECKeyPEM, `private key does not match the public key of certificate "node"`},
+		{"other algorithm", rsaKeyPEM, `private key is RSA, but the public key of certificate "node" is ECDSA`},
+		{"corrupted key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")}),
+			"invalid PKCS#8 private key"},
+		{"no key", certPEM, "no PRIVATE KEY block found"},
+	}
+	for _, tc := range testCases {
+		_, _, err := security.LoadTLSConfigAndCert(certPEM, tc.keyPEM, caPEM)
+		if !errors.Is(err, security.ErrBadKeyPair) || !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("%s: expected %q, got %v", tc.name, tc.expectedError, err)
+		}
+	}
+}
+
+func TestLoadTLSConfigFromDirVerifiesCA(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := generateBaseCerts(certsDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the CA certificate with an unrelated one.
+	otherDir, otherCleanup := tempDir(t)
+	defer otherCleanup()
+	if err := security.CreateCAPair(
+		otherDir, filepath.Join(otherDir, security.EmbeddedCAKey),
+		testKeySize, time.Hour*96, true, true,
+	); err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := ioutil.ReadFile(filepath.Join(otherDir, security.CACertFilename()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(certsDir, security.CACertFilename()), otherCA, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{})
+	if !testutils.IsError(err, "is not signed by CA") {
+		t.Fatalf("expected CA verification error, got %v", err)
+	}
+	if _, err := security.LoadTLSConfigFromDir(
+		certsDir, security.CertsDirOptions{SkipCAVerification: true},
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadTLSConfigFromDirIntermediateCA(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	generateKey := func() *rsa.PrivateKey {
+		key, err := rsa.GenerateKey(rand.Reader, testKeySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	writeCert := func(name string, der []byte) *x509.Certificate {
+		if err := security.WritePEMToFile(
+			filepath.Join(certsDir, name), 0644, true, &pem.Block{Type: "CERTIFICATE", Bytes: der},
+		); err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	// Build a root CA -> intermediate CA -> node certificate chain.
+	rootKey := generateKey()
+	rootDER, err := security.GenerateCA(rootKey, 96*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCert := writeCert(security.CACertFilename(), rootDER)
+
+	intermediateKey := generateKey()
+	intermediateDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Intermediate CA"},
+		NotBefore:             rootCert.NotBefore,
+		NotAfter:              rootCert.NotAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, rootCert, intermediateKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateCert := writeCert(security.IntermediateCACertFilename(), intermediateDER)
+
+	nodeKey := generateKey()
+	nodeDER, err := security.GenerateServerCert(
+		intermediateCert, intermediateKey, nodeKey.Public(), 48*time.Hour,
+		security.NodeUser, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCert(security.NodeCertFilename(), nodeDER)
+	keyBlock, err := security.PrivateKeyToPEM(nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := security.WritePEMToFile(
+		filepath.Join(certsDir, security.NodeKeyFilename()), 0600, true, keyBlock,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig, err := security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(serverConfig.Certificates[0].Certificate); n != 2 {
+		t.Fatalf("expected the intermediate CA to be served along with the node cert, got %d certs", n)
+	}
+
+	// A client trusting only the root CA can build the chain.
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	state, err := testHandshake(t, serverConfig, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(state.VerifiedChains[0]); n != 3 {
+		t.Errorf("expected a verified chain of 3 certs, got %d", n)
+	}
+}
+
+func TestLoadTLSConfigMisorderedChain(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	generateKey := func() *rsa.PrivateKey {
+		key, err := rsa.GenerateKey(rand.Reader, testKeySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	encode := func(der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+
+	// Build a root CA -> intermediate CA -> node certificate chain.
+	rootKey := generateKey()
+	rootDER, err := security.GenerateCA(rootKey, 96*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCert, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateKey := generateKey()
+	intermediateDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Intermediate CA"},
+		NotBefore:             rootCert.NotBefore,
+		NotAfter:              rootCert.NotAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, rootCert, intermediateKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediateCert, err := x509.ParseCertificate(intermediateDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeKey := generateKey()
+	nodeDER, err := security.GenerateServerCert(
+		intermediateCert, intermediateKey, nodeKey.Public(), 48*time.Hour,
+		security.NodeUser, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, err := security.PrivateKeyToPEM(nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The node certificate file lists the chain in reverse, with no separate
+	// CA certificate file: the CA certificates are taken from it.
+	src := security.MemoryCertSource{
+		security.NodeCertFilename(): bytes.Join(
+			[][]byte{encode(rootDER), encode(intermediateDER), encode(nodeDER)}, nil),
+		security.NodeKeyFilename(): pem.EncodeToMemory(keyBlock),
+	}
+	serverConfig, err := security.LoadTLSConfigFromDirWithSource(src, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := serverConfig.Certificates[0].Certificate
+	if len(served) != 3 || !bytes.Equal(served[0], nodeDER) ||
+		!bytes.Equal(served[1], intermediateDER) || !bytes.Equal(served[2], rootDER) {
+		t.Fatal("expected the node certificate to be served first, followed by its chain")
+	}
+	if !bytes.Equal(serverConfig.Certificates[0].Leaf.Raw, nodeDER) {
+		t.Error("expected the node certificate as the leaf")
+	}
+
+	// A client trusting only the root CA can build the chain.
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	state, err := testHandshake(t, serverConfig, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(state.VerifiedChains[0]); n != 3 {
+		t.Errorf("expected a verified chain of 3 certs, got %d", n)
+	}
+
+	// When no certificate matches the key, the first one is reported.
+	src[security.NodeKeyFilename()] = pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(generateKey()),
+	})
+	if _, err := security.LoadTLSConfigFromDirWithSource(
+		src, security.CertsDirOptions{},
+	); !testutils.IsError(err, `private key does not match the public key of certificate "Cockroach CA"`) {
+		t.Errorf("expected key mismatch error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigFromDirBundledCA(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	caPEM := readAsset(security.EmbeddedCACert)
+	nodePEM := readAsset(security.EmbeddedNodeCert)
+	// The CA certificate is bundled with the node certificate, with no
+	// separate CA certificate file.
+	src := security.MemoryCertSource{
+		security.NodeCertFilename(): append(append(append([]byte(nil), nodePEM...), '\n'), caPEM...),
+		security.NodeKeyFilename():  readAsset(security.EmbeddedNodeKey),
+	}
+
+	serverConfig, err := security.LoadTLSConfigFromDirWithSource(src, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(serverConfig.ClientCAs.Subjects()); n != 1 {
+		t.Errorf("expected the bundled CA certificate in the pool, got %d certificates", n)
+	}
+	nodeClientConfig, err := security.LoadClientTLSConfigFromDirWithSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, clientConfig := range []*tls.Config{embeddedClientTLSConfig(t), nodeClientConfig} {
+		if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without a bundled CA certificate, the missing CA certificate file is
+	// reported.
+	src[security.NodeCertFilename()] = nodePEM
+	if _, err := security.LoadTLSConfigFromDirWithSource(
+		src, security.CertsDirOptions{},
+	); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+	if _, err := security.LoadClientTLSConfigFromDirWithSource(src); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigFromDirSplitCA(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := generateSplitCACerts(certsDir); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := security.LoadTLSConfigFromDir(certsDir, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readCert := func(name string) *x509.Certificate {
+		contents, err := ioutil.ReadFile(filepath.Join(certsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs, err := security.PEMContentsToX509(contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certs[0]
+	}
+	nodeCert := readCert(security.NodeCertFilename())
+	rootCert := readCert(security.ClientCertFilename(security.RootUser))
+
+	// The node certificate is signed by ca.crt, the root client certificate
+	// by ca-client.crt.
+	if err := verifyX509Cert(nodeCert, "", config.RootCAs); err != nil {
+		t.Errorf("Couldn't verify node cert against server CA: %v", err)
+	}
+	if err := verifyX509Cert(nodeCert, "", config.ClientCAs); err == nil {
+		t.Error("unexpectedly verified node cert against client CA")
+	}
+	if err := verifyX509Cert(rootCert, "", config.ClientCAs); err != nil {
+		t.Errorf("Couldn't verify client cert against client CA: %v", err)
+	}
+	if err := verifyX509Cert(rootCert, "", config.RootCAs); err == nil {
+		t.Error("unexpectedly verified client cert against server CA")
+	}
+}
+
+func TestNewServerTLSConfigWithSNI(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	caPEM := readAsset(security.EmbeddedCACert)
+	caCerts, err := security.PEMContentsToX509(caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := security.PEMToPrivateKey(readAsset(security.EmbeddedCAKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Generate a certificate for another server name, signed by the embedded CA.
+	otherKey, err := rsa.GenerateKey(rand.Reader, testKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDER, err := security.GenerateServerCert(
+		caCerts[0], caKey, otherKey.Public(), 48*time.Hour, security.NodeUser, []string{"other.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyBlock, err := security.PrivateKeyToPEM(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig, err := security.NewServerTLSConfigWithSNI(
+		security.CertKeyPair{
+			CertPEM: readAsset(security.EmbeddedNodeCert),
+			KeyPEM:  readAsset(security.EmbeddedNodeKey),
+		},
+		map[string]security.CertKeyPair{
+			"Other.Example": {
+				CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherDER}),
+				KeyPEM:  pem.EncodeToMemory(otherKeyBlock),
+			},
+		},
+		caPEM, caPEM, security.TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		serverName string
+		expected   []string
+	}{
+		{"other.example", []string{"other.example"}},
+		// The embedded node certificate.
+		{"localhost", []string{"localhost", "*.local"}},
+		{"unknown.local", []string{"localhost", "*.local"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.serverName, func(t *testing.T) {
+			clientConfig := embeddedClientTLSConfig(t)
+			clientConfig.ServerName = tc.serverName
+			state, err := testHandshake(t, serverConfig, clientConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			require.Equal(t, tc.expected, state.PeerCertificates[0].DNSNames)
+		})
+	}
+}
+
+func TestLoadTLSConfigCurvePreferences(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	_, err := security.LoadServerTLSConfigWithOptions(
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeCert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeKey),
+		security.TLSOptions{CurvePreferences: []tls.CurveID{tls.CurveP256, 42}})
+	if !testutils.IsError(err, "unknown or unsupported curve 42") {
+		t.Fatalf("expected unknown curve error, got %v", err)
+	}
+
+	if cfg := embeddedServerTLSConfig(t, security.TLSOptions{}); cfg.CurvePreferences != nil {
+		t.Fatalf("expected the default curves, got %v", cfg.CurvePreferences)
+	}
+
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	})
+	clientConfig := embeddedClientTLSConfig(t)
+	clientConfig.CurvePreferences = []tls.CurveID{tls.CurveP384}
+	if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.CurvePreferences = []tls.CurveID{tls.X25519}
+	if _, err := testHandshake(t, serverConfig, clientConfig); err == nil {
+		t.Error("expected handshake with an X25519-only client to fail")
+	}
+}
+
+func TestLoadTLSConfigNextProtos(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{})
+	if serverConfig.NextProtos != nil {
+		t.Fatalf("expected no ALPN protocols by default, got %v", serverConfig.NextProtos)
+	}
+
+	serverConfig = embeddedServerTLSConfig(t, security.TLSOptions{NextProtos: []string{"h2", "postgresql"}})
+	testCases := []struct {
+		clientProtos []string
+		expected     string
+	}{
+		{[]string{"postgresql"}, "postgresql"},
+		// The server preference wins.
+		{[]string{"postgresql", "h2"}, "h2"},
+		{nil, ""},
+	}
+	for i, tc := range testCases {
+		clientConfig := embeddedClientTLSConfig(t)
+		clientConfig.NextProtos = tc.clientProtos
+		state, err := testHandshake(t, serverConfig, clientConfig)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if state.NegotiatedProtocol != tc.expected {
+			t.Errorf("#%d: expected protocol %q, got %q", i, tc.expected, state.NegotiatedProtocol)
+		}
+	}
+}
+
+func TestLoadTLSConfigGetConfigForClient(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var mu sync.Mutex
+	var policy string
+	var remoteAddrs []net.Addr
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo, base *tls.Config) (*tls.Config, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			remoteAddrs = append(remoteAddrs, hello.Conn.RemoteAddr())
+			switch policy {
+			case "require":
+				return security.CloneWithOverrides(base, func(cfg *tls.Config) {
+					cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				}), nil
+			case "reject":
+				return nil, errors.New("connections from outside are not allowed")
+			default:
+				return nil, nil
+			}
+		},
+	})
+	withCert := embeddedClientTLSConfig(t)
+	withoutCert := withCert.Clone()
+	withoutCert.Certificates = nil
+
+	testCases := []struct {
+		policy        string
+		clientConfig  *tls.Config
+		expectedError string
+	}{
+		// The base config is served by default.
+		{"", withCert, ""},
+		{"", withoutCert, ""},
+		{"require", withCert, ""},
+		{"require", withoutCert, "client didn't provide a certificate"},
+		{"reject", withCert, "internal error"},
+	}
+	for i, tc := range testCases {
+		mu.Lock()
+		policy = tc.policy
+		mu.Unlock()
+		_, err := testHandshake(t, serverConfig, tc.clientConfig)
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Errorf("#%d: %v", i, err)
+			}
+		} else if !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("#%d: expected error %q, got %v", i, tc.expectedError, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(remoteAddrs) != len(testCases) {
+		t.Fatalf("expected %d calls, got %d", len(testCases), len(remoteAddrs))
+	}
+	for _, addr := range remoteAddrs {
+		if !addr.(*net.TCPAddr).IP.IsLoopback() {
+			t.Errorf("expected a loopback client address, got %s", addr)
+		}
+	}
+}
+
+func TestLoadTLSConfigVerifyPeerCertificate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{
+		VerifyPeerCertificate: func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(verifiedChains) == 0 {
+				return errors.New("no verified chains")
+			}
+			if cn := verifiedChains[0][0].Subject.CommonName; cn != security.RootUser {
+				return errors.Errorf("user %s is not allowed", cn)
+			}
+			return nil
+		},
+	})
+
+	if _, err := testHandshake(t, serverConfig, embeddedClientTLSConfig(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	testUserConfig, err := security.LoadClientTLSConfig(
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedTestUserCert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedTestUserKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, testUserConfig); !testutils.IsError(err, "user testuser is not allowed") {
+		t.Fatalf("expected the callback to reject testuser, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigMaxPeerCertificates(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	caPEM, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caBlock, _ := pem.Decode(caPEM)
+	// chainConfig returns a client config presenting the root client
+	// certificate followed by the CA certificate, for a total of n
+	// certificates.
+	chainConfig := func(n int) *tls.Config {
+		cfg := embeddedClientTLSConfig(t)
+		cert := cfg.Certificates[0]
+		cert.Certificate = cert.Certificate[:1:1]
+		for len(cert.Certificate) < n {
+			cert.Certificate = append(cert.Certificate, caBlock.Bytes)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		return cfg
+	}
+
+	stats := &security.HandshakeStats{}
+	testCases := []struct {
+		opts          security.TLSOptions
+		numCerts      int
+		expectedError string
+	}{
+		{security.TLSOptions{}, 10, ""},
+		{security.TLSOptions{}, 11, "peer presented 11 certificates, more than the maximum of 10"},
+		{security.TLSOptions{MaxPeerCertificates: 20}, 11, ""},
+		{security.TLSOptions{MaxPeerCertificates: 1}, 2, "more than the maximum of 1"},
+		{security.TLSOptions{HandshakeStats: stats}, 11, "more than the maximum of 10"},
+	}
+	for i, tc := range testCases {
+		serverConfig := embeddedServerTLSConfig(t, tc.opts)
+		_, err := testHandshake(t, serverConfig, chainConfig(tc.numCerts))
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Errorf("#%d: %v", i, err)
+			}
+		} else if !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("#%d: expected error %q, got %v", i, tc.expectedError, err)
+		}
+	}
+	// The over-long chain was rejected before being verified.
+	if n := stats.OtherFailure(); n != 0 {
+		t.Errorf("expected no counted failure, got %d", n)
+	}
+
+	if _, err := security.LoadServerTLSConfigWithOptions(
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeCert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeKey),
+		security.TLSOptions{MaxPeerCertificates: -1},
+	); !testutils.IsError(err, "invalid maximum number of peer certificates -1") {
+		t.Errorf("expected invalid maximum error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigAllowedCommonNames(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	nodeClientConfig, err := security.LoadClientTLSConfigFromDir("embedded=" + security.EmbeddedCertsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootClientConfig := embeddedClientTLSConfig(t)
+
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{
+		AllowedCommonNames: []string{security.NodeUser, "other"},
+	})
+	if _, err := testHandshake(t, serverConfig, nodeClientConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, rootClientConfig); !testutils.IsError(
+		err, `certificate CommonName "root" is not allowed`,
+	) {
+		t.Fatalf("expected root to be rejected, got %v", err)
+	}
+
+	// An empty allowlist accepts any valid certificate.
+	serverConfig = embeddedServerTLSConfig(t, security.TLSOptions{})
+	for _, clientConfig := range []*tls.Config{nodeClientConfig, rootClientConfig} {
+		if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadTLSConfigNotIssuedBefore(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	now := timeutil.Now()
+	cutoff := now.Add(-time.Hour)
+	caPEM, caKeyPEM := generateTestCA(t)
+	certOptions := func(notBefore time.Time) security.CertOptions {
+		return security.CertOptions{
+			KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true},
+			NotBefore:  notBefore,
+			ValidFor:   48 * time.Hour,
+		}
+	}
+	nodePEM, nodeKeyPEM, err := security.GenerateNodeCertAndKey(
+		caPEM, caKeyPEM, []string{"localhost"}, certOptions(now.Add(-time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := func(notBefore time.Time) *tls.Config {
+		certPEM, keyPEM, err := security.GenerateClientCertAndKey(
+			caPEM, caKeyPEM, security.RootUser, certOptions(notBefore))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := security.LoadClientTLSConfigForHost(certPEM, keyPEM, caPEM, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	oldClientConfig, newClientConfig := clientConfig(cutoff.Add(-time.Hour)), clientConfig(cutoff.Add(time.Second))
+
+	// The check is disabled by default.
+	for _, opts := range []security.TLSOptions{{}, {NotIssuedBefore: cutoff}} {
+		serverConfig, err := security.NewServerTLSConfigWithSNI(
+			security.CertKeyPair{CertPEM: nodePEM, KeyPEM: nodeKeyPEM}, nil, caPEM, caPEM, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testHandshake(t, serverConfig, newClientConfig); err != nil {
+			t.Fatal(err)
+		}
+		_, err = testHandshake(t, serverConfig, oldClientConfig)
+		if opts.NotIssuedBefore.IsZero() {
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else if !testutils.IsError(err, `certificate "root" \(serial .*\) was issued on .*, before the cutoff`) {
+			t.Fatalf("expected the old certificate to be rejected, got %v", err)
+		}
+	}
+
+	// Clients check the server certificates.
+	loadClient := func(opts security.ClientTLSOptions) *tls.Config {
+		cfg, err := security.LoadClientTLSConfigWithOptions(
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedRootCert),
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedRootKey),
+			opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{})
+	if _, err := testHandshake(t, serverConfig, loadClient(security.ClientTLSOptions{})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(
+		t, serverConfig, loadClient(security.ClientTLSOptions{NotIssuedBefore: now}),
+	); !testutils.IsError(err, `certificate "node" \(serial .*\) was issued on .*, before the cutoff`) {
+		t.Errorf("expected the embedded node certificate to be rejected, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigMinRSAKeyBits(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	caPEM, caKeyPEM := generateTestCA(t)
+	generatePair := func(keyOpts security.KeyOptions) security.CertKeyPair {
+		certPEM, keyPEM, err := security.GenerateNodeCertAndKey(
+			caPEM, caKeyPEM, []string{"localhost"}, security.CertOptions{KeyOptions: keyOpts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return security.CertKeyPair{CertPEM: certPEM, KeyPEM: keyPEM}
+	}
+	weakPair := generatePair(security.KeyOptions{KeySize: 1024, AllowWeakKey: true})
+	ecdsaPair := generatePair(security.KeyOptions{KeyType: security.ECDSAKey})
+
+	testCases := []struct {
+		pair          security.CertKeyPair
+		sniPair       *security.CertKeyPair
+		minBits       int
+		expectedError string
+	}{
+		// The check is disabled by default.
+		{weakPair, nil, 0, ""},
+		{weakPair, nil, 1024, ""},
+		{weakPair, nil, 2048, "RSA key of 1024 bits is shorter than the minimum of 2048 bits"},
+		{ecdsaPair, nil, 2048, ""},
+		{ecdsaPair, &weakPair, 2048, `invalid certificate for server name "weak": RSA key of 1024 bits`},
+	}
+	for i, tc := range testCases {
+		var pairs map[string]security.CertKeyPair
+		if tc.sniPair != nil {
+			pairs = map[string]security.CertKeyPair{"weak": *tc.sniPair}
+		}
+		_, err := security.NewServerTLSConfigWithSNI(
+			tc.pair, pairs, caPEM, caPEM, security.TLSOptions{MinRSAKeyBits: tc.minBits})
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Errorf("#%d: %v", i, err)
+			}
+		} else if !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("#%d: expected error %q, got %v", i, tc.expectedError, err)
+		}
+	}
+}
+
+func TestLoadSystemClientTLSConfig(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	certPEM, keyPEM := readAsset(security.EmbeddedRootCert), readAsset(security.EmbeddedRootKey)
+
+	clientConfig, err := security.LoadSystemClientTLSConfig(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clientConfig.Certificates) != 1 {
+		t.Fatalf("expected the client certificate, got %d certificates", len(clientConfig.Certificates))
+	}
+	// The cluster CA is not in the system trust store.
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{})
+	if _, err := testHandshake(t, serverConfig, clientConfig); !testutils.IsError(
+		err, "certificate signed by unknown authority",
+	) {
+		t.Fatalf("expected unknown authority error, got %v", err)
+	}
+
+	if _, err := security.LoadSystemClientTLSConfig(
+		certPEM, readAsset(security.EmbeddedNodeKey),
+	); !errors.Is(err, security.ErrBadKeyPair) {
+		t.Fatalf("expected ErrBadKeyPair, got %v", err)
+	}
+}
+
+func TestCloneWithOverrides(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	base := embeddedClientTLSConfig(t)
+	base.NextProtos = []string{"h2"}
+	baseCert := base.Certificates[0]
+	baseSuite := base.CipherSuites[0]
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{})
+
+	// Concurrent clones of a shared config can be modified freely.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			serverName := fmt.Sprintf("node%d.local", i)
+			cfg := security.CloneWithOverrides(base, func(cfg *tls.Config) {
+				cfg.ServerName = serverName
+				cfg.Certificates[0] = tls.Certificate{}
+				cfg.NextProtos[0] = "http/1.1"
+				cfg.CipherSuites[0] = 0
+			})
+			if cfg.ServerName != serverName {
+				t.Errorf("expected server name %s, got %s", serverName, cfg.ServerName)
+			}
+			// Without overrides, the clone works as the base config.
+			cfg = security.CloneWithOverrides(base, nil)
+			cfg.ServerName = serverName
+			if _, err := testHandshake(t, serverConfig, cfg); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if base.ServerName != "" {
+		t.Errorf("expected no server name in the base config, got %s", base.ServerName)
+	}
+	if len(base.Certificates[0].Certificate) != len(baseCert.Certificate) {
+		t.Error("the certificates of the base config were modified")
+	}
+	if base.NextProtos[0] != "h2" {
+		t.Errorf("the protocols of the base config were modified: %v", base.NextProtos)
+	}
+	if base.CipherSuites[0] != baseSuite {
+		t.Errorf("the cipher suites of the base config were modified: %v", base.CipherSuites)
+	}
+}
+
+func TestLoadClientTLSConfigForHost(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	certPEM, keyPEM := readAsset(security.EmbeddedRootCert), readAsset(security.EmbeddedRootKey)
+	caPEM := readAsset(security.EmbeddedCACert)
+
+	if _, err := security.LoadClientTLSConfigForHost(certPEM, keyPEM, caPEM, ""); !testutils.IsError(err, "server name cannot be empty") {
+		t.Fatalf("expected empty server name error, got %v", err)
+	}
+
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{})
+	testCases := []struct {
+		serverName    string
+		expectedError string
+	}{
+		// The embedded node certificate is valid for *.local.
+		{"lb.local", ""},
+		{"lb.example.com", "certificate is valid for"},
+	}
+	for _, tc := range testCases {
+		clientConfig, err := security.LoadClientTLSConfigForHost(certPEM, keyPEM, caPEM, tc.serverName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clientConfig.ServerName != tc.serverName {
+			t.Errorf("expected server name %q, got %q", tc.serverName, clientConfig.ServerName)
+		}
+		_, err = testHandshake(t, serverConfig, clientConfig)
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.serverName, err)
+			}
+		} else if !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("%s: expected error %q, got %v", tc.serverName, tc.expectedError, err)
+		}
+	}
+}
+
+func TestLoadPinnedClientTLSConfig(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	nodeCertPEM, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := security.CertFingerprintFromPEM(nodeCertPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCertPEM, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, security.EmbeddedRootCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherFingerprint, err := security.CertFingerprintFromPEM(rootCertPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastByte := "00"
+	if strings.HasSuffix(fingerprint, lastByte) {
+		lastByte = "01"
+	}
+
+	serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{})
+	testCases := []struct {
+		fingerprint   string
+		expectedError string
+	}{
+		{fingerprint, ""},
+		{strings.ToLower(fingerprint), ""},
+		{otherFingerprint, "server certificate fingerprint " + fingerprint + " does not match"},
+		// A difference in the last byte only is caught.
+		{fingerprint[:len(fingerprint)-2] + lastByte, "does not match the expected"},
+		{fingerprint + ":00", "does not match the expected"},
+		{"", "does not match the expected"},
+		{"not hex", `invalid expected fingerprint "not hex"`},
+	}
+	for i, tc := range testCases {
+		_, err := testHandshake(t, serverConfig, security.LoadPinnedClientTLSConfig(tc.fingerprint))
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Errorf("#%d: %v", i, err)
+			}
+		} else if !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("#%d: expected error %q, got %v", i, tc.expectedError, err)
+		}
+	}
+}
+
+func TestLoadClientTLSConfigRequireSCT(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	caPEM := readAsset(security.EmbeddedCACert)
+	caCert, caKey := parseCertAndKey(t, caPEM, readAsset(security.EmbeddedCAKey))
+
+	// serverConfig returns a config serving a node certificate signed by the
+	// embedded CA, with the passed-in extra extensions.
+	serverConfig := func(extensions []pkix.Extension) *tls.Config {
+		key, err := rsa.GenerateKey(rand.Reader, testKeySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:    big.NewInt(1),
+			Subject:         pkix.Name{CommonName: security.NodeUser},
+			NotBefore:       timeutil.Now().Add(-time.Hour),
+			NotAfter:        timeutil.Now().Add(time.Hour),
+			KeyUsage:        x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			IPAddresses:     []net.IP{net.ParseIP("127.0.0.1")},
+			ExtraExtensions: extensions,
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyBlock, err := security.PrivateKeyToPEM(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := security.LoadTLSConfigAndCert(
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+			pem.EncodeToMemory(keyBlock), caPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	sctExtension := pkix.Extension{
+		Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2},
+		// The contents are not checked.
+		Value: []byte{0x04, 0x00},
+	}
+	withSCT := serverConfig([]pkix.Extension{sctExtension})
+	withoutSCT := serverConfig(nil)
+
+	clientConfig := func(requireSCT bool) *tls.Config {
+		config, err := security.LoadClientTLSConfigWithOptions(
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedRootCert),
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedRootKey),
+			security.ClientTLSOptions{RequireSCT: requireSCT})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	testCases := []struct {
+		name          string
+		serverConfig  *tls.Config
+		requireSCT    bool
+		expectedError string
+	}{
+		{"with SCT", withSCT, true, ""},
+		{"without SCT", withoutSCT, true, `certificate "node" has no embedded signed certificate timestamp`},
+		{"not required", withoutSCT, false, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := testHandshake(t, tc.serverConfig, clientConfig(tc.requireSCT))
+			if tc.expectedError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !testutils.IsError(err, tc.expectedError) {
+				t.Fatalf("expected error %q, got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestNewCertPoolFromFiles(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	oldCAPEM, oldCAKeyPEM := generateTestCA(t)
+	newCAPEM, newCAKeyPEM := generateTestCA(t)
+	oldCAPath := filepath.Join(certsDir, "old-ca.crt")
+	newCAPath := filepath.Join(certsDir, "new-ca.crt")
+	emptyPath := filepath.Join(certsDir, "empty.crt")
+	for path, contents := range map[string][]byte{
+		oldCAPath: oldCAPEM, newCAPath: newCAPEM, emptyPath: nil,
+	} {
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := security.NewCertPoolFromFiles(); !testutils.IsError(err, "at least one CA certificate file is required") {
+		t.Errorf("expected missing files error, got %v", err)
+	}
+	if _, err := security.NewCertPoolFromFiles(oldCAPath, emptyPath); !testutils.IsError(err, "no certificates found in CA certificate file .*empty.crt") {
+		t.Errorf("expected empty file error, got %v", err)
+	}
+	if _, err := security.NewCertPoolFromFiles(filepath.Join(certsDir, "missing.crt")); !os.IsNotExist(errors.UnwrapAll(err)) {
+		t.Errorf("expected missing file error, got %v", err)
+	}
+
+	// The CAs found in several files are only added once, including to the
+	// pools merged from this one.
+	pool, err := security.NewCertPoolFromFiles(oldCAPath, oldCAPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(pool.Pool.Subjects()); n != 1 {
+		t.Errorf("expected 1 CA certificate, got %d", n)
+	}
+	if n := len(security.MergeCertPools(pool, pool).Pool.Subjects()); n != 1 {
+		t.Errorf("expected 1 CA certificate, got %d", n)
+	}
+
+	pool, err = security.NewCertPoolFromFiles(oldCAPath, newCAPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}}
+	nodePEM, nodeKeyPEM, err := security.GenerateNodeCertAndKey(oldCAPEM, oldCAKeyPEM, []string{"localhost"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err := security.NewServerTLSConfigWithSNI(
+		security.CertKeyPair{CertPEM: nodePEM, KeyPEM: nodeKeyPEM}, nil, oldCAPEM, oldCAPEM,
+		security.TLSOptions{ClientCAs: pool.Pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients with certificates signed by either CA are accepted.
+	for _, ca := range []struct{ certPEM, keyPEM []byte }{
+		{oldCAPEM, oldCAKeyPEM}, {newCAPEM, newCAKeyPEM},
+	} {
+		clientPEM, clientKeyPEM, err := security.GenerateClientCertAndKey(ca.certPEM, ca.keyPEM, security.RootUser, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig, _, err := security.LoadTLSConfigAndCert(clientPEM, clientKeyPEM, oldCAPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig.ServerName = "localhost"
+		if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestLoadCertPoolFromGlob(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	ca1PEM, ca1KeyPEM := generateTestCA(t)
+	ca2PEM, ca2KeyPEM := generateTestCA(t)
+	otherPEM, _ := generateTestCA(t)
+	opts := security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}}
+	clientPEM, clientKeyPEM, err := security.GenerateClientCertAndKey(ca2PEM, ca2KeyPEM, security.RootUser, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string][]byte{
+		"ca-1.crt": ca1PEM, "ca-2.crt": ca2PEM, "other.crt": otherPEM,
+		"client.crt": clientPEM, "client.key": clientKeyPEM,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(certsDir, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(certsDir, "ca-dir.crt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	glob := filepath.Join(certsDir, "ca-*.crt")
+
+	pool, err := security.LoadCertPoolFromGlob(glob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(pool.Pool.Subjects()); n != 2 {
+		t.Errorf("expected 2 CA certificates, got %d", n)
+	}
+
+	// The loaders use the pattern through the options.
+	nodePEM, nodeKeyPEM, err := security.GenerateNodeCertAndKey(ca1PEM, ca1KeyPEM, []string{"localhost"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err := security.NewServerTLSConfigWithSNI(
+		security.CertKeyPair{CertPEM: nodePEM, KeyPEM: nodeKeyPEM}, nil, otherPEM, otherPEM,
+		security.TLSOptions{CAFilesGlob: glob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := security.LoadClientTLSConfigWithOptions(
+		filepath.Join(certsDir, "other.crt"), filepath.Join(certsDir, "client.crt"),
+		filepath.Join(certsDir, "client.key"), security.ClientTLSOptions{CAFilesGlob: glob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.ServerName = "localhost"
+	if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first file failing to parse is named.
+	truncatedPEM := ca2PEM[:len(ca2PEM)/2]
+	if err := ioutil.WriteFile(filepath.Join(certsDir, "ca-3.crt"), truncatedPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		pattern       string
+		expectedError string
+	}{
+		{glob, "failed to parse CA certificate file .*ca-3.crt"},
+		{filepath.Join(certsDir, "missing-*.crt"), "no CA certificate files match .*missing-\\*.crt"},
+		{filepath.Join(certsDir, "ca-[.crt"), "invalid CA certificate files pattern"},
+		{filepath.Join(certsDir, "*", "ca.crt"), "wildcards are only allowed in the file name"},
+	}
+	for _, tc := range testCases {
+		if _, err := security.LoadCertPoolFromGlob(tc.pattern); !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("%s: expected %q, got %v", tc.pattern, tc.expectedError, err)
+		}
+	}
+	if _, err := security.NewServerTLSConfigWithSNI(
+		security.CertKeyPair{CertPEM: nodePEM, KeyPEM: nodeKeyPEM}, nil, otherPEM, otherPEM,
+		security.TLSOptions{CAFilesGlob: glob},
+	); !testutils.IsError(err, "failed to parse CA certificate file .*ca-3.crt") {
+		t.Errorf("expected parse error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigErrorKinds(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	caPEM := readAsset(security.EmbeddedCACert)
+	nodePair := security.CertKeyPair{
+		CertPEM: readAsset(security.EmbeddedNodeCert), KeyPEM: readAsset(security.EmbeddedNodeKey),
+	}
+	mismatchedPair := security.CertKeyPair{
+		CertPEM: readAsset(security.EmbeddedNodeCert), KeyPEM: readAsset(security.EmbeddedRootKey),
+	}
+
+	testCases := []struct {
+		name        string
+		pair        security.CertKeyPair
+		caPEM       []byte
+		caClientPEM []byte
+		expected    error
+	}{
+		{"bad CA", nodePair, []byte("garbage"), caPEM, security.ErrBadCAPEM},
+		{"bad client CA", nodePair, caPEM, []byte("garbage"), security.ErrBadCAPEM},
+		{"mismatched key", mismatchedPair, caPEM, caPEM, security.ErrBadKeyPair},
+		{"bad certificate", security.CertKeyPair{CertPEM: []byte("garbage"), KeyPEM: nodePair.KeyPEM},
+			caPEM, caPEM, security.ErrBadKeyPair},
+		{"empty CA", nodePair, []byte(" \n"), caPEM, security.ErrEmptyCAFile},
+		{"empty client CA", nodePair, caPEM, []byte{}, security.ErrEmptyCAFile},
+		{"empty certificate", security.CertKeyPair{CertPEM: []byte("\n"), KeyPEM: nodePair.KeyPEM},
+			caPEM, caPEM, security.ErrEmptyCertFile},
+		{"empty key", security.CertKeyPair{CertPEM: nodePair.CertPEM, KeyPEM: []byte{}},
+			caPEM, caPEM, security.ErrEmptyCertFile},
+	}
+	for _, tc := range testCases {
+		_, err := security.NewServerTLSConfigWithSNI(tc.pair, nil, tc.caPEM, tc.caClientPEM, security.TLSOptions{})
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, err)
+		}
+	}
+
+	// Missing files are not reported as malformed.
+	_, err := security.LoadServerTLSConfig("missing-ca.crt", "missing-ca.crt", "missing.crt", "missing.key")
+	if err == nil || errors.Is(err, security.ErrBadCAPEM) || errors.Is(err, security.ErrBadKeyPair) {
+		t.Errorf("expected a file access error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigDERCA(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	certs := make(security.MemoryCertSource)
+	for _, name := range []string{security.EmbeddedCACert, security.EmbeddedNodeCert, security.EmbeddedNodeKey} {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs[name] = contents
+	}
+	caPEM := certs[security.CACertFilename()]
+	otherCAPEM, _ := generateTestCA(t)
+	toDER := func(certPEM []byte) []byte {
+		block, _ := pem.Decode(certPEM)
+		if block == nil {
+			t.Fatal("no PEM data found")
+		}
+		return block.Bytes
+	}
+
+	testCases := []struct {
+		name               string
+		caPEM, clientCAPEM []byte
+	}{
+		{"PEM", caPEM, append(append(append([]byte(nil), otherCAPEM...), '\n'), caPEM...)},
+		{"DER", toDER(caPEM), append(toDER(otherCAPEM), toDER(caPEM)...)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			src := make(security.MemoryCertSource)
+			for name, contents := range certs {
+				src[name] = contents
+			}
+			src[security.CACertFilename()] = tc.caPEM
+			src["ca-client.crt"] = tc.clientCAPEM
+
+			serverConfig, err := security.LoadTLSConfigFromDirWithSource(src, security.CertsDirOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(serverConfig.ClientCAs.Subjects()); n != 2 {
+				t.Errorf("expected 2 client CA certificates, got %d", n)
+			}
+			clientConfig, err := security.LoadClientTLSConfigFromDirWithSource(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// Data that is neither PEM nor DER is still reported as malformed.
+	src := make(security.MemoryCertSource)
+	for name, contents := range certs {
+		src[name] = contents
+	}
+	src[security.CACertFilename()] = []byte{0x30, 0x03, 0x02, 0x01}
+	if _, err := security.LoadTLSConfigFromDirWithSource(
+		src, security.CertsDirOptions{},
+	); !errors.Is(err, security.ErrBadCAPEM) {
+		t.Errorf("expected ErrBadCAPEM, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigFromDirEmptyFiles(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	certs := make(security.MemoryCertSource)
+	for _, name := range []string{security.EmbeddedCACert, security.EmbeddedNodeCert, security.EmbeddedNodeKey} {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs[name] = contents
+	}
+	intermediatePEM, _ := generateTestCA(t)
+
+	testCases := []struct {
+		name     string
+		expected error
+	}{
+		{security.CACertFilename(), security.ErrEmptyCAFile},
+		{security.NodeCertFilename(), security.ErrEmptyCertFile},
+		{security.NodeKeyFilename(), security.ErrEmptyCertFile},
+	}
+	for _, tc := range testCases {
+		src := make(security.MemoryCertSource)
+		for name, contents := range certs {
+			src[name] = contents
+		}
+		src[tc.name] = []byte("  \n\t\n")
+		// The empty node certificate must not be masked by the intermediate
+		// CA certificates appended to it.
+		src[security.IntermediateCACertFilename()] = intermediatePEM
+
+		_, err := security.LoadTLSConfigFromDirWithSource(src, security.CertsDirOptions{})
+		if !errors.Is(err, tc.expected) || !testutils.IsError(err, tc.name+" is empty") {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, err)
+		}
+		if errors.Is(err, security.ErrBadCAPEM) || errors.Is(err, security.ErrBadKeyPair) {
+			t.Errorf("%s: empty file reported as malformed: %v", tc.name, err)
+		}
+		_, err = security.LoadClientTLSConfigFromDirWithSource(src)
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%s: expected %v from the client loader, got %v", tc.name, tc.expected, err)
+		}
+	}
+}
+
+func TestLoadTLSConfigFromK8sDir(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	clientConfig := embeddedClientTLSConfig(t)
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for src, dst := range map[string]string{
+		security.EmbeddedCACert:   "ca.crt",
+		security.EmbeddedNodeCert: "tls.crt",
+		security.EmbeddedNodeKey:  "tls.key",
+	} {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(certsDir, dst), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverConfig, err := security.LoadTLSConfigFromK8sDir(certsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(certsDir, "tls.key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := security.LoadTLSConfigFromK8sDir(certsDir); !os.IsNotExist(errors.UnwrapAll(err)) {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigFromDirNamed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	clientConfig := embeddedClientTLSConfig(t)
+	// Do not mock cert access for this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	for src, dst := range map[string]string{
+		security.EmbeddedCACert:   "root.pem",
+		security.EmbeddedNodeCert: "server.pem",
+		security.EmbeddedNodeKey:  "node.key",
+	} {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(certsDir, dst), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The node key keeps its standard name.
+	names := security.FileNames{Cert: "server.pem", CA: "root.pem"}
+	serverConfig, err := security.LoadTLSConfigFromDirNamed(certsDir, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// The errors name the files actually read.
+	if err := ioutil.WriteFile(filepath.Join(certsDir, "server.pem"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := security.LoadTLSConfigFromDirNamed(certsDir, names); !testutils.IsError(
+		err, "server.pem is empty",
+	) {
+		t.Errorf("expected empty certificate error, got %v", err)
+	}
+	if _, err := security.LoadTLSConfigFromDirNamed(
+		certsDir, security.FileNames{},
+	); !os.IsNotExist(errors.UnwrapAll(err)) {
+		t.Errorf("expected missing certificate error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigClientCertMode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	_, err := security.LoadServerTLSConfigWithOptions(
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeCert),
+		filepath.Join(security.EmbeddedCertsDir, security.EmbeddedNodeKey),
+		security.TLSOptions{ClientCertMode: 42})
+	if !testutils.IsError(err, "unknown client certificate mode 42") {
+		t.Fatalf("expected unknown mode error, got %v", err)
+	}
+
+	withCert := embeddedClientTLSConfig(t)
+	withoutCert := embeddedClientTLSConfig(t)
+	withoutCert.Certificates = nil
+
+	testCases := []struct {
+		mode          security.ClientCertMode
+		clientAuth    tls.ClientAuthType
+		clientConfig  *tls.Config
+		expectedPeers int
+		expectedError string
+	}{
+		{security.ClientCertVerifyIfGiven, tls.VerifyClientCertIfGiven, withCert, 1, ""},
+		{security.ClientCertVerifyIfGiven, tls.VerifyClientCertIfGiven, withoutCert, 0, ""},
+		// The client certificate is not even requested.
+		{security.ClientCertNone, tls.NoClientCert, withCert, 0, ""},
+		{security.ClientCertNone, tls.NoClientCert, withoutCert, 0, ""},
+		{security.ClientCertRequired, tls.RequireAndVerifyClientCert, withCert, 1, ""},
+		{security.ClientCertRequired, tls.RequireAndVerifyClientCert, withoutCert, 0,
+			"client didn't provide a certificate"},
+	}
+	for i, tc := range testCases {
+		serverConfig := embeddedServerTLSConfig(t, security.TLSOptions{ClientCertMode: tc.mode})
+		if serverConfig.ClientAuth != tc.clientAuth {
+			t.Errorf("#%d: expected ClientAuth %v, got %v", i, tc.clientAuth, serverConfig.ClientAuth)
+		}
+		_, serverState, err := testHandshakeStates(t, serverConfig, tc.clientConfig)
+		if tc.expectedError != "" {
+			if !testutils.IsError(err, tc.expectedError) {
+				t.Errorf("#%d: expected error %q, got %v", i, tc.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		if n := len(serverState.PeerCertificates); n != tc.expectedPeers {
+			t.Errorf("#%d: expected %d peer certificates, got %d", i, tc.expectedPeers, n)
+		}
+	}
+}
+
+func TestLoadTLSConfigFromCombinedPEM(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	caPEM := readAsset(security.EmbeddedCACert)
+	certPEM, keyPEM := readAsset(security.EmbeddedNodeCert), readAsset(security.EmbeddedNodeKey)
+	concat := func(parts ...[]byte) []byte {
+		var res []byte
+		for _, p := range parts {
+			res = append(res, p...)
+		}
+		return res
+	}
+
+	testCases := []struct {
+		name          string
+		combinedPEM   []byte
+		expectedError string
+	}{
+		{"cert first", concat(certPEM, keyPEM), ""},
+		{"key first", concat(keyPEM, certPEM), ""},
+		{"with chain", concat(certPEM, keyPEM, caPEM), ""},
+		{"no key", concat(certPEM, caPEM), "no PRIVATE KEY block found"},
+		{"no cert", keyPEM, "no CERTIFICATE block found"},
+		{"two keys", concat(keyPEM, certPEM, keyPEM), "more than one PRIVATE KEY block found"},
+		{"other block", concat(certPEM, keyPEM, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL"})),
+			"unexpected PEM block of type X509 CRL"},
+	}
+	for _, tc := range testCases {
+		serverConfig, err := security.LoadTLSConfigFromCombinedPEM(tc.combinedPEM, caPEM)
+		if tc.expectedError != "" {
+			if !testutils.IsError(err, tc.expectedError) {
+				t.Errorf("%s: expected error %q, got %v", tc.name, tc.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if _, err := testHandshake(t, serverConfig, embeddedClientTLSConfig(t)); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestLoadTLSConfigWith(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	readAsset := func(name string) []byte {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	caPEM := readAsset(security.EmbeddedCACert)
+	certPEM, keyPEM := readAsset(security.EmbeddedNodeCert), readAsset(security.EmbeddedNodeKey)
+
+	serverConfig, err := security.LoadTLSConfigWith(certPEM, keyPEM, caPEM, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, embeddedClientTLSConfig(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The base config is set up when configure runs, and can be overridden,
+	// including the pools.
+	otherCAPEM, _ := generateTestCA(t)
+	otherPool := x509.NewCertPool()
+	otherPool.AppendCertsFromPEM(otherCAPEM)
+	serverConfig, err = security.LoadTLSConfigWith(certPEM, keyPEM, caPEM, func(cfg *tls.Config) {
+		if len(cfg.Certificates) != 1 || cfg.RootCAs == nil || cfg.ClientCAs == nil {
+			t.Error("expected the certificate and pools to be set")
+		}
+		if cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+			t.Errorf("expected ClientAuth %s, got %s", tls.VerifyClientCertIfGiven, cfg.ClientAuth)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = otherPool
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, embeddedClientTLSConfig(t)); !testutils.IsError(
+		err, "certificate signed by unknown authority|bad certificate",
+	) {
+		t.Errorf("expected unknown authority error, got %v", err)
+	}
+
+	if _, err := security.LoadTLSConfigWith(certPEM, nil, caPEM, func(*tls.Config) {
+		t.Error("configure called for an invalid config")
+	}); !testutils.IsError(err, "certificate or key PEM data is empty") {
+		t.Errorf("expected empty key error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigDistinctCAs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Both CAs are trusted for server certificates, only the client CA for
+	// client certificates.
+	clientCAPEM, clientCAKeyPEM := generateTestCA(t)
+	rootOnlyCAPEM, rootOnlyCAKeyPEM := generateTestCA(t)
+	rootCAPEM := append(append(append([]byte(nil), clientCAPEM...), '\n'), rootOnlyCAPEM...)
+	opts := security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}}
+	nodePEM, nodeKeyPEM, err := security.GenerateNodeCertAndKey(
+		rootOnlyCAPEM, rootOnlyCAKeyPEM, []string{"localhost"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := security.LoadTLSConfigDistinctCAs(
+		nodePEM, nodeKeyPEM, rootCAPEM, nil,
+	); !testutils.IsError(err, "a client CA certificate is required") {
+		t.Errorf("expected missing client CA error, got %v", err)
+	}
+	serverConfig, err := security.LoadTLSConfigDistinctCAs(nodePEM, nodeKeyPEM, rootCAPEM, clientCAPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(serverConfig.RootCAs.Subjects()); n != 2 {
+		t.Errorf("expected 2 root CA certificates, got %d", n)
+	}
+	if n := len(serverConfig.ClientCAs.Subjects()); n != 1 {
+		t.Errorf("expected 1 client CA certificate, got %d", n)
+	}
+
+	clientConfig := func(caPEM, caKeyPEM []byte) *tls.Config {
+		certPEM, keyPEM, err := security.GenerateClientCertAndKey(caPEM, caKeyPEM, security.RootUser, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := security.LoadClientTLSConfigForHost(certPEM, keyPEM, rootCAPEM, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	_, serverState, err := testHandshakeStates(t, serverConfig, clientConfig(clientCAPEM, clientCAKeyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serverState.VerifiedChains) == 0 {
+		t.Error("expected the client certificate to be verified")
+	}
+	// The clients of the CA only trusted for server certificates are rejected.
+	if _, err := testHandshake(
+		t, serverConfig, clientConfig(rootOnlyCAPEM, rootOnlyCAKeyPEM),
+	); !testutils.IsError(err, "certificate signed by unknown authority|bad certificate") {
+		t.Errorf("expected unknown authority error, got %v", err)
+	}
+}
+
+func TestLoadTLSConfigCheckExtKeyUsage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	loadServer := func(certName, keyName string, check bool) error {
+		_, err := security.LoadServerTLSConfigWithOptions(
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+			filepath.Join(security.EmbeddedCertsDir, certName),
+			filepath.Join(security.EmbeddedCertsDir, keyName),
+			security.TLSOptions{CheckExtKeyUsage: check})
+		return err
+	}
+	loadClient := func(certName, keyName string, check bool) error {
+		_, err := security.LoadClientTLSConfigWithOptions(
+			filepath.Join(security.EmbeddedCertsDir, security.EmbeddedCACert),
+			filepath.Join(security.EmbeddedCertsDir, certName),
+			filepath.Join(security.EmbeddedCertsDir, keyName),
+			security.ClientTLSOptions{CheckExtKeyUsage: check})
+		return err
+	}
+
+	testCases := []struct {
+		name          string
+		load          func(certName, keyName string, check bool) error
+		certName      string
+		keyName       string
+		expectedError string
+	}{
+		// The node certificate allows both server and client authentication.
+		{"node as server", loadServer, security.EmbeddedNodeCert, security.EmbeddedNodeKey, ""},
+		{"node as client", loadClient, security.EmbeddedNodeCert, security.EmbeddedNodeKey, ""},
+		{"client as client", loadClient, security.EmbeddedRootCert, security.EmbeddedRootKey, ""},
+		{"client as server", loadServer, security.EmbeddedRootCert, security.EmbeddedRootKey,
+			`certificate "root" does not have the serverAuth extended key usage`},
+	}
+	for _, tc := range testCases {
+		// Nothing is checked by default.
+		if err := tc.load(tc.certName, tc.keyName, false); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		err := tc.load(tc.certName, tc.keyName, true)
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+		} else if !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("%s: expected error %q, got %v", tc.name, tc.expectedError, err)
+		}
+	}
+
+	// A server-only certificate cannot be used as a client certificate.
+	security.ResetAssetLoader()
+	defer ResetTest()
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	caPEM, caKeyPEM := generateTestCA(t)
+	caCert, caKey := parseCertAndKey(t, caPEM, caKeyPEM)
+	key, err := rsa.GenerateKey(rand.Reader, testKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDER, err := security.GenerateUIServerCert(caCert, caKey, key.Public(), time.Hour, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, err := security.PrivateKeyToPEM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPath := filepath.Join(certsDir, "ca.crt")
+	certPath := filepath.Join(certsDir, "ui.crt")
+	keyPath := filepath.Join(certsDir, "ui.key")
+	for path, contents := range map[string][]byte{
+		caPath:   caPEM,
+		certPath: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		keyPath:  pem.EncodeToMemory(keyBlock),
+	} {
+		if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = security.LoadClientTLSConfigWithOptions(
+		caPath, certPath, keyPath, security.ClientTLSOptions{CheckExtKeyUsage: true})
+	if expected := `certificate "localhost" does not have the clientAuth extended key usage`; !testutils.IsError(err, expected) {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestValidateTLSConfigDir(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	if errs := security.ValidateTLSConfigDir(security.EmbeddedCertsDir); len(errs) != 0 {
+		t.Fatalf("expected the embedded certs to be valid, got %v", errs)
+	}
+
+	// Do not mock cert access for the rest of this test.
+	security.ResetAssetLoader()
+	defer ResetTest()
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// All the files are missing.
+	errs := security.ValidateTLSConfigDir(certsDir)
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+	if !testutils.IsError(errs[0], "could not load server TLS config") ||
+		!testutils.IsError(errs[1], "could not load client TLS config") {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	// An expired node certificate signed by another CA.
+	caPEM, _ := generateTestCA(t)
+	otherCAPEM, otherCAKeyPEM := generateTestCA(t)
+	certPEM, keyPEM, err := security.GenerateNodeCertAndKey(otherCAPEM, otherCAKeyPEM, []string{"localhost"},
+		security.CertOptions{
+			KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true},
+			NotBefore:  timeutil.Now().Add(-2 * time.Hour),
+			ValidFor:   time.Hour,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string][]byte{
+		security.CACertFilename():   caPEM,
+		security.NodeCertFilename(): certPEM,
+		security.NodeKeyFilename():  keyPEM,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(certsDir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs = security.ValidateTLSConfigDir(certsDir)
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+	if !testutils.IsError(errs[0], "node certificate .* expired on") ||
+		!testutils.IsError(errs[1], "node certificate .* is not signed by CA") {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestLoadTLSConfigEmbeddedPrefix(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer ResetTest()
+
+	embeddedDir := "embedded=" + security.EmbeddedCertsDir
+	embeddedPath := func(name string) string {
+		return filepath.Join(embeddedDir, name)
+	}
+	loaders := []func() error{
+		func() error {
+			_, err := security.LoadTLSConfigFromDir(embeddedDir, security.CertsDirOptions{})
+			return err
+		},
+		func() error {
+			_, err := security.LoadServerTLSConfig(
+				embeddedPath(security.EmbeddedCACert),
+				embeddedPath(security.EmbeddedCACert),
+				embeddedPath(security.EmbeddedNodeCert),
+				embeddedPath(security.EmbeddedNodeKey))
+			return err
+		},
+		func() error {
+			_, err := security.LoadClientTLSConfig(
+				embeddedPath(security.EmbeddedCACert),
+				embeddedPath(security.EmbeddedRootCert),
+				embeddedPath(security.EmbeddedRootKey))
+			return err
+		},
+	}
+
+	// The embedded assets are installed by ResetTest.
+	for i, load := range loaders {
+		if err := load(); err != nil {
+			t.Errorf("#%d: %v", i, err)
+		}
+	}
+
+	// Without them, the prefix is reported instead of a missing file.
+	security.ResetAssetLoader()
+	for i, load := range loaders {
+		if err := load(); !testutils.IsError(err, "embedded certs are not available in this build") {
+			t.Errorf("#%d: expected embedded certs error, got %v", i, err)
+		}
+	}
+}
+
+func TestLoadTLSConfigFromDirContext(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer ResetTest()
+
+	config, err := security.LoadTLSConfigFromDirContext(
+		context.Background(), "embedded="+security.EmbeddedCertsDir, security.CertsDirOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Certificates) != 1 {
+		t.Fatalf("config.Certificates should have 1 cert; found %d", len(config.Certificates))
+	}
+
+	// Simulate a hung filesystem: the first access blocks until unblocked.
+	unblock := make(chan struct{})
+	var mu struct {
+		syncutil.Mutex
+		accesses int
+	}
+	access := func() {
+		mu.Lock()
+		mu.accesses++
+		first := mu.accesses == 1
+		mu.Unlock()
+		if first {
+			<-unblock
+		}
+	}
+	accesses := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return mu.accesses
+	}
+	done := make(chan struct{})
+	security.SetAssetLoader(security.AssetLoader{
+		ReadDir: securitytest.EmbeddedAssets.ReadDir,
+		ReadFile: func(path string) ([]byte, error) {
+			access()
+			return securitytest.EmbeddedAssets.ReadFile(path)
+		},
+		Stat: func(path string) (os.FileInfo, error) {
+			access()
+			defer func() {
+				select {
+				case done <- struct{}{}:
+				default:
+				}
+			}()
+			return securitytest.EmbeddedAssets.Stat(path)
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := security.LoadTLSConfigFromDirContext(
+		ctx, security.EmbeddedCertsDir, security.CertsDirOptions{},
+	); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// Once the hung read returns, the load stops instead of reading the
+	// remaining files.
+	close(unblock)
+	<-done
+	time.Sleep(10 * time.Millisecond)
+	if n := accesses(); n != 2 {
+		t.Errorf("expected the load to stop after the hung read, got %d accesses", n)
+	}
+}
+
+func TestLoadTLSConfigFromEnv(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const envVar = "COCKROACH_TEST_CERTS_DIR"
+	defer func() {
+		if err := os.Unsetenv(envVar); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if err := os.Unsetenv(envVar); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := security.LoadTLSConfigFromEnv(envVar); !testutils.IsError(
+		err, "the certs directory environment variable COCKROACH_TEST_CERTS_DIR is not set",
+	) {
+		t.Errorf("expected unset variable error, got %v", err)
+	}
+
+	embeddedDir := "embedded=" + security.EmbeddedCertsDir
+	if err := os.Setenv(envVar, embeddedDir); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err := security.LoadTLSConfigFromEnv(envVar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, embeddedClientTLSConfig(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Do not mock cert access for the following cases.
+	security.ResetAssetLoader()
+	defer ResetTest()
+	certsDir, cleanup := tempDir(t)
+	defer cleanup()
+	filePath := filepath.Join(certsDir, "file")
+	if err := ioutil.WriteFile(filePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		certDir       string
+		expectedError string
+	}{
+		{"", "the certs directory environment variable COCKROACH_TEST_CERTS_DIR is empty"},
+		{filepath.Join(certsDir, "missing"),
+			"could not load the certs directory COCKROACH_TEST_CERTS_DIR=.*missing: .*no such file or directory"},
+		{filePath, "COCKROACH_TEST_CERTS_DIR=.*file: .*file is not a directory"},
+		{certsDir, "COCKROACH_TEST_CERTS_DIR=.*node.crt: no such file or directory"},
+	}
+	for _, tc := range testCases {
+		if err := os.Setenv(envVar, tc.certDir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := security.LoadTLSConfigFromEnv(envVar); !testutils.IsError(err, tc.expectedError) {
+			t.Errorf("%q: expected %q, got %v", tc.certDir, tc.expectedError, err)
+		}
+	}
+}
+
+func TestLoadTLSConfigFromMemory(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	clientConfig := embeddedClientTLSConfig(t)
+
+	// The asset loader is not used: nothing can be read through it.
+	security.SetAssetLoader(security.AssetLoader{
+		ReadFile: func(name string) ([]byte, error) {
+			t.Errorf("unexpected read of %s", name)
+			return nil, os.ErrNotExist
+		},
+		Stat: func(name string) (os.FileInfo, error) {
+			t.Errorf("unexpected stat of %s", name)
+			return nil, os.ErrNotExist
+		},
+	})
+	defer ResetTest()
+
+	certs := make(map[string][]byte)
+	for _, name := range []string{security.EmbeddedCACert, security.EmbeddedNodeCert, security.EmbeddedNodeKey} {
+		contents, err := securitytest.Asset(filepath.Join(security.EmbeddedCertsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs[name] = contents
+	}
+
+	serverConfig, err := security.LoadTLSConfigFromMemory(certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// The optional files are picked up too: with an unrelated client CA, the
+	// root client certificate is rejected.
+	otherCAPEM, _ := generateTestCA(t)
+	certs["ca-client.crt"] = otherCAPEM
+	serverConfig, err = security.LoadTLSConfigFromMemory(certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testHandshake(t, serverConfig, clientConfig); !testutils.IsError(
+		err, "certificate signed by unknown authority",
+	) {
+		t.Fatalf("expected unknown authority error, got %v", err)
+	}
+
+	delete(certs, security.EmbeddedNodeKey)
+	if _, err := security.LoadTLSConfigFromMemory(certs); !os.IsNotExist(err) {
+		t.Fatalf("expected missing file error, got %v", err)
+	}
+}
+
+func TestCertPoolCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	security.ClearCertPoolCache()
+	first := embeddedServerTLSConfig(t, security.TLSOptions{})
+	second := embeddedServerTLSConfig(t, security.TLSOptions{})
+	if first.RootCAs != second.RootCAs {
+		t.Error("expected the CA pool to be shared across loads")
+	}
+	// The same CA is used for clients: the pool is shared too.
+	if first.RootCAs != first.ClientCAs {
+		t.Error("expected RootCAs and ClientCAs to share the same pool")
+	}
+
+	security.ClearCertPoolCache()
+	third := embeddedServerTLSConfig(t, security.TLSOptions{})
+	if third.RootCAs == first.RootCAs {
+		t.Error("expected a new CA pool after clearing the cache")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// LatencySink records the durations of the TLS handshakes of the connections
+// accepted by a listener returned by NewTimingListener, eg: into a histogram.
+// It may be called concurrently.
+type LatencySink interface {
+	RecordHandshakeLatency(time.Duration)
+}
+
+// timingListener is the listener returned by NewTimingListener.
+type timingListener struct {
+	net.Listener
+	config *tls.Config
+	sink   LatencySink
+}
+
+// NewTimingListener returns a listener accepting TLS connections on inner,
+// like tls.NewListener, and recording the duration of their handshakes into
+// sink.
+//
+// The tls package does not expose the start of the handshake, so it is
+// approximated by the first read of the underlying connection returning data,
+// ie: the arrival of the ClientHello. The time spent waiting for the client to
+// start the handshake is not counted. Only successful handshakes are recorded.
+//
+// The accepted connections are not *tls.Conn, but implement the Handshake and
+// ConnectionState methods of *tls.Conn, to which they delegate.
+func NewTimingListener(inner net.Listener, config *tls.Config, sink LatencySink) net.Listener {
+	return &timingListener{Listener: inner, config: config, sink: sink}
+}
+
+// Accept implements the net.Listener interface.
+func (l *timingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	raw := &firstReadConn{Conn: conn}
+	return &handshakeHookConn{
+		Conn: tls.Server(raw, l.config),
+		onHandshake: func(err error) {
+			if err == nil {
+				l.sink.RecordHandshakeLatency(timeutil.Since(raw.firstRead))
+			}
+		},
+	}, nil
+}
+
+// firstReadConn records when its first read returned data.
+type firstReadConn struct {
+	net.Conn
+	// firstRead is only set during the handshake, from the goroutine running
+	// it.
+	firstRead time.Time
+}
+
+// Read implements the net.Conn interface.
+func (c *firstReadConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.firstRead.IsZero() {
+		c.firstRead = timeutil.Now()
+	}
+	return n, err
+}
+
+// handshakeHookConn is a TLS connection calling onHandshake with the result of
+// its handshake, once it completes.
+type handshakeHookConn struct {
+	*tls.Conn
+	onHandshake func(error)
+	once        sync.Once
+}
+
+// Handshake runs the handshake if it has not been run yet, like
+// tls.Conn.Handshake, and calls onHandshake with its result.
+func (c *handshakeHookConn) Handshake() error {
+	c.once.Do(func() {
+		c.onHandshake(c.Conn.Handshake())
+	})
+	// The result of the handshake is cached by the tls.Conn.
+	return c.Conn.Handshake()
+}
+
+// Read implements the net.Conn interface.
+func (c *handshakeHookConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// Write implements the net.Conn interface.
+func (c *handshakeHookConn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// fakeLatencySink records the handshake latencies it is passed.
+type fakeLatencySink struct {
+	mu        syncutil.Mutex
+	latencies []time.Duration
+}
+
+func (s *fakeLatencySink) RecordHandshakeLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies = append(s.latencies, d)
+}
+
+func (s *fakeLatencySink) recorded() []time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Duration(nil), s.latencies...)
+}
+
+func TestTimingListener(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeLatencySink{}
+	ln := security.NewTimingListener(inner, embeddedServerTLSConfig(t, security.TLSOptions{}), sink)
+	defer ln.Close()
+
+	// The server reads the data sent by each client until it is closed.
+	serverCh := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, err = ioutil.ReadAll(conn)
+			if err == nil {
+				if state := conn.(interface {
+					ConnectionState() tls.ConnectionState
+				}).ConnectionState(); !state.HandshakeComplete {
+					t.Error("expected a complete handshake")
+				}
+			}
+			_ = conn.Close()
+			serverCh <- err
+		}
+	}()
+
+	const delay = 10 * time.Millisecond
+	dial := func(cfg *tls.Config) error {
+		rawConn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := tls.Client(rawConn, cfg)
+		defer conn.Close()
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+		// Wait before sending data: the server only counts the handshake.
+		time.Sleep(delay)
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			return err
+		}
+		return conn.CloseWrite()
+	}
+
+	clientConfig := embeddedClientTLSConfig(t)
+	clientConfig.ServerName = "localhost"
+	start := time.Now()
+	if err := dial(clientConfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serverCh; err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	latencies := sink.recorded()
+	if len(latencies) != 1 {
+		t.Fatalf("expected 1 recorded latency, got %v", latencies)
+	}
+	if max := elapsed - delay; latencies[0] <= 0 || latencies[0] >= max {
+		t.Errorf("expected a latency between 0 and %s, got %s", max, latencies[0])
+	}
+
+	// Failed handshakes are not recorded.
+	clientConfig.RootCAs = x509.NewCertPool()
+	if err := dial(clientConfig); !testutils.IsError(err, "certificate signed by unknown authority") {
+		t.Fatalf("expected unknown authority error, got %v", err)
+	}
+	if err := <-serverCh; err == nil {
+		t.Fatal("expected the server handshake to fail")
+	}
+	if latencies := sink.recorded(); len(latencies) != 1 {
+		t.Errorf("expected 1 recorded latency, got %v", latencies)
+	}
+}
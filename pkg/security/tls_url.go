@@ -0,0 +1,119 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// The file names fetched by LoadTLSConfigFromURL, relative to the base URL.
+const (
+	urlNodeCertFilename = "node.server.crt"
+	urlNodeKeyFilename  = "node.server.key"
+	urlCACertFilename   = "ca.crt"
+)
+
+// maxURLCertFileSize is the maximum size of the files fetched by
+// LoadTLSConfigFromURL. Certificates and keys are much smaller: larger
+// responses are not read in full.
+const maxURLCertFileSize = 1 << 20
+
+// LoadTLSConfigFromURL creates a server TLSConfig from the node certificate,
+// node key and CA certificate fetched from a config server, at
+// baseURL/node.server.crt, baseURL/node.server.key and baseURL/ca.crt. The CA
+// certificate is used for both server and client certificates. As the node key
+// is fetched, baseURL must be an https URL.
+//
+// The requests are sent with client, which lets callers authenticate to the
+// config server and configure the TLS connections to it. If client is nil,
+// http.DefaultClient is used. Responses other than 200 OK are errors.
+//
+// As for LoadTLSConfigFromDir, the node certificate must chain up to the CA
+// certificate.
+func LoadTLSConfigFromURL(
+	ctx context.Context, baseURL string, client *http.Client,
+) (*tls.Config, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid certs URL %s", baseURL)
+	}
+	if u.Scheme != "https" {
+		return nil, errors.Errorf("invalid certs URL %s: only https URLs are supported", baseURL)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	fetch := func(name string, sentinel error) ([]byte, string, error) {
+		fileURL := baseURL + "/" + name
+		contents, err := fetchCertFile(ctx, client, fileURL)
+		if err != nil {
+			return nil, fileURL, err
+		}
+		return contents, fileURL, checkNotEmpty(contents, fileURL, sentinel)
+	}
+	certPEM, certURL, err := fetch(urlNodeCertFilename, ErrEmptyCertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, _, err := fetch(urlNodeKeyFilename, ErrEmptyCertFile)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, caURL, err := fetch(urlCACertFilename, ErrEmptyCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := newServerTLSConfig(certPEM, keyPEM, caPEM, caPEM, TLSOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyCertificateChain(cfg.Certificates[0], cfg.RootCAs); err != nil {
+		return nil, errors.Wrapf(err, "node certificate %s is not signed by CA %s", certURL, caURL)
+	}
+	return cfg, nil
+}
+
+// fetchCertFile returns the body of the response to a GET request of fileURL,
+// or an error if it is larger than maxURLCertFileSize.
+func fetchCertFile(ctx context.Context, client *http.Client, fileURL string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not fetch %s", fileURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("could not fetch %s: server returned %s", fileURL, resp.Status)
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxURLCertFileSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not fetch %s", fileURL)
+	}
+	if len(contents) > maxURLCertFileSize {
+		return nil, errors.Errorf("could not fetch %s: response is larger than %d bytes",
+			fileURL, maxURLCertFileSize)
+	}
+	return contents, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+func TestLoadTLSConfigFromURL(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	caPEM, caKeyPEM := generateTestCA(t)
+	otherCAPEM, _ := generateTestCA(t)
+	nodePEM, nodeKeyPEM, err := security.GenerateNodeCertAndKey(caPEM, caKeyPEM, []string{"127.0.0.1"},
+		security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files are served under /certs, to clients presenting the token.
+	var mu syncutil.Mutex
+	files := map[string][]byte{
+		"/certs/node.server.crt": nodePEM,
+		"/certs/node.server.key": nodeKeyPEM,
+		"/certs/ca.crt":          caPEM,
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		contents, ok := files[r.URL.Path]
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(contents)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: authTransport{server.Client().Transport}}
+
+	ctx := context.Background()
+	cfg, err := security.LoadTLSConfigFromURL(ctx, server.URL+"/certs/", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	if _, err := testHandshake(t, cfg, &tls.Config{RootCAs: roots}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		baseURL  string
+		client   *http.Client
+		files    map[string][]byte
+		expected string
+	}{
+		{"http URL", strings.Replace(server.URL, "https", "http", 1) + "/certs", client, nil,
+			"only https URLs are supported"},
+		{"unauthorized", server.URL + "/certs", server.Client(), nil,
+			"could not fetch .*/certs/node.server.crt: server returned 403 Forbidden"},
+		{"missing file", server.URL + "/other", client, nil,
+			"could not fetch .*/other/node.server.crt: server returned 404 Not Found"},
+		{"empty file", server.URL + "/certs", client, map[string][]byte{"/certs/ca.crt": nil},
+			"/certs/ca.crt is empty"},
+		{"large file", server.URL + "/certs", client,
+			map[string][]byte{"/certs/node.server.key": make([]byte, 1<<20+1)},
+			"could not fetch .*/certs/node.server.key: response is larger than 1048576 bytes"},
+		{"other CA", server.URL + "/certs", client, map[string][]byte{"/certs/ca.crt": otherCAPEM},
+			"node certificate .*/certs/node.server.crt is not signed by CA .*/certs/ca.crt"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			for path, contents := range tc.files {
+				defer func(path string, orig []byte) {
+					mu.Lock()
+					files[path] = orig
+					mu.Unlock()
+				}(path, files[path])
+				files[path] = contents
+			}
+			mu.Unlock()
+			if _, err := security.LoadTLSConfigFromURL(ctx, tc.baseURL, tc.client); !testutils.IsError(
+				err, tc.expected,
+			) {
+				t.Errorf("expected %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+// authTransport authenticates the requests to the test config server.
+type authTransport struct {
+	http.RoundTripper
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer token")
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// NewHTTPTransport returns an http.Transport authenticating with the node
+// certificate in certDir, as loaded by LoadClientTLSConfigFromDir. The other
+// settings, including timeouts, are those of http.DefaultTransport.
+//
+// The TLSClientConfig of the transport is the config loaded from certDir, not
+// a copy.
+func NewHTTPTransport(certDir string) (*http.Transport, error) {
+	tlsConfig, err := LoadClientTLSConfigFromDir(certDir)
+	if err != nil {
+		return nil, err
+	}
+	// Copy the defaults from http.DefaultTransport. We cannot just copy the
+	// entire struct because it has a sync Mutex.
+	t := http.DefaultTransport.(*http.Transport)
+	return &http.Transport{
+		Proxy:                 t.Proxy,
+		DialContext:           t.DialContext,
+		MaxIdleConns:          t.MaxIdleConns,
+		IdleConnTimeout:       t.IdleConnTimeout,
+		TLSHandshakeTimeout:   t.TLSHandshakeTimeout,
+		ExpectContinueTimeout: t.ExpectContinueTimeout,
+		// HTTP/2 is only enabled by default when TLSClientConfig is not set.
+		ForceAttemptHTTP2: t.ForceAttemptHTTP2,
+
+		TLSClientConfig: tlsConfig,
+	}, nil
+}
+
+// DialTLS opens a TLS connection to addr, authenticating with the node
+// certificate in certDir, as loaded by LoadClientTLSConfigFromDir. The server
+// certificate is verified against the host part of addr. The dial and the
+// handshake are aborted if the context is canceled. Handshake errors are
+// returned as is, so that callers can inspect certificate problems.
+func DialTLS(ctx context.Context, addr, certDir string) (net.Conn, error) {
+	tlsConfig, err := LoadClientTLSConfigFromDir(certDir)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = host
+
+	var dialer net.Dialer
+	rawConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, tlsConfig)
+	if err := handshakeContext(ctx, rawConn, conn); err != nil {
+		_ = rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handshakeContext performs the TLS handshake on conn, closing the underlying
+// rawConn to abort it if the context is canceled first.
+func handshakeContext(ctx context.Context, rawConn net.Conn, conn *tls.Conn) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.Handshake()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		_ = rawConn.Close()
+		// Wait for the handshake goroutine to notice.
+		<-errCh
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+)
+
+func TestNewHTTPTransport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	s.TLS = embeddedServerTLSConfig(t, security.TLSOptions{ClientCertMode: security.ClientCertRequired})
+	s.StartTLS()
+	defer s.Close()
+
+	transport, err := security.NewHTTPTransport(security.EmbeddedCertsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.CloseIdleConnections()
+	if transport.TLSHandshakeTimeout == 0 {
+		t.Error("expected a TLS handshake timeout")
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The node certificate is used as the client certificate.
+	if cn := string(body); cn != security.NodeUser {
+		t.Errorf("expected the server to see client %q, got %q", security.NodeUser, cn)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0",
+		embeddedServerTLSConfig(t, security.TLSOptions{ClientCertMode: security.ClientCertRequired}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	serverErrCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+		defer conn.Close()
+		serverErrCh <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := security.DialTLS(context.Background(), ln.Addr().String(), security.EmbeddedCertsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-serverErrCh; err != nil {
+		t.Fatal(err)
+	}
+	if !conn.(*tls.Conn).ConnectionState().HandshakeComplete {
+		t.Error("expected the handshake to be complete")
+	}
+}
+
+func TestDialTLSErrors(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// A server with a certificate signed by another CA.
+	caPEM, caKeyPEM := generateTestCA(t)
+	certPEM, keyPEM, err := security.GenerateNodeCertAndKey(caPEM, caKeyPEM, []string{"127.0.0.1"},
+		security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConfig, _, err := security.LoadTLSConfigAndCert(certPEM, keyPEM, caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", otherConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.(*tls.Conn).Handshake()
+	}()
+
+	_, err = security.DialTLS(context.Background(), ln.Addr().String(), security.EmbeddedCertsDir)
+	var authorityErr x509.UnknownAuthorityError
+	if !errors.As(err, &authorityErr) {
+		t.Errorf("expected an x509.UnknownAuthorityError, got %T: %v", err, err)
+	}
+
+	// A server that never completes the handshake.
+	rawLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawLn.Close()
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := rawLn.Accept()
+		if err != nil {
+			close(acceptedCh)
+			return
+		}
+		acceptedCh <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := security.DialTLS(ctx, rawLn.Addr().String(), security.EmbeddedCertsDir); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if conn, ok := <-acceptedCh; ok {
+		conn.Close()
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// vaultRetryInterval is the interval at which the issuance of a certificate
+// is retried after a failure.
+const vaultRetryInterval = 10 * time.Second
+
+// vaultRequestTimeout is the maximum duration of a request for a new
+// certificate.
+const vaultRequestTimeout = time.Minute
+
+// VaultCertRequest describes the certificates to request from Vault.
+type VaultCertRequest struct {
+	// Role is the name of the PKI role issuing the certificates.
+	Role string
+	// CommonName is the common name of the certificates. If empty, NodeUser is
+	// used, as required for node certificates.
+	CommonName string
+	// Hosts are the DNS names and IP addresses the certificates are valid for.
+	Hosts []string
+	// TTL is the lifetime of the certificates. If zero, the default of the
+	// role is used.
+	TTL time.Duration
+}
+
+// VaultCert is a certificate issued by Vault, PEM-encoded.
+type VaultCert struct {
+	CertPEM, KeyPEM []byte
+	// CAPEM holds the certificates of the issuing CA and its chain, used to
+	// verify the certificates of peers.
+	CAPEM []byte
+}
+
+// VaultClient issues certificates, eg: through the PKI secrets engine of
+// Vault. See NewVaultPKIClient.
+type VaultClient interface {
+	IssueCert(ctx context.Context, req VaultCertRequest) (VaultCert, error)
+}
+
+// VaultConfig holds the settings of LoadTLSConfigFromVault.
+type VaultConfig struct {
+	// Client issues the certificates.
+	Client VaultClient
+	// Request describes the certificates to request.
+	Request VaultCertRequest
+	// TLSOptions are applied to the server configs, which are rebuilt on each
+	// renewal: the CA pools set through TLSOptions.CAPools are re-applied to
+	// the renewed ones.
+	TLSOptions TLSOptions
+}
+
+// LoadTLSConfigFromVault requests a node certificate from Vault, and returns a
+// server config serving it. A new certificate is requested once two thirds of
+// the remaining validity of the current one have elapsed, and swapped in
+// without a restart. Failures to get a new certificate are logged and retried
+// until the current one expires. Stop must be called to stop the renewals.
+//
+// Nothing is written to disk: the certificates and keys only live in memory.
+func LoadTLSConfigFromVault(cfg VaultConfig) (*ReloadingTLSConfig, error) {
+	if cfg.Client == nil {
+		return nil, errors.New("a Vault client is required")
+	}
+	if cfg.Request.Role == "" {
+		return nil, errors.New("a Vault PKI role is required")
+	}
+	if cfg.Request.CommonName == "" {
+		cfg.Request.CommonName = NodeUser
+	}
+
+	v := &vaultIssuer{cfg: cfg}
+	if err := v.issue(context.Background()); err != nil {
+		return nil, err
+	}
+	r := &ReloadingTLSConfig{
+		config: &tls.Config{
+			GetConfigForClient: v.getConfigForClient,
+		},
+		vault:   v,
+		stopper: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	r.mu.leaf = r.currentLeaf()
+	go r.watchVault()
+	return r, nil
+}
+
+// vaultIssuer keeps a server config serving a certificate issued by Vault.
+type vaultIssuer struct {
+	cfg VaultConfig
+
+	mu struct {
+		syncutil.RWMutex
+		config *tls.Config
+		// renewAt is the time at which a new certificate should be requested.
+		renewAt time.Time
+	}
+}
+
+// issue requests a new certificate and swaps it in. The request is made
+// without holding v.mu, and gives up after vaultRequestTimeout.
+func (v *vaultIssuer) issue(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, vaultRequestTimeout)
+	defer cancel()
+	cert, err := v.cfg.Client.IssueCert(ctx, v.cfg.Request)
+	if err != nil {
+		return errors.Wrap(err, "could not get a certificate from Vault")
+	}
+	config, err := newServerTLSConfig(cert.CertPEM, cert.KeyPEM, cert.CAPEM, cert.CAPEM, v.cfg.TLSOptions)
+	if err != nil {
+		return errors.Wrap(err, "invalid certificate issued by Vault")
+	}
+
+	now := timeutil.Now()
+	notAfter := config.Certificates[0].Leaf.NotAfter
+	if !now.Before(notAfter) {
+		return errors.Errorf("certificate issued by Vault expired on %s", notAfter)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.mu.config = config
+	v.mu.renewAt = now.Add(notAfter.Sub(now) * 2 / 3)
+	return nil
+}
+
+// maybeRenew requests a new certificate if it is time to. It returns true if
+// the certificate was renewed.
+func (v *vaultIssuer) maybeRenew(ctx context.Context) (bool, error) {
+	if timeutil.Now().Before(v.renewAt()) {
+		return false, nil
+	}
+	if err := v.issue(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// renewAt returns the time at which a new certificate should be requested.
+func (v *vaultIssuer) renewAt() time.Time {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.mu.renewAt
+}
+
+// getConfigForClient is the callback set in tls.Config.GetConfigForClient.
+// The tls package does not call the GetConfigForClient callback of the
+// returned config, so the one set up by the TLSOptions, if any, is called
+// here.
+func (v *vaultIssuer) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	v.mu.RLock()
+	config := v.mu.config
+	v.mu.RUnlock()
+	if config.GetConfigForClient == nil {
+		return config, nil
+	}
+	served, err := config.GetConfigForClient(hello)
+	if err != nil || served != nil {
+		return served, err
+	}
+	return config, nil
+}
+
+// watchVault renews the certificate when it is time to, until the config is
+// stopped.
+func (r *ReloadingTLSConfig) watchVault() {
+	defer close(r.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stopper:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var retryAt time.Time
+	for {
+		next := r.vault.renewAt()
+		if retryAt.After(next) {
+			next = retryAt
+		}
+		timer := time.NewTimer(next.Sub(timeutil.Now()))
+		select {
+		case <-r.stopper:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := r.renewFromVault(ctx); err != nil {
+			log.Warningf(ctx, "could not renew certificate: %v", err)
+			retryAt = timeutil.Now().Add(vaultRetryInterval)
+		} else {
+			log.Info(ctx, "successfully renewed certificate from Vault")
+		}
+	}
+}
+
+// vaultPKIClient is a VaultClient using the HTTP API of Vault.
+type vaultPKIClient struct {
+	addr, token, mount string
+	httpClient         *http.Client
+}
+
+// NewVaultPKIClient returns a VaultClient issuing certificates through the PKI
+// secrets engine mounted at mount (eg: "pki") on the Vault server at addr (eg:
+// "https://vault:8200"), authenticating with token. If httpClient is nil,
+// http.DefaultClient is used.
+func NewVaultPKIClient(addr, token, mount string, httpClient *http.Client) VaultClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &vaultPKIClient{
+		addr:       strings.TrimSuffix(addr, "/"),
+		token:      token,
+		mount:      strings.Trim(mount, "/"),
+		httpClient: httpClient,
+	}
+}
+
+// vaultIssueRequest is the body of the requests to the issue endpoint.
+type vaultIssueRequest struct {
+	CommonName string `json:"common_name"`
+	AltNames   string `json:"alt_names,omitempty"`
+	IPSANs     string `json:"ip_sans,omitempty"`
+	TTL        string `json:"ttl,omitempty"`
+}
+
+// vaultIssueResponse is the body of the responses of the issue endpoint.
+type vaultIssueResponse struct {
+	Data struct {
+		Certificate string   `json:"certificate"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+		PrivateKey  string   `json:"private_key"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// IssueCert implements the VaultClient interface.
+func (c *vaultPKIClient) IssueCert(ctx context.Context, req VaultCertRequest) (VaultCert, error) {
+	var dnsNames, ips []string
+	for _, h := range req.Hosts {
+		if net.ParseIP(h) != nil {
+			ips = append(ips, h)
+		} else {
+			dnsNames = append(dnsNames, h)
+		}
+	}
+	body := vaultIssueRequest{
+		CommonName: req.CommonName,
+		AltNames:   strings.Join(dnsNames, ","),
+		IPSANs:     strings.Join(ips, ","),
+	}
+	if req.TTL != 0 {
+		body.TTL = fmt.Sprintf("%ds", int64(req.TTL/time.Second))
+	}
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return VaultCert{}, err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/issue/%s", c.addr, c.mount, req.Role)
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return VaultCert{}, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("X-Vault-Token", c.token)
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return VaultCert{}, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return VaultCert{}, err
+	}
+
+	var issued vaultIssueResponse
+	if err := json.Unmarshal(respBody, &issued); err != nil && resp.StatusCode == http.StatusOK {
+		return VaultCert{}, errors.Wrap(err, "could not decode Vault response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return VaultCert{}, errors.Errorf("Vault returned %s: %s", resp.Status, strings.Join(issued.Errors, "; "))
+	}
+	if issued.Data.Certificate == "" || issued.Data.PrivateKey == "" {
+		return VaultCert{}, errors.New("Vault response is missing the certificate or private key")
+	}
+
+	caPEM := issued.Data.IssuingCA
+	for _, ca := range issued.Data.CAChain {
+		if ca != issued.Data.IssuingCA {
+			caPEM += "\n" + ca
+		}
+	}
+	return VaultCert{
+		CertPEM: []byte(issued.Data.Certificate),
+		KeyPEM:  []byte(issued.Data.PrivateKey),
+		CAPEM:   []byte(caPEM),
+	}, nil
+}
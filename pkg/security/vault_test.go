@@ -0,0 +1,257 @@
+// Copyright 2020 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package security_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/errors"
+)
+
+// fakeVaultClient issues node certificates signed by a test CA.
+type fakeVaultClient struct {
+	caPEM, caKeyPEM []byte
+
+	mu struct {
+		sync.Mutex
+		requests []security.VaultCertRequest
+		err      error
+		// hang, if set, makes the requests block until they are canceled.
+		hang bool
+	}
+}
+
+func (c *fakeVaultClient) IssueCert(
+	ctx context.Context, req security.VaultCertRequest,
+) (security.VaultCert, error) {
+	c.mu.Lock()
+	c.mu.requests = append(c.mu.requests, req)
+	hang, err := c.mu.hang, c.mu.err
+	c.mu.Unlock()
+	if hang {
+		<-ctx.Done()
+		return security.VaultCert{}, ctx.Err()
+	}
+	if err != nil {
+		return security.VaultCert{}, err
+	}
+	certPEM, keyPEM, err := security.GenerateNodeCertAndKey(c.caPEM, c.caKeyPEM, req.Hosts,
+		security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}, ValidFor: req.TTL})
+	if err != nil {
+		return security.VaultCert{}, err
+	}
+	return security.VaultCert{CertPEM: certPEM, KeyPEM: keyPEM, CAPEM: c.caPEM}, nil
+}
+
+func (c *fakeVaultClient) numRequests() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.mu.requests)
+}
+
+func TestLoadTLSConfigFromVault(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	caPEM, caKeyPEM := generateTestCA(t)
+	client := &fakeVaultClient{caPEM: caPEM, caKeyPEM: caKeyPEM}
+	request := security.VaultCertRequest{
+		Role:  "node",
+		Hosts: []string{"127.0.0.1", "localhost"},
+		// The certificate is renewed after two thirds of its lifetime.
+		TTL: 1500 * time.Millisecond,
+	}
+
+	if _, err := security.LoadTLSConfigFromVault(security.VaultConfig{
+		Request: request,
+	}); !testutils.IsError(err, "a Vault client is required") {
+		t.Fatalf("expected missing client error, got %v", err)
+	}
+	if _, err := security.LoadTLSConfigFromVault(security.VaultConfig{
+		Client: client,
+	}); !testutils.IsError(err, "a Vault PKI role is required") {
+		t.Fatalf("expected missing role error, got %v", err)
+	}
+	client.mu.err = errors.New("permission denied")
+	if _, err := security.LoadTLSConfigFromVault(security.VaultConfig{
+		Client: client, Request: request,
+	}); !testutils.IsError(err, "could not get a certificate from Vault: permission denied") {
+		t.Fatalf("expected issuance error, got %v", err)
+	}
+	client.mu.err = nil
+
+	var caPools security.CAPoolHolder
+	r, err := security.LoadTLSConfigFromVault(security.VaultConfig{
+		Client: client, Request: request, TLSOptions: security.TLSOptions{CAPools: &caPools},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	client.mu.Lock()
+	if cn := client.mu.requests[len(client.mu.requests)-1].CommonName; cn != security.NodeUser {
+		t.Errorf("expected common name %q, got %q", security.NodeUser, cn)
+	}
+	client.mu.Unlock()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	clientConfig := &tls.Config{RootCAs: roots}
+	if _, err := testHandshake(t, r.Config(), clientConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate is renewed in the background.
+	serial := servedSerial(t, r.Config())
+	testutils.SucceedsSoon(t, func() error {
+		if servedSerial(t, r.Config()).Cmp(serial) == 0 {
+			return errors.New("certificate not renewed yet")
+		}
+		return nil
+	})
+	if _, err := testHandshake(t, r.Config(), clientConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// A forced reload requests a new certificate.
+	numRequests := client.numRequests()
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if client.numRequests() == numRequests {
+		t.Error("expected Reload to request a new certificate")
+	}
+
+	// The CA pools set through the holder are kept across renewals.
+	otherCAPEM, otherCAKeyPEM := generateTestCA(t)
+	otherCertPEM, otherKeyPEM, err := security.GenerateClientCertAndKey(
+		otherCAPEM, otherCAKeyPEM, security.RootUser,
+		security.CertOptions{KeyOptions: security.KeyOptions{KeySize: testKeySize, AllowWeakKey: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := tls.X509KeyPair(otherCertPEM, otherKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherClientConfig := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{otherCert}}
+	if _, err := testHandshake(t, r.Config(), otherClientConfig); !testutils.IsError(
+		err, "certificate signed by unknown authority",
+	) {
+		t.Fatalf("expected unknown authority error, got %v", err)
+	}
+	if err := caPools.UpdateCAPool(append(append([]byte(nil), caPEM...), otherCAPEM...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	numRequests = client.numRequests()
+	if _, err := testHandshake(t, r.Config(), otherClientConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// A hung request does not block the other calls, and is canceled with
+	// its context.
+	client.mu.Lock()
+	client.mu.hang = true
+	client.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.Reload(ctx) }()
+	testutils.SucceedsSoon(t, func() error {
+		if client.numRequests() == numRequests+1 {
+			return errors.New("request not sent yet")
+		}
+		return nil
+	})
+	r.OnReload(func(_, _ *x509.Certificate) {})
+	if _, err := testHandshake(t, r.Config(), clientConfig); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestVaultPKIClient(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var received struct {
+		path, token string
+		body        map[string]string
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.path = r.URL.Path
+		received.token = r.Header.Get("X-Vault-Token")
+		received.body = nil
+		if err := json.NewDecoder(r.Body).Decode(&received.body); err != nil {
+			t.Error(err)
+		}
+		if received.token != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"certificate":"CERT","issuing_ca":"CA","ca_chain":["CA","ROOT"],"private_key":"KEY"}}`))
+	}))
+	defer server.Close()
+
+	req := security.VaultCertRequest{
+		Role:       "node",
+		CommonName: security.NodeUser,
+		Hosts:      []string{"localhost", "127.0.0.1", "node.local", "::1"},
+		TTL:        time.Hour,
+	}
+	client := security.NewVaultPKIClient(server.URL+"/", "s.token", "/pki/", nil)
+	cert, err := client.IssueCert(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.path != "/v1/pki/issue/node" {
+		t.Errorf("unexpected request path %s", received.path)
+	}
+	expectedBody := map[string]string{
+		"common_name": security.NodeUser,
+		"alt_names":   "localhost,node.local",
+		"ip_sans":     "127.0.0.1,::1",
+		"ttl":         "3600s",
+	}
+	if len(received.body) != len(expectedBody) {
+		t.Errorf("expected request body %v, got %v", expectedBody, received.body)
+	}
+	for k, v := range expectedBody {
+		if received.body[k] != v {
+			t.Errorf("expected %s %q, got %q", k, v, received.body[k])
+		}
+	}
+	if string(cert.CertPEM) != "CERT" || string(cert.KeyPEM) != "KEY" || string(cert.CAPEM) != "CA\nROOT" {
+		t.Errorf("unexpected certificate %+v", cert)
+	}
+
+	client = security.NewVaultPKIClient(server.URL, "s.other", "pki", nil)
+	if _, err := client.IssueCert(context.Background(), req); !testutils.IsError(
+		err, "Vault returned 403 Forbidden: permission denied",
+	) {
+		t.Fatalf("expected permission error, got %v", err)
+	}
+}
@@ -72,12 +72,7 @@ func GenerateCA(signer crypto.Signer, lifetime time.Duration) ([]byte, error) {
 		return nil, err
 	}
 
-	// Set CA-specific fields.
-	template.BasicConstraintsValid = true
-	template.IsCA = true
-	template.MaxPathLen = maxPathLength
-	template.KeyUsage |= x509.KeyUsageCertSign
-	template.KeyUsage |= x509.KeyUsageContentCommitment
+	setCAFields(template)
 
 	certBytes, err := x509.CreateCertificate(
 		rand.Reader,
@@ -92,6 +87,15 @@ func GenerateCA(signer crypto.Signer, lifetime time.Duration) ([]byte, error) {
 	return certBytes, nil
 }
 
+// setCAFields sets the CA-specific fields of a template.
+func setCAFields(template *x509.Certificate) {
+	template.BasicConstraintsValid = true
+	template.IsCA = true
+	template.MaxPathLen = maxPathLength
+	template.KeyUsage |= x509.KeyUsageCertSign
+	template.KeyUsage |= x509.KeyUsageContentCommitment
+}
+
 func checkLifetimeAgainstCA(cert, ca *x509.Certificate) error {
 	if ca.NotAfter.After(cert.NotAfter) || ca.NotAfter.Equal(cert.NotAfter) {
 		return nil
@@ -123,6 +127,17 @@ func GenerateServerCert(
 		return nil, err
 	}
 
+	return signServerCert(template, caCert, caPrivateKey, nodePublicKey, hosts)
+}
+
+// signServerCert completes the template of a server certificate and signs it.
+func signServerCert(
+	template *x509.Certificate,
+	caCert *x509.Certificate,
+	caPrivateKey crypto.PrivateKey,
+	nodePublicKey crypto.PublicKey,
+	hosts []string,
+) ([]byte, error) {
 	// Don't issue certificates that outlast the CA cert.
 	if err := checkLifetimeAgainstCA(template, caCert); err != nil {
 		return nil, err
@@ -208,6 +223,16 @@ func GenerateClientCert(
 		return nil, err
 	}
 
+	return signClientCert(template, caCert, caPrivateKey, clientPublicKey)
+}
+
+// signClientCert completes the template of a client certificate and signs it.
+func signClientCert(
+	template *x509.Certificate,
+	caCert *x509.Certificate,
+	caPrivateKey crypto.PrivateKey,
+	clientPublicKey crypto.PublicKey,
+) ([]byte, error) {
 	// Don't issue certificates that outlast the CA cert.
 	if err := checkLifetimeAgainstCA(template, caCert); err != nil {
 		return nil, err